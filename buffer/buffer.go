@@ -31,107 +31,99 @@ func ConvertToInt64LE(byteSlice []byte) int64 {
 			(uint64(byteSlice[7]) << 56))
 }
 
+// SizeError is returned when a length prefix read from a reader is out of
+// range, before anything is allocated for it.
+type SizeError struct {
+	What string
+	Size int32
+}
+
+func (s SizeError) Error() string {
+	return fmt.Sprintf("invalid %v size %v", s.What, s.Size)
+}
+
+// maxDocumentSize bounds the size prefix of a document, since no document
+// can be larger than the largest message a server sends.
+const maxDocumentSize = 48000000
+
+// lener is implemented by readers that know how many bytes they have left,
+// such as bytes.Reader.
+type lener interface {
+	Len() int
+}
+
+// readFull reads exactly len(buffer) bytes. A reader that ends part way
+// returns io.ErrUnexpectedEOF, and one that ends before any bytes returns
+// io.EOF.
+func readFull(reader io.Reader, buffer []byte) error {
+	_, err := io.ReadFull(reader, buffer)
+	return err
+}
+
 // ReadDocument reads a BSON ordered document from a reader, and returns the
 // number of bytes in the document and the document itself in bson.D format.
 func ReadDocument(reader io.Reader) (docSize int32, document bson.D, err error) {
-	// Read the first 4 bytes from the connection
-	docSize, err = ReadInt32LE(reader)
+	docSize, raw, err := ReadDocumentRaw(reader)
 	if err != nil {
-		return 0, nil, fmt.Errorf("error reading docsize: %v", err)
-	}
-	if docSize < 4 {
-		return 0, nil, fmt.Errorf("docSize too small")
-	}
-	documentBuffer := make([]byte, docSize-4)
-	n, err := reader.Read(documentBuffer)
-	if err != nil && err != io.EOF {
-		return 0, nil, fmt.Errorf("error reading document: %v", err)
-	}
-	if int32(n) != docSize-4 {
-		return 0, nil, fmt.Errorf("insufficient bytes read: %v instead of %v", n, docSize-4)
+		return 0, nil, err
 	}
-	if n == 0 {
-		// if the document size was only the size of the four header bytes for whatever reason,
-		// we have an empty document. We still read the 4 bytes, though.
-		if docSize == 4 {
-			return docSize, bson.D{}, nil
-		}
-		// erroneously read an empty document
-		return 0, nil, io.EOF
-	}
-	docSizeBuffer := make([]byte, 4)
-	binary.LittleEndian.PutUint32(docSizeBuffer, uint32(docSize))
-
-	// append buffers
 	document = bson.D{}
-	fullByteSlice := append(docSizeBuffer, documentBuffer...)
-	err = bson.Unmarshal(fullByteSlice, &document)
+	err = bson.Unmarshal(raw, &document)
 	if err != nil {
-		return 0, nil, fmt.Errorf("error unmarshalling query: %v", err)
+		return 0, nil, fmt.Errorf("error unmarshalling document: %v", err)
 	}
-	return
+	return docSize, document, nil
 }
 
 // ReadDocumentRaw reads a BSON ordered document from a reader, and returns the
 // number of bytes in the document and the document itself in a byte array format.
+// The size prefix is checked against the largest message size, and against
+// the bytes left in readers that know how many they have, so a corrupt prefix
+// can't cause a huge allocation.
 func ReadDocumentRaw(reader io.Reader) (docSize int32, document []byte, err error) {
-	// Read the first 4 bytes from the connection
 	docSize, err = ReadInt32LE(reader)
 	if err != nil {
-		return 0, nil, fmt.Errorf("error reading docsize: %v", err)
+		return 0, nil, err
 	}
-	if docSize < 4 {
-		return 0, nil, fmt.Errorf("docSize too small")
+	// the smallest document is the size, followed by the terminating null
+	if docSize < 5 || docSize > maxDocumentSize {
+		return 0, nil, SizeError{What: "document", Size: docSize}
 	}
-	documentBuffer := make([]byte, docSize-4)
-	n, err := reader.Read(documentBuffer)
-	if err != nil && err != io.EOF {
-		return 0, nil, fmt.Errorf("error reading document: %v", err)
+	if l, ok := reader.(lener); ok && int(docSize-4) > l.Len() {
+		return 0, nil, SizeError{What: "document", Size: docSize}
 	}
-	if int32(n) != docSize-4 {
-		return 0, nil, fmt.Errorf("insufficient bytes read: %v instead of %v", n, docSize-4)
+
+	document = make([]byte, docSize)
+	binary.LittleEndian.PutUint32(document, uint32(docSize))
+	err = readFull(reader, document[4:])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
 	}
-	if n == 0 {
-		// if the document size was only the size of the four header bytes for whatever reason,
-		// we have an empty document. We still read the 4 bytes, though.
-		if docSize == 4 {
-			return docSize, nil, nil
-		}
-		// erroneously read an empty document
-		return 0, nil, io.EOF
+	if err != nil {
+		return 0, nil, err
 	}
-	docSizeBuffer := make([]byte, 4)
-	binary.LittleEndian.PutUint32(docSizeBuffer, uint32(docSize))
-
-	// append buffers
-	document = append(docSizeBuffer, documentBuffer...)
-	return
+	if document[docSize-1] != 0 {
+		return 0, nil, fmt.Errorf("document is not null terminated")
+	}
+	return docSize, document, nil
 }
 
 // ReadInt32LE reads a 32-bit integer from a reader with little endian encoding.
 func ReadInt32LE(reader io.Reader) (int32, error) {
-	// Read the first 4 bytes from the connection
 	buffer := make([]byte, 4)
-	n, err := reader.Read(buffer)
-	if err != nil && err != io.EOF {
-		return 0, fmt.Errorf("error reading from connection: %v", err)
-	}
-	if n != 4 {
-		return 0, fmt.Errorf("insufficient data")
+	err := readFull(reader, buffer)
+	if err != nil {
+		return 0, err
 	}
 	return ConvertToInt32LE(buffer), nil
 }
 
 // ReadInt64LE reads a 64-bit long from a reader with little endian encoding.
 func ReadInt64LE(reader io.Reader) (int64, error) {
-	// Read the first 4 bytes from the connection
 	buffer := make([]byte, 8)
-	n, err := reader.Read(buffer)
-	if err != nil && err != io.EOF {
-		return 0, fmt.Errorf("error reading from connection: %v", err)
-	}
-	if n != 8 {
-		return 0, fmt.Errorf("insufficient data")
+	err := readFull(reader, buffer)
+	if err != nil {
+		return 0, err
 	}
 	return ConvertToInt64LE(buffer), nil
 }
@@ -150,17 +142,17 @@ func ReadNullTerminatedString(reader io.Reader, maxSize int32) (int32, string, e
 		if numRead >= maxSize {
 			return 0, "", fmt.Errorf("read too many bytes")
 		}
-		n, err := reader.Read(buffer)
-		if err != nil && err != io.EOF {
-			return 0, "", fmt.Errorf("error reading null string from connection: %v", err)
+		err := readFull(reader, buffer)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
-		if n != 1 {
-			return 0, "", fmt.Errorf("insufficient bytes read")
+		if err != nil {
+			return 0, "", err
 		}
 		if buffer[0] == '\x00' {
 			break
 		}
-		numRead += int32(n)
+		numRead++
 		stringBuffer = append(stringBuffer, buffer[0])
 	}
 	return numRead + 1, string(stringBuffer), nil
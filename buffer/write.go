@@ -8,6 +8,9 @@ import (
 // WriteToBuf takes in a buffer and writes the data as bytes to the buffer
 // in the order provided in the arguments. Returns an error if writing to
 // the buffer fails for any reason.
+//
+// Deprecated: WriteToBuf goes through reflection for every value. Use a
+// MessageWriter instead.
 func WriteToBuf(buf *bytes.Buffer, data ...interface{}) error {
 	for _, d := range data {
 		if err := binary.Write(buf, binary.LittleEndian, d); err != nil {
@@ -0,0 +1,109 @@
+package buffer
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+const (
+	// initial capacity of a pooled writer, enough for most commands
+	initialWriterSize = 1024
+	// writers that grew beyond this aren't put back in the pool, so that one
+	// huge message doesn't keep its memory alive
+	maxPooledWriterSize = 1024 * 1024
+)
+
+var writerPool = sync.Pool{
+	New: func() interface{} {
+		return &MessageWriter{
+			buf: make([]byte, 0, initialWriterSize),
+		}
+	},
+}
+
+// MessageWriter builds a wire protocol message in a buffer that is reused
+// from one message to the next. Lengths that are only known once the rest
+// has been written are reserved and back-patched.
+type MessageWriter struct {
+	buf []byte
+}
+
+// NewMessageWriter returns an empty writer from the pool. Release gives it
+// back once its bytes are no longer needed.
+func NewMessageWriter() *MessageWriter {
+	w := writerPool.Get().(*MessageWriter)
+	w.buf = w.buf[:0]
+	return w
+}
+
+// Release puts the writer back in the pool. Neither the writer nor the
+// slice returned by Bytes may be used after this.
+func (w *MessageWriter) Release() {
+	if cap(w.buf) > maxPooledWriterSize {
+		return
+	}
+	writerPool.Put(w)
+}
+
+// Bytes returns the message written so far.
+func (w *MessageWriter) Bytes() []byte {
+	return w.buf
+}
+
+// Len returns the number of bytes written so far.
+func (w *MessageWriter) Len() int {
+	return len(w.buf)
+}
+
+// ReserveInt32 leaves room for an int32 that is written later with
+// PatchInt32 or PatchLength, and returns its position.
+func (w *MessageWriter) ReserveInt32() int {
+	pos := len(w.buf)
+	w.buf = append(w.buf, 0, 0, 0, 0)
+	return pos
+}
+
+// PatchInt32 writes a little endian int32 at a position reserved with
+// ReserveInt32.
+func (w *MessageWriter) PatchInt32(pos int, v int32) {
+	binary.LittleEndian.PutUint32(w.buf[pos:], uint32(v))
+}
+
+// PatchLength writes the number of bytes from pos to the end of what has
+// been written at pos, which is how messages, documents and document
+// sequences are all prefixed with their length.
+func (w *MessageWriter) PatchLength(pos int) {
+	w.PatchInt32(pos, int32(len(w.buf)-pos))
+}
+
+// WriteUint8 appends a single byte.
+func (w *MessageWriter) WriteUint8(v uint8) {
+	w.buf = append(w.buf, v)
+}
+
+// WriteInt32 appends a little endian int32.
+func (w *MessageWriter) WriteInt32(v int32) {
+	w.WriteUint32(uint32(v))
+}
+
+// WriteUint32 appends a little endian uint32.
+func (w *MessageWriter) WriteUint32(v uint32) {
+	w.buf = append(w.buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// WriteInt64 appends a little endian int64.
+func (w *MessageWriter) WriteInt64(v int64) {
+	w.buf = append(w.buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24),
+		byte(v>>32), byte(v>>40), byte(v>>48), byte(v>>56))
+}
+
+// WriteCString appends a string followed by a null terminator.
+func (w *MessageWriter) WriteCString(s string) {
+	w.buf = append(w.buf, s...)
+	w.buf = append(w.buf, 0)
+}
+
+// WriteBytes appends raw bytes, such as a marshalled document.
+func (w *MessageWriter) WriteBytes(b []byte) {
+	w.buf = append(w.buf, b...)
+}
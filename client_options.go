@@ -0,0 +1,522 @@
+package gomongo
+
+import (
+	"compress/zlib"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxPoolSize            = 100
+	defaultMaxConnecting          = 2
+	defaultServerSelectionTimeout = 30 * time.Second
+	defaultHeartbeatInterval      = 10 * time.Second
+	defaultLocalThreshold         = 15 * time.Millisecond
+	// how long a check of a server may take if there's no connect timeout
+	defaultHeartbeatTimeout = 10 * time.Second
+
+	maxAppNameLength     = 128
+	minHeartbeatInterval = 500 * time.Millisecond
+	minMaxStaleness      = 90 * time.Second
+)
+
+// the authentication mechanisms a connection string may name
+var authMechanisms = map[string]bool{
+	"SCRAM-SHA-1":   true,
+	"SCRAM-SHA-256": true,
+	"MONGODB-X509":  true,
+	"MONGODB-AWS":   true,
+	"GSSAPI":        true,
+	"PLAIN":         true,
+}
+
+// the read preference modes
+var readPreferences = map[string]bool{
+	"primary":            true,
+	"primaryPreferred":   true,
+	"secondary":          true,
+	"secondaryPreferred": true,
+	"nearest":            true,
+}
+
+// ClientOptions configures how a client connects to a deployment.
+type ClientOptions struct {
+	// Hosts is the seed list of "host[:port]" addresses to connect to.
+	Hosts []string
+	// SRVHost is looked up in DNS for the seed list instead of using Hosts,
+	// as with mongodb+srv connection strings. Its TXT record may also set
+	// the replicaSet and authSource options.
+	SRVHost string
+	// SRVServiceName is the service name of the SRV records. Zero means the
+	// default of "mongodb".
+	SRVServiceName string
+	// SRVMaxHosts limits how many of the hosts found through SRV are used,
+	// picking them at random. Zero means no limit.
+	SRVMaxHosts int
+	// Resolver does the DNS lookups for SRVHost. Nil means the system's
+	// resolver.
+	Resolver Resolver
+
+	// Database is the default database named in the connection string.
+	Database string
+	// Auth holds the credentials from the connection string, if any.
+	// Authentication isn't supported yet, so connecting with them fails.
+	Auth *Credential
+	// AppName identifies the application to the server.
+	AppName string
+	// ReplicaSet is the name of the replica set to connect to. Servers that
+	// are not members of it are ignored.
+	ReplicaSet string
+	// DirectConnection connects to the single host given, without
+	// discovering the rest of the deployment from it.
+	DirectConnection *bool
+	// LoadBalanced connects through a load balancer in front of mongos
+	// routers. The single host given is the load balancer, and nothing is
+	// discovered from it.
+	LoadBalanced *bool
+
+	// Dialer opens the connections to servers. Nil means a net.Dialer.
+	Dialer Dialer
+	// ProxyHost is a SOCKS5 proxy to connect to servers through, which is
+	// itself reached with the Dialer.
+	ProxyHost string
+	// ProxyPort is the port of the proxy. Zero means the default of 1080.
+	ProxyPort int
+	// ProxyUsername and ProxyPassword authenticate with the proxy, if set.
+	ProxyUsername string
+	ProxyPassword string
+
+	// ConnectTimeout limits how long opening a connection may take, including
+	// the TLS and MongoDB handshakes. Zero means no limit.
+	ConnectTimeout time.Duration
+	// SocketTimeout limits how long each read or write on a connection may
+	// take. Zero means no limit.
+	SocketTimeout time.Duration
+	// ServerSelectionTimeout is how long an operation may wait for a
+	// suitable server. Zero means the default of 30 seconds.
+	ServerSelectionTimeout time.Duration
+	// HeartbeatInterval is how often servers are checked in the background.
+	// Zero means the default of 10 seconds.
+	HeartbeatInterval time.Duration
+	// LocalThreshold is the latency window for choosing among suitable
+	// servers: any server whose round trip time is within it of the
+	// fastest one's may be chosen. Nil means the default of 15
+	// milliseconds, and zero means only the fastest server.
+	LocalThreshold *time.Duration
+
+	// ReadPreference is the read preference mode, such as "primary" or
+	// "secondaryPreferred". Databases, collections and queries can
+	// override the read preference with one of their own.
+	ReadPreference string
+	// ReadPreferenceTags are the tag sets that servers are matched against,
+	// in order of preference.
+	ReadPreferenceTags []map[string]string
+	// MaxStaleness is how far behind the primary a secondary may be for
+	// reads. Zero means no limit.
+	MaxStaleness time.Duration
+	// ReadPreferenceHedge enables or disables hedged reads, as
+	// ReadPreference.Hedge does.
+	ReadPreferenceHedge *bool
+
+	// WriteConcern is sent with every write, if set.
+	WriteConcern *WriteConcern
+	// RetryWrites and RetryReads carry the retryWrites and retryReads
+	// options of the connection string.
+	RetryWrites *bool
+	RetryReads  *bool
+
+	// ServerAPI declares the stable API version that every command is run
+	// under, if set.
+	ServerAPI *ServerAPI
+
+	// Compressors lists the wire compressors to offer the server during the
+	// handshake, in order of preference. Supported names are "snappy", "zlib"
+	// and "zstd"; others are ignored.
+	Compressors []string
+	// ZlibCompressionLevel is the zlib compression level, from -1 to 9. Zero
+	// and -1 use the zlib default.
+	ZlibCompressionLevel int
+
+	// MinPoolSize is the number of connections to each server that are kept
+	// open in the background.
+	MinPoolSize int
+	// MaxPoolSize is the maximum number of connections open to each server.
+	// Zero means the default of 100.
+	MaxPoolSize int
+	// MaxConnecting is the maximum number of connections each pool may be
+	// establishing at once. Zero means the default of 2.
+	MaxConnecting int
+	// WaitQueueTimeout is how long an operation waits for a connection when
+	// the pool is at its maximum size. Zero means no limit.
+	WaitQueueTimeout time.Duration
+	// MaxIdleTime is how long a connection may sit idle in the pool before it
+	// is closed. Zero means no limit.
+	MaxIdleTime time.Duration
+
+	// TLS turns on TLS for connections to every server.
+	TLS bool
+	// TLSConfig is the base configuration for TLS connections, which the
+	// other TLS options are applied on top of.
+	TLSConfig *tls.Config
+	// TLSCAFile is a PEM file of the CAs that server certificates are
+	// verified against, in addition to TLSCAs. If neither is set, the
+	// system's CAs are used.
+	TLSCAFile string
+	// TLSCAs is a pool of the CAs that server certificates are verified
+	// against.
+	TLSCAs *x509.CertPool
+	// TLSCertificateKeyFile is a PEM file holding the client certificate
+	// and its private key, presented to servers that ask for one.
+	TLSCertificateKeyFile string
+	// TLSCertificates are client certificates presented to servers that ask
+	// for one.
+	TLSCertificates []tls.Certificate
+	// TLSServerName overrides the hostname that server certificates are
+	// verified against, which is otherwise the host being connected to.
+	TLSServerName string
+	// TLSAllowInvalidHostnames skips checking that the server certificate
+	// is valid for its hostname. The certificate chain is still verified.
+	TLSAllowInvalidHostnames bool
+	// TLSAllowInvalidCertificates skips verifying server certificates. Go
+	// checks the hostname as part of the certificate, so that is skipped too.
+	TLSAllowInvalidCertificates bool
+	// TLSInsecure skips verifying server certificates altogether, as
+	// TLSAllowInvalidCertificates and TLSAllowInvalidHostnames do together.
+	// It is only meant for development.
+	TLSInsecure bool
+}
+
+// Credential holds what is needed to authenticate a client.
+type Credential struct {
+	Username string
+	Password string
+	// PasswordSet distinguishes an empty password from no password.
+	PasswordSet bool
+	// Source is the database that holds the user's credentials.
+	Source string
+	// Mechanism is the authentication mechanism, such as "SCRAM-SHA-256".
+	// It is negotiated with the server if empty.
+	Mechanism           string
+	MechanismProperties map[string]string
+}
+
+// WriteConcern describes the acknowledgement requested from the server for
+// writes.
+type WriteConcern struct {
+	// W is the number of members that must acknowledge a write, or a tag
+	// such as "majority". Nil leaves it to the server.
+	W interface{}
+	// Journal requests that writes are written to the journal before they
+	// are acknowledged.
+	Journal *bool
+	// WTimeout limits how long the server waits for acknowledgement.
+	WTimeout time.Duration
+}
+
+// ServerAPIVersion1 is version 1 of the stable API.
+const ServerAPIVersion1 = "1"
+
+// ServerAPI declares the stable API version the client is written against,
+// so that the server rejects or warns about behaviour outside of it.
+type ServerAPI struct {
+	// Version is the API version, such as ServerAPIVersion1.
+	Version string
+	// Strict makes the server fail commands that aren't part of the API
+	// version.
+	Strict *bool
+	// DeprecationErrors makes the server fail commands that the API version
+	// deprecates.
+	DeprecationErrors *bool
+}
+
+// document returns the fields declaring the API version on a command.
+func (a *ServerAPI) document() bson.D {
+	doc := bson.D{{"apiVersion", a.Version}}
+	if a.Strict != nil {
+		doc = append(doc, bson.DocElem{"apiStrict", *a.Strict})
+	}
+	if a.DeprecationErrors != nil {
+		doc = append(doc, bson.DocElem{"apiDeprecationErrors", *a.DeprecationErrors})
+	}
+	return doc
+}
+
+func (a *ServerAPI) validate() error {
+	if a.Version != ServerAPIVersion1 {
+		return fmt.Errorf("unsupported server API version %q", a.Version)
+	}
+	return nil
+}
+
+// document returns the write concern as a writeConcern command field.
+func (w *WriteConcern) document() bson.D {
+	doc := bson.D{}
+	if w.W != nil {
+		doc = append(doc, bson.DocElem{"w", w.W})
+	}
+	if w.Journal != nil {
+		doc = append(doc, bson.DocElem{"j", *w.Journal})
+	}
+	if w.WTimeout > 0 {
+		doc = append(doc, bson.DocElem{"wtimeout", int64(w.WTimeout / time.Millisecond)})
+	}
+	return doc
+}
+
+// unacknowledged returns whether writes are sent without waiting for the
+// server to reply.
+func (w *WriteConcern) unacknowledged() bool {
+	if w == nil {
+		return false
+	}
+	n, ok := w.W.(int)
+	return ok && n == 0
+}
+
+func (w *WriteConcern) validate() error {
+	switch v := w.W.(type) {
+	case nil:
+	case int:
+		if v < 0 {
+			return fmt.Errorf("w can't be negative")
+		}
+		if v == 0 && w.Journal != nil && *w.Journal {
+			return fmt.Errorf("w=0 conflicts with journal=true")
+		}
+	case string:
+		if v == "" {
+			return fmt.Errorf("w can't be empty")
+		}
+	default:
+		return fmt.Errorf("w must be a number or a tag name, not %T", w.W)
+	}
+	if w.WTimeout < 0 {
+		return fmt.Errorf("wtimeout can't be negative")
+	}
+	return nil
+}
+
+func (c *Credential) validate() error {
+	if c.Mechanism != "" && !authMechanisms[c.Mechanism] {
+		return fmt.Errorf("unknown authentication mechanism %v", c.Mechanism)
+	}
+	if c.Mechanism == "" && c.MechanismProperties != nil {
+		return fmt.Errorf("authMechanismProperties need an authMechanism")
+	}
+	switch c.Mechanism {
+	case "MONGODB-X509":
+		if c.PasswordSet {
+			return fmt.Errorf("MONGODB-X509 doesn't use a password")
+		}
+		if c.Source != "" && c.Source != "$external" {
+			return fmt.Errorf("MONGODB-X509 credentials are in $external, not %v", c.Source)
+		}
+	case "MONGODB-AWS":
+		if c.Username != "" && !c.PasswordSet {
+			return fmt.Errorf("MONGODB-AWS needs a password with the username")
+		}
+	case "GSSAPI", "PLAIN":
+		if c.Username == "" {
+			return fmt.Errorf("%v needs a username", c.Mechanism)
+		}
+		if c.Mechanism == "GSSAPI" && c.Source != "" && c.Source != "$external" {
+			return fmt.Errorf("GSSAPI credentials are in $external, not %v", c.Source)
+		}
+	default:
+		if c.Username == "" {
+			return fmt.Errorf("authentication needs a username")
+		}
+	}
+	return nil
+}
+
+// authSource returns the database that holds the user's credentials, which
+// defaults to the database in the connection string, and then to admin.
+func (o *ClientOptions) authSource() string {
+	if o.Auth != nil && o.Auth.Source != "" {
+		return o.Auth.Source
+	}
+	if o.Database != "" {
+		return o.Database
+	}
+	return "admin"
+}
+
+// writeConcern returns the write concern, creating an empty one if there is
+// none yet.
+func (o *ClientOptions) writeConcern() *WriteConcern {
+	if o.WriteConcern == nil {
+		o.WriteConcern = &WriteConcern{}
+	}
+	return o.WriteConcern
+}
+
+// loadBalanced returns whether the client connects through a load balancer.
+func (o *ClientOptions) loadBalanced() bool {
+	return o.LoadBalanced != nil && *o.LoadBalanced
+}
+
+func (o *ClientOptions) validate() error {
+	if len(o.Hosts) == 0 && o.SRVHost == "" {
+		return fmt.Errorf("no hosts to connect to")
+	}
+	if o.DirectConnection != nil && *o.DirectConnection && (len(o.Hosts) > 1 || o.SRVHost != "") {
+		return fmt.Errorf("a direct connection can't have more than one host")
+	}
+	if o.SRVHost == "" && (o.SRVServiceName != "" || o.SRVMaxHosts != 0) {
+		return fmt.Errorf("srvServiceName and srvMaxHosts need an SRV host")
+	}
+	if o.SRVMaxHosts < 0 {
+		return fmt.Errorf("srvMaxHosts can't be negative")
+	}
+	if o.SRVMaxHosts > 0 && o.ReplicaSet != "" {
+		return fmt.Errorf("srvMaxHosts can't be used with replicaSet")
+	}
+	if o.loadBalanced() {
+		if len(o.Hosts) > 1 {
+			return fmt.Errorf("loadBalanced can't have more than one host")
+		}
+		if o.ReplicaSet != "" {
+			return fmt.Errorf("loadBalanced can't be used with replicaSet")
+		}
+		if o.DirectConnection != nil && *o.DirectConnection {
+			return fmt.Errorf("loadBalanced can't be used with directConnection")
+		}
+		if o.SRVMaxHosts > 0 {
+			return fmt.Errorf("loadBalanced can't be used with srvMaxHosts")
+		}
+	}
+	if o.ProxyHost == "" && (o.ProxyPort != 0 || o.ProxyUsername != "" || o.ProxyPassword != "") {
+		return fmt.Errorf("proxy options need a proxyHost")
+	}
+	if o.ProxyPort < 0 || o.ProxyPort > 65535 {
+		return fmt.Errorf("proxyPort must be between 0 and 65535")
+	}
+	if (o.ProxyUsername == "") != (o.ProxyPassword == "") {
+		return fmt.Errorf("proxyUsername and proxyPassword must be set together")
+	}
+	if len(o.ProxyUsername) > 255 || len(o.ProxyPassword) > 255 {
+		return fmt.Errorf("proxyUsername and proxyPassword can't be longer than 255 bytes")
+	}
+	if len(o.AppName) > maxAppNameLength {
+		return fmt.Errorf("appName is longer than %v bytes", maxAppNameLength)
+	}
+	if o.ConnectTimeout < 0 || o.SocketTimeout < 0 || o.ServerSelectionTimeout < 0 ||
+		o.WaitQueueTimeout < 0 || o.MaxIdleTime < 0 || (o.LocalThreshold != nil && *o.LocalThreshold < 0) {
+		return fmt.Errorf("timeouts can't be negative")
+	}
+	if o.HeartbeatInterval != 0 && o.HeartbeatInterval < minHeartbeatInterval {
+		return fmt.Errorf("heartbeatFrequencyMS can't be less than %v", minHeartbeatInterval)
+	}
+	if o.MinPoolSize < 0 || o.MaxPoolSize < 0 || o.MaxConnecting < 0 {
+		return fmt.Errorf("pool sizes can't be negative")
+	}
+	if o.MinPoolSize > o.maxPoolSize() {
+		return fmt.Errorf("minPoolSize %v is greater than maxPoolSize %v", o.MinPoolSize, o.maxPoolSize())
+	}
+	if !o.TLS && (o.TLSConfig != nil || o.TLSCAFile != "" || o.TLSCAs != nil || o.TLSCertificateKeyFile != "" ||
+		len(o.TLSCertificates) > 0 || o.TLSServerName != "" || o.TLSAllowInvalidHostnames ||
+		o.TLSAllowInvalidCertificates || o.TLSInsecure) {
+		return fmt.Errorf("TLS options are set but TLS is off")
+	}
+	if o.TLSInsecure && (o.TLSAllowInvalidHostnames || o.TLSAllowInvalidCertificates) {
+		return fmt.Errorf("tlsInsecure already allows invalid certificates and hostnames")
+	}
+	if o.ZlibCompressionLevel < -1 || o.ZlibCompressionLevel > 9 {
+		return fmt.Errorf("zlibCompressionLevel must be from -1 to 9")
+	}
+
+	err := o.readPreference().validate(o.heartbeatInterval())
+	if err != nil {
+		return err
+	}
+
+	if o.WriteConcern != nil {
+		err := o.WriteConcern.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if o.ServerAPI != nil {
+		err := o.ServerAPI.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if o.Auth != nil {
+		err := o.Auth.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if strings.ContainsAny(o.Database, "/\\ .\"$") {
+		return fmt.Errorf("invalid database name %v", o.Database)
+	}
+	return nil
+}
+
+func (o *ClientOptions) maxPoolSize() int {
+	if o.MaxPoolSize == 0 {
+		return defaultMaxPoolSize
+	}
+	return o.MaxPoolSize
+}
+
+func (o *ClientOptions) maxConnecting() int {
+	if o.MaxConnecting == 0 {
+		return defaultMaxConnecting
+	}
+	return o.MaxConnecting
+}
+
+func (o *ClientOptions) serverSelectionTimeout() time.Duration {
+	if o.ServerSelectionTimeout == 0 {
+		return defaultServerSelectionTimeout
+	}
+	return o.ServerSelectionTimeout
+}
+
+func (o *ClientOptions) heartbeatInterval() time.Duration {
+	if o.HeartbeatInterval == 0 {
+		return defaultHeartbeatInterval
+	}
+	return o.HeartbeatInterval
+}
+
+func (o *ClientOptions) localThreshold() time.Duration {
+	if o.LocalThreshold == nil {
+		return defaultLocalThreshold
+	}
+	return *o.LocalThreshold
+}
+
+func (o *ClientOptions) heartbeatTimeout() time.Duration {
+	if o.ConnectTimeout == 0 {
+		return defaultHeartbeatTimeout
+	}
+	return o.ConnectTimeout
+}
+
+// compressors returns the compressors to offer the server, leaving out the
+// ones that aren't supported.
+func (o *ClientOptions) compressors() []string {
+	var names []string
+	for _, name := range o.Compressors {
+		_, err := newCompressor(name, o.zlibLevel())
+		if err == nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (o *ClientOptions) zlibLevel() int {
+	if o.ZlibCompressionLevel == 0 {
+		return zlib.DefaultCompression
+	}
+	return o.ZlibCompressionLevel
+}
@@ -0,0 +1,66 @@
+// Command gomongo-proxy sits between applications and a MongoDB server. It
+// logs every command with how long the server took to answer it, and can
+// refuse what clients aren't meant to do and rename the namespaces they use.
+//
+// Usage:
+//
+//	gomongo-proxy [-listen localhost:27018] [-upstream localhost:27017] [flags]
+//
+// Clients connect to the listen address as if it were the server, with
+// directConnection=true if the server is part of a replica set, since the
+// addresses the server gives out aren't the proxy's.
+//
+// With -read-only, only commands known to read are let through, such as
+// find, getMore, count, distinct and aggregate without $out or $merge, along
+// with the commands needed to connect and log in. Everything else is
+// refused. With -block-unfiltered, updates with multi and deletes with a
+// limit of 0 are refused if their filter is empty. With -databases, only the
+// listed databases may be used, apart from the commands needed to connect
+// and log in. Legacy OP_KILL_CURSORS messages name no database, so they are
+// dropped then. Refused requests get an Unauthorized error, except those the
+// client expects no answer to, which are dropped.
+//
+// Each -rewrite from=to renames a database, or a collection if both sides
+// are full namespaces, in the requests sent to the server. Policies apply to
+// the names the client uses. TLS isn't supported, on either side of the
+// proxy.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dmliao/gomongo/wireserver"
+	"log"
+	"os"
+)
+
+func main() {
+	listen := flag.String("listen", "localhost:27018", "address to accept clients on")
+	upstream := flag.String("upstream", "localhost:27017", "address of the server")
+	readOnly := flag.Bool("read-only", false, "refuse commands that write")
+	blockUnfiltered := flag.Bool("block-unfiltered", false, "refuse multi updates and deletes with an empty filter")
+	databases := flag.String("databases", "", "comma separated databases clients may use, or all if empty")
+	var rewrites rewriteFlag
+	flag.Var(&rewrites, "rewrite", "rename a database or namespace, as from=to (repeatable)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: gomongo-proxy [flags]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logger := log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds)
+	handler := newProxy(*upstream, &policy{
+		readOnly:        *readOnly,
+		blockUnfiltered: *blockUnfiltered,
+		databases:       parseDatabases(*databases),
+	}, &rewriter{
+		rules: rewrites,
+	}, logger)
+	logger.Printf("proxying %v to %v", *listen, *upstream)
+	err := wireserver.ListenAndServe(*listen, handler)
+	logger.Fatal(err)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"github.com/dmliao/gomongo"
+	"github.com/dmliao/gomongo/wireserver"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+)
+
+// operation is what a request asks the server to do, as far as logging and
+// policies need to know.
+type operation struct {
+	// the command name, or the name of the operation of a legacy opcode
+	name       string
+	database   string
+	collection string
+	// the command document, for commands
+	command bson.D
+	// the update or delete statements of a write, each with its filter in
+	// "q" and, for an update, "multi", or for a delete, "limit"
+	statements []bson.D
+}
+
+// namespace returns the database and collection the operation works on.
+func (o *operation) namespace() string {
+	if o.collection == "" {
+		return o.database
+	}
+	return o.database + "." + o.collection
+}
+
+// parseOperation works out what a request asks for. Requests that can't be
+// understood come back as an operation named after their opcode.
+func parseOperation(request wireserver.Request) *operation {
+	switch r := request.(type) {
+	case *gomongo.OpMsg:
+		var command bson.D
+		var sequences []gomongo.MsgSection
+		for _, section := range r.Sections {
+			if section.Kind == 0 && len(section.Documents) == 1 {
+				bson.Unmarshal(section.Documents[0], &command)
+			} else if section.Kind == 1 {
+				sequences = append(sequences, section)
+			}
+		}
+		op := commandOperation(command, "")
+		for _, sequence := range sequences {
+			if sequence.Identifier != "updates" && sequence.Identifier != "deletes" {
+				continue
+			}
+			for _, doc := range sequence.Documents {
+				var statement bson.D
+				bson.Unmarshal(doc, &statement)
+				op.statements = append(op.statements, statement)
+			}
+		}
+		return op
+	case *gomongo.OpQuery:
+		database, collection := splitNamespace(r.FullCollectionName)
+		if collection == "$cmd" {
+			var command bson.D
+			bson.Unmarshal(r.Query.(bson.Raw).Data, &command)
+			// a command may be wrapped with the read preference
+			if query, ok := lookup(command, "$query").(bson.D); ok {
+				command = query
+			}
+			return commandOperation(command, database)
+		}
+		return &operation{
+			name:       "query",
+			database:   database,
+			collection: collection,
+		}
+	case *gomongo.OpGetMore:
+		return legacyOperation("getMore", r.FullCollectionName)
+	case *gomongo.OpKillCursors:
+		return &operation{
+			name: "killCursors",
+		}
+	case *gomongo.OpInsert:
+		return legacyOperation("insert", r.FullCollectionName)
+	case *gomongo.OpUpdate:
+		op := legacyOperation("update", r.FullCollectionName)
+		var selector bson.D
+		bson.Unmarshal(r.Selector.(bson.Raw).Data, &selector)
+		op.statements = []bson.D{{
+			{"q", selector},
+			{"multi", r.Flags&2 != 0},
+		}}
+		return op
+	case *gomongo.OpDelete:
+		op := legacyOperation("delete", r.FullCollectionName)
+		var selector bson.D
+		bson.Unmarshal(r.Selector.(bson.Raw).Data, &selector)
+		limit := 0
+		if r.Flags&1 != 0 {
+			limit = 1
+		}
+		op.statements = []bson.D{{
+			{"q", selector},
+			{"limit", limit},
+		}}
+		return op
+	}
+	return &operation{
+		name: "unknown",
+	}
+}
+
+// commandOperation describes a command. The database comes from $db, or
+// from the namespace of a legacy command.
+func commandOperation(command bson.D, database string) *operation {
+	op := &operation{
+		name:     "unknown",
+		database: database,
+		command:  command,
+	}
+	if len(command) == 0 {
+		return op
+	}
+	op.name = command[0].Name
+	if db, ok := lookup(command, "$db").(string); ok {
+		op.database = db
+	}
+	op.collection = commandCollection(command)
+	for _, field := range []string{"updates", "deletes"} {
+		statements, _ := lookup(command, field).([]interface{})
+		for _, statement := range statements {
+			if doc, ok := statement.(bson.D); ok {
+				op.statements = append(op.statements, doc)
+			}
+		}
+	}
+	return op
+}
+
+// commandCollection returns the collection a command works on, which is
+// the value of the command name for most commands that have one.
+func commandCollection(command bson.D) string {
+	switch command[0].Name {
+	case "getMore":
+		collection, _ := lookup(command, "collection").(string)
+		return collection
+	case "renameCollection":
+		// the collections are full namespaces of the admin command
+		return ""
+	}
+	collection, _ := command[0].Value.(string)
+	return collection
+}
+
+func legacyOperation(name string, namespace string) *operation {
+	database, collection := splitNamespace(namespace)
+	return &operation{
+		name:       name,
+		database:   database,
+		collection: collection,
+	}
+}
+
+// splitNamespace splits a namespace at its first dot into the database and
+// the collection, which may have dots of its own.
+func splitNamespace(namespace string) (string, string) {
+	i := strings.IndexByte(namespace, '.')
+	if i < 0 {
+		return namespace, ""
+	}
+	return namespace[:i], namespace[i+1:]
+}
+
+// lookup returns the value of a field of a document, or nil.
+func lookup(doc bson.D, name string) interface{} {
+	for _, elem := range doc {
+		if elem.Name == name {
+			return elem.Value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+)
+
+// commands that only read, which are all a read-only proxy lets through
+// besides the connection commands. Anything not listed is refused, since
+// there is no telling what a command the proxy doesn't know does.
+var readCommands = map[string]bool{
+	"find":     true,
+	"getMore":  true,
+	"count":    true,
+	"distinct": true,
+	// unless it ends with $out or $merge
+	"aggregate":       true,
+	"explain":         true,
+	"listCollections": true,
+	"listIndexes":     true,
+	"listDatabases":   true,
+	"dbStats":         true,
+	"dbstats":         true,
+	"collStats":       true,
+	"collstats":       true,
+	"dataSize":        true,
+	"datasize":        true,
+	"serverStatus":    true,
+	"hostInfo":        true,
+	"killCursors":     true,
+	// the legacy opcodes that read
+	"query": true,
+}
+
+// commands that any client may run whichever databases it is restricted
+// to, since connecting and logging in need them
+var connectionCommands = map[string]bool{
+	"hello":        true,
+	"isMaster":     true,
+	"ismaster":     true,
+	"ping":         true,
+	"buildInfo":    true,
+	"buildinfo":    true,
+	"saslStart":    true,
+	"saslContinue": true,
+	"getnonce":     true,
+	"authenticate": true,
+	"logout":       true,
+	"endSessions":  true,
+}
+
+// policy decides which operations the proxy passes on. The zero value lets
+// everything through.
+type policy struct {
+	readOnly bool
+	// refuse updates and deletes of many documents with an empty filter
+	blockUnfiltered bool
+	// the databases clients may use, or nil for all of them
+	databases map[string]bool
+}
+
+// check returns why an operation is refused, or nil if it may go ahead.
+// Databases are checked as the client named them, before any rewriting.
+func (p *policy) check(op *operation) error {
+	if p.readOnly && !isRead(op) {
+		return fmt.Errorf("%v is not allowed, the proxy is read-only", op.name)
+	}
+	if p.blockUnfiltered {
+		for _, statement := range op.statements {
+			if isUnfiltered(statement) {
+				return fmt.Errorf("%v without a filter is not allowed on many documents", op.name)
+			}
+		}
+	}
+	if p.databases != nil && !connectionCommands[op.name] && !p.databases[op.database] {
+		return fmt.Errorf("database %q is not allowed", op.database)
+	}
+	return nil
+}
+
+// isRead returns whether an operation is known to change nothing.
+func isRead(op *operation) bool {
+	if connectionCommands[op.name] {
+		return true
+	}
+	if !readCommands[op.name] {
+		return false
+	}
+	if op.name == "aggregate" {
+		// only the last stage of a pipeline can write
+		pipeline, _ := lookup(op.command, "pipeline").([]interface{})
+		if len(pipeline) > 0 {
+			stage, _ := pipeline[len(pipeline)-1].(bson.D)
+			if len(stage) > 0 && (stage[0].Name == "$out" || stage[0].Name == "$merge") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isUnfiltered returns whether an update or delete statement applies to
+// every document of a collection.
+func isUnfiltered(statement bson.D) bool {
+	filter, ok := lookup(statement, "q").(bson.D)
+	if lookup(statement, "q") != nil && (!ok || len(filter) > 0) {
+		return false
+	}
+	if multi, ok := lookup(statement, "multi").(bool); ok {
+		return multi
+	}
+	// a delete statement with a limit of 0 deletes every match
+	switch limit := lookup(statement, "limit").(type) {
+	case int:
+		return limit == 0
+	case int64:
+		return limit == 0
+	case float64:
+		return limit == 0
+	}
+	return false
+}
+
+// parseDatabases reads a comma separated list of databases.
+func parseDatabases(list string) map[string]bool {
+	if list == "" {
+		return nil
+	}
+	databases := map[string]bool{}
+	for _, database := range strings.Split(list, ",") {
+		databases[strings.TrimSpace(database)] = true
+	}
+	return databases
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/dmliao/gomongo"
+	"github.com/dmliao/gomongo/wireserver"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the code of the error a refused request gets, which is the server's code
+// for an unauthorized command
+const refusedCode = 13
+
+// proxy is a wireserver.Handler that passes the requests of each client
+// connection on to a connection of its own to the server, and the replies
+// back.
+type proxy struct {
+	upstream string
+	dialer   *net.Dialer
+	policy   *policy
+	// rewrites requests, and toClient undoes it in replies
+	toServer *rewriter
+	toClient *rewriter
+	log      *log.Logger
+
+	mu    sync.Mutex
+	conns map[*wireserver.Conn]*upstreamConn
+}
+
+// upstreamConn is the connection to the server for one client connection.
+type upstreamConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newProxy(upstream string, policy *policy, rewriter *rewriter, logger *log.Logger) *proxy {
+	return &proxy{
+		upstream: upstream,
+		dialer: &net.Dialer{
+			Timeout: 10 * time.Second,
+		},
+		policy:   policy,
+		toServer: rewriter,
+		toClient: rewriter.reverse(),
+		log:      logger,
+		conns:    map[*wireserver.Conn]*upstreamConn{},
+	}
+}
+
+// connect returns the server connection of a client connection, opening it
+// on the first request. Sessions, cursors and logins belong to a
+// connection, so each client gets a server connection of its own.
+func (p *proxy) connect(conn *wireserver.Conn) (*upstreamConn, error) {
+	p.mu.Lock()
+	upstream := p.conns[conn]
+	p.mu.Unlock()
+	if upstream != nil {
+		return upstream, nil
+	}
+
+	netConn, err := p.dialer.Dial("tcp", p.upstream)
+	if err != nil {
+		return nil, err
+	}
+	upstream = &upstreamConn{
+		conn:   netConn,
+		reader: bufio.NewReader(netConn),
+	}
+	p.mu.Lock()
+	p.conns[conn] = upstream
+	p.mu.Unlock()
+	return upstream, nil
+}
+
+func (p *proxy) HandleClose(conn *wireserver.Conn) {
+	p.mu.Lock()
+	upstream := p.conns[conn]
+	delete(p.conns, conn)
+	p.mu.Unlock()
+	if upstream != nil {
+		upstream.conn.Close()
+	}
+}
+
+func (p *proxy) Handle(conn *wireserver.Conn, request wireserver.Request) error {
+	op := parseOperation(request)
+	err := p.policy.check(op)
+	if err != nil {
+		p.logf(conn, op, 0, "refused: %v", err)
+		return refuse(conn, request, err)
+	}
+
+	err = p.toServer.request(request)
+	if err != nil {
+		p.logf(conn, op, 0, "failed: %v", err)
+		return err
+	}
+	upstream, err := p.connect(conn)
+	if err != nil {
+		p.logf(conn, op, 0, "failed: %v", err)
+		return err
+	}
+	start := time.Now()
+	err = wireserver.WriteRequest(upstream.conn, request)
+	if err != nil {
+		p.logf(conn, op, 0, "failed: %v", err)
+		return err
+	}
+	if !expectsReply(request) {
+		p.logf(conn, op, 0, "sent")
+		return nil
+	}
+
+	// an exhaust cursor streams replies until the last batch
+	responseTo := request.MessageHeader().RequestID
+	for first := true; ; first = false {
+		reply, err := wireserver.ReadReply(upstream.reader, wireserver.DefaultMaxMessageSize)
+		if err != nil {
+			p.logf(conn, op, time.Since(start), "failed: %v", err)
+			return err
+		}
+		if first {
+			p.logf(conn, op, time.Since(start), "%v", outcome(reply))
+		}
+		err = p.toClient.reply(reply)
+		if err != nil {
+			return err
+		}
+		switch r := reply.(type) {
+		case *gomongo.OpMsg:
+			responseTo, err = conn.WriteMsg(responseTo, r)
+		case *gomongo.OpResponse:
+			responseTo, err = conn.WriteReply(responseTo, r)
+		}
+		if err != nil {
+			return err
+		}
+		if !moreToCome(request, reply) {
+			return nil
+		}
+	}
+}
+
+// logf logs an operation with what came of it. The arguments of commands
+// aren't logged, since they may hold data or credentials.
+func (p *proxy) logf(conn *wireserver.Conn, op *operation, elapsed time.Duration, format string, args ...interface{}) {
+	timing := ""
+	if elapsed != 0 {
+		timing = " " + elapsed.String()
+	}
+	p.log.Printf("%v %v %v%v %v", conn.RemoteAddr(), op.name, op.namespace(), timing, fmt.Sprintf(format, args...))
+}
+
+// expectsReply returns whether the client waits for an answer to a request.
+func expectsReply(request wireserver.Request) bool {
+	switch r := request.(type) {
+	case *gomongo.OpMsg:
+		return r.FlagBits&gomongo.MSG_MORE_TO_COME == 0
+	case *gomongo.OpQuery, *gomongo.OpGetMore:
+		return true
+	}
+	return false
+}
+
+// moreToCome returns whether the server sends another reply after this one
+// without being asked, which it does for exhaust cursors.
+func moreToCome(request wireserver.Request, reply gomongo.Reply) bool {
+	switch r := reply.(type) {
+	case *gomongo.OpMsg:
+		return r.FlagBits&gomongo.MSG_MORE_TO_COME != 0
+	case *gomongo.OpResponse:
+		// the legacy exhaust flag of OP_QUERY
+		query, ok := request.(*gomongo.OpQuery)
+		return ok && query.Flags&(1<<6) != 0 && r.CursorID != 0 && r.ResponseFlags&2 == 0
+	}
+	return false
+}
+
+// outcome sums up the first reply to a request for the log.
+func outcome(reply gomongo.Reply) string {
+	documents := reply.Documents()
+	if len(documents) == 0 {
+		return "ok"
+	}
+	var result struct {
+		Ok          interface{} `bson:"ok"`
+		Errmsg      string      `bson:"errmsg"`
+		Err         string      `bson:"$err"`
+		WriteErrors []struct {
+			Errmsg string `bson:"errmsg"`
+		} `bson:"writeErrors"`
+	}
+	err := bson.Unmarshal(documents[0], &result)
+	if err != nil {
+		return "invalid reply: " + err.Error()
+	}
+	if r, ok := reply.(*gomongo.OpResponse); ok && r.ResponseFlags&2 != 0 {
+		return "error: " + result.Err
+	}
+	switch ok := result.Ok.(type) {
+	case float64:
+		if ok == 0 {
+			return "error: " + result.Errmsg
+		}
+	case int:
+		if ok == 0 {
+			return "error: " + result.Errmsg
+		}
+	}
+	if len(result.WriteErrors) > 0 {
+		messages := make([]string, len(result.WriteErrors))
+		for i, writeError := range result.WriteErrors {
+			messages[i] = writeError.Errmsg
+		}
+		return "write errors: " + strings.Join(messages, "; ")
+	}
+	return "ok"
+}
+
+// refuse answers a request the policy doesn't allow with an error. Requests
+// that get no answer are dropped.
+func refuse(conn *wireserver.Conn, request wireserver.Request, reason error) error {
+	message := "gomongo-proxy: " + reason.Error()
+	if query, ok := request.(*gomongo.OpQuery); ok && !strings.HasSuffix(query.FullCollectionName, ".$cmd") {
+		doc, err := bson.Marshal(bson.D{{"$err", message}, {"code", refusedCode}})
+		if err != nil {
+			return err
+		}
+		_, err = conn.WriteReply(query.Header.RequestID, &gomongo.OpResponse{
+			ResponseFlags: 2, // query failure
+			Document:      [][]byte{doc},
+		})
+		return err
+	}
+	return conn.Respond(request, bson.D{
+		{"ok", 0},
+		{"errmsg", message},
+		{"code", refusedCode},
+		{"codeName", "Unauthorized"},
+	})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"github.com/dmliao/gomongo"
+	"github.com/dmliao/gomongo/wireserver"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// upstreamServer is the server behind the proxy. It answers every command
+// with ok, and find with a single document, and records what it was sent.
+type upstreamServer struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+func (u *upstreamServer) Handle(conn *wireserver.Conn, request wireserver.Request) error {
+	var command bson.D
+	switch r := request.(type) {
+	case *gomongo.OpQuery:
+		err := r.Query.(bson.Raw).Unmarshal(&command)
+		if err != nil {
+			return err
+		}
+	case *gomongo.OpMsg:
+		err := bson.Unmarshal(r.Sections[0].Documents[0], &command)
+		if err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	u.mu.Lock()
+	u.commands = append(u.commands, command[0].Name)
+	u.mu.Unlock()
+
+	switch command[0].Name {
+	case "hello", "isMaster", "ismaster":
+		return conn.Respond(request, bson.M{"ismaster": true, "maxWireVersion": 13, "ok": 1})
+	case "find":
+		namespace := lookup(command, "$db").(string) + "." + command[0].Value.(string)
+		return conn.Respond(request, bson.M{"ok": 1, "cursor": bson.M{
+			"id":         int64(0),
+			"ns":         namespace,
+			"firstBatch": []bson.M{{"_id": 1}},
+		}})
+	}
+	return conn.Respond(request, bson.M{"ok": 1})
+}
+
+// received returns whether the upstream server was sent the command.
+func (u *upstreamServer) received(name string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, command := range u.commands {
+		if command == name {
+			return true
+		}
+	}
+	return false
+}
+
+// startProxy starts an upstream server and a proxy in front of it with the
+// policy, and connects a client to the proxy.
+func startProxy(t *testing.T, policy *policy) (*upstreamServer, gomongo.Mongo) {
+	upstream := &upstreamServer{}
+	upstreamListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &wireserver.Server{
+		Handler: upstream,
+	}
+	go backend.Serve(upstreamListener)
+	t.Cleanup(func() {
+		backend.Close()
+	})
+
+	p := newProxy(upstreamListener.Addr().String(), policy, &rewriter{}, log.New(ioutil.Discard, "", 0))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &wireserver.Server{
+		Handler: p,
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() {
+		server.Close()
+	})
+
+	m, err := gomongo.Connect(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		m.Close()
+	})
+	return upstream, m
+}
+
+// refusal runs a command and returns the error message of its reply, which
+// is empty if the command succeeded.
+func refusal(db gomongo.Database, command bson.D) (string, error) {
+	var result struct {
+		ErrMsg string `bson:"errmsg"`
+	}
+	err := db.ExecuteCommand(command, &result)
+	return result.ErrMsg, err
+}
+
+func TestReadOnly(t *testing.T) {
+	upstream, m := startProxy(t, &policy{readOnly: true})
+	db := m.GetDB("test")
+
+	_, err := db.GetCollection("foo").Insert(bson.M{"a": 1})
+	if err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Errorf("insert through a read-only proxy: %v", err)
+	}
+	// commands the proxy doesn't know are refused as well as writes
+	commands := []bson.D{
+		{{"fsync", 1}},
+		{{"bulkWrite", 1}, {"ops", []bson.M{}}, {"nsInfo", []bson.M{}}},
+		{{"setParameter", 1}, {"logLevel", 1}},
+		{{"aggregate", "foo"}, {"pipeline", []bson.M{{"$out": "bar"}}}, {"cursor", bson.M{}}},
+	}
+	for _, command := range commands {
+		refused, err := refusal(m.GetDB("admin"), command)
+		if err != nil || !strings.Contains(refused, "read-only") {
+			t.Errorf("%v through a read-only proxy: %q, %v", command[0].Name, refused, err)
+		}
+		if upstream.received(command[0].Name) {
+			t.Errorf("%v reached the server", command[0].Name)
+		}
+	}
+	if upstream.received("insert") {
+		t.Error("insert reached the server")
+	}
+
+	cursor, err := db.GetCollection("foo").Find(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.M
+	err = cursor.Next(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused, err := refusal(db, bson.D{{"count", "foo"}})
+	if err != nil || refused != "" {
+		t.Errorf("count through a read-only proxy: %q, %v", refused, err)
+	}
+}
+
+func TestDatabases(t *testing.T) {
+	upstream, m := startProxy(t, &policy{databases: parseDatabases("test")})
+
+	_, err := m.GetDB("test").GetCollection("foo").Find(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.GetDB("secret").GetCollection("foo").Find(nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("find on another database: %v", err)
+	}
+	refused, err := refusal(m.GetDB("secret"), bson.D{{"killCursors", "foo"}, {"cursors", []int64{1}}})
+	if err != nil || !strings.Contains(refused, "not allowed") {
+		t.Errorf("killCursors on another database: %q, %v", refused, err)
+	}
+	if upstream.received("killCursors") {
+		t.Error("killCursors reached the server")
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"github.com/dmliao/gomongo"
+	"github.com/dmliao/gomongo/wireserver"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+)
+
+// rewriteRule renames a database, or a collection if from has a dot in it.
+type rewriteRule struct {
+	from string
+	to   string
+}
+
+// rewriter renames the namespaces of requests on their way to the server,
+// and the namespaces of cursors in replies on their way back. Only the
+// namespace a command works on is renamed, not collections named inside
+// it, such as those of $lookup stages.
+type rewriter struct {
+	rules []rewriteRule
+}
+
+// rewriteFlag collects the -rewrite flags.
+type rewriteFlag []rewriteRule
+
+func (r *rewriteFlag) String() string {
+	rules := make([]string, len(*r))
+	for i, rule := range *r {
+		rules[i] = rule.from + "=" + rule.to
+	}
+	return strings.Join(rules, ",")
+}
+
+func (r *rewriteFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("want from=to, got %q", value)
+	}
+	if strings.Contains(parts[0], ".") != strings.Contains(parts[1], ".") {
+		return fmt.Errorf("%q renames a database to a collection or the other way around", value)
+	}
+	*r = append(*r, rewriteRule{
+		from: parts[0],
+		to:   parts[1],
+	})
+	return nil
+}
+
+// reverse returns the rewriter that undoes this one.
+func (r *rewriter) reverse() *rewriter {
+	reversed := &rewriter{}
+	for _, rule := range r.rules {
+		reversed.rules = append(reversed.rules, rewriteRule{
+			from: rule.to,
+			to:   rule.from,
+		})
+	}
+	return reversed
+}
+
+// namespace renames a full namespace. Collection rules come before database
+// rules.
+func (r *rewriter) namespace(namespace string) string {
+	for _, rule := range r.rules {
+		if strings.Contains(rule.from, ".") && rule.from == namespace {
+			return rule.to
+		}
+	}
+	database, collection := splitNamespace(namespace)
+	database = r.database(database)
+	if collection == "" {
+		return database
+	}
+	return database + "." + collection
+}
+
+// database renames a database.
+func (r *rewriter) database(database string) string {
+	for _, rule := range r.rules {
+		if !strings.Contains(rule.from, ".") && rule.from == database {
+			return rule.to
+		}
+	}
+	return database
+}
+
+// request renames the namespace of a request, changing it in place.
+func (r *rewriter) request(request wireserver.Request) error {
+	if len(r.rules) == 0 {
+		return nil
+	}
+	switch req := request.(type) {
+	case *gomongo.OpMsg:
+		for i, section := range req.Sections {
+			if section.Kind != 0 || len(section.Documents) != 1 {
+				continue
+			}
+			body, err := rewriteDocument(section.Documents[0], "", func(command bson.D, database string) {
+				r.command(command, database)
+			})
+			if err != nil {
+				return err
+			}
+			req.Sections[i].Documents = [][]byte{body}
+		}
+	case *gomongo.OpQuery:
+		database, collection := splitNamespace(req.FullCollectionName)
+		if collection != "$cmd" {
+			req.FullCollectionName = r.namespace(req.FullCollectionName)
+			return nil
+		}
+		renamed := database
+		query, err := rewriteDocument(req.Query.(bson.Raw).Data, database, func(command bson.D, database string) {
+			if wrapped, ok := lookup(command, "$query").(bson.D); ok {
+				command = wrapped
+			}
+			renamed = r.command(command, database)
+		})
+		if err != nil {
+			return err
+		}
+		req.FullCollectionName = renamed + ".$cmd"
+		req.Query = bson.Raw{Kind: 0x03, Data: query}
+	case *gomongo.OpGetMore:
+		req.FullCollectionName = r.namespace(req.FullCollectionName)
+	case *gomongo.OpInsert:
+		req.FullCollectionName = r.namespace(req.FullCollectionName)
+	case *gomongo.OpUpdate:
+		req.FullCollectionName = r.namespace(req.FullCollectionName)
+	case *gomongo.OpDelete:
+		req.FullCollectionName = r.namespace(req.FullCollectionName)
+	}
+	return nil
+}
+
+// reply renames the namespace of the cursor in a reply to a command, so that
+// the client asks for more from the namespace it knows.
+func (r *rewriter) reply(reply gomongo.Reply) error {
+	if len(r.rules) == 0 {
+		return nil
+	}
+	rewriteCursor := func(doc bson.D, database string) {
+		cursor, ok := lookup(doc, "cursor").(bson.D)
+		if !ok {
+			return
+		}
+		for i, elem := range cursor {
+			if ns, ok := elem.Value.(string); ok && elem.Name == "ns" {
+				cursor[i].Value = r.namespace(ns)
+			}
+		}
+	}
+	switch rep := reply.(type) {
+	case *gomongo.OpMsg:
+		for i, section := range rep.Sections {
+			if section.Kind != 0 || len(section.Documents) != 1 {
+				continue
+			}
+			body, err := rewriteDocument(section.Documents[0], "", rewriteCursor)
+			if err != nil {
+				return err
+			}
+			rep.Sections[i].Documents = [][]byte{body}
+		}
+	case *gomongo.OpResponse:
+		if len(rep.Document) == 1 {
+			doc, err := rewriteDocument(rep.Document[0], "", rewriteCursor)
+			if err != nil {
+				return err
+			}
+			rep.Document[0] = doc
+		}
+	}
+	return nil
+}
+
+// rewriteDocument decodes a document, changes it and encodes it again.
+func rewriteDocument(data []byte, database string, change func(bson.D, string)) ([]byte, error) {
+	var doc bson.D
+	err := bson.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	change(doc, database)
+	return bson.Marshal(doc)
+}
+
+// command renames the namespace of a command document in place, and
+// returns the database it goes to. The database comes from $db, or from the
+// namespace of a legacy command.
+func (r *rewriter) command(command bson.D, database string) string {
+	if len(command) == 0 {
+		return database
+	}
+	if db, ok := lookup(command, "$db").(string); ok {
+		database = db
+	}
+
+	switch command[0].Name {
+	case "renameCollection":
+		for i, elem := range command {
+			if ns, ok := elem.Value.(string); ok && (elem.Name == "renameCollection" || elem.Name == "to") {
+				command[i].Value = r.namespace(ns)
+			}
+		}
+		return database
+	case "explain":
+		// the explained command goes to the database of the explain
+		if explained, ok := command[0].Value.(bson.D); ok {
+			renamed := r.command(explained, database)
+			setField(command, "$db", renamed)
+			return renamed
+		}
+		return database
+	}
+
+	// the field that holds the collection, if the command has one
+	field := -1
+	if command[0].Name == "getMore" {
+		for i, elem := range command {
+			if elem.Name == "collection" {
+				field = i
+			}
+		}
+	} else if _, ok := command[0].Value.(string); ok {
+		field = 0
+	}
+
+	renamed := r.database(database)
+	if field >= 0 {
+		namespace := r.namespace(database + "." + command[field].Value.(string))
+		var collection string
+		renamed, collection = splitNamespace(namespace)
+		command[field].Value = collection
+	}
+	setField(command, "$db", renamed)
+	return renamed
+}
+
+// setField changes the value of a field that the document already has.
+func setField(doc bson.D, name string, value interface{}) {
+	for i, elem := range doc {
+		if elem.Name == name {
+			doc[i].Value = value
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// packet is a frame read from a capture file.
+type packet struct {
+	time     time.Time
+	linkType uint32
+	data     []byte
+}
+
+const (
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapMagicNanos  = 0xa1b23c4d
+	pcapngSection   = 0x0a0d0d0a
+	pcapngByteOrder = 0x1a2b3c4d
+)
+
+// pcapng block types
+const (
+	pcapngInterface      = 1
+	pcapngPacketObsolete = 2
+	pcapngSimplePacket   = 3
+	pcapngEnhancedPacket = 6
+)
+
+// isCapture returns whether a file starts like a pcap or pcapng file.
+func isCapture(reader *bufio.Reader) bool {
+	magic, err := reader.Peek(4)
+	if err != nil {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(magic) {
+	case pcapMagicMicros, pcapMagicNanos, pcapngSection:
+		return true
+	}
+	switch binary.BigEndian.Uint32(magic) {
+	case pcapMagicMicros, pcapMagicNanos:
+		return true
+	}
+	return false
+}
+
+// readCapture reads the packets of a pcap or pcapng file in order.
+func readCapture(reader *bufio.Reader, handle func(packet)) error {
+	magic, err := reader.Peek(4)
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(magic) == pcapngSection {
+		return readPcapng(reader, handle)
+	}
+	return readPcap(reader, handle)
+}
+
+// readPcap reads a classic libpcap file.
+func readPcap(reader io.Reader, handle func(packet)) error {
+	header := make([]byte, 24)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return err
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	magic := order.Uint32(header)
+	if magic != pcapMagicMicros && magic != pcapMagicNanos {
+		order = binary.BigEndian
+		magic = order.Uint32(header)
+	}
+	fraction := time.Microsecond
+	if magic == pcapMagicNanos {
+		fraction = time.Nanosecond
+	}
+	linkType := order.Uint32(header[20:]) & 0xffff
+
+	record := make([]byte, 16)
+	for {
+		_, err = io.ReadFull(reader, record)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		length := order.Uint32(record[8:])
+		if length > 1<<28 {
+			return fmt.Errorf("pcap record of %v bytes", length)
+		}
+		data := make([]byte, length)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return err
+		}
+		handle(packet{
+			time:     time.Unix(int64(order.Uint32(record[0:])), int64(order.Uint32(record[4:]))*int64(fraction)),
+			linkType: linkType,
+			data:     data,
+		})
+	}
+}
+
+// pcapngInterfaceInfo is what a pcapng file says about an interface that
+// packets were captured on.
+type pcapngInterfaceInfo struct {
+	linkType uint32
+	snapLen  uint32
+	// timestamp units per second
+	resolution uint64
+}
+
+// readPcapng reads a pcapng file, which may have several sections.
+func readPcapng(reader io.Reader, handle func(packet)) error {
+	var order binary.ByteOrder = binary.LittleEndian
+	var interfaces []pcapngInterfaceInfo
+	head := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(reader, head)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		blockType := order.Uint32(head)
+		if blockType == pcapngSection {
+			// the byte order of a section is only known from its header
+			bom := make([]byte, 4)
+			_, err = io.ReadFull(reader, bom)
+			if err != nil {
+				return err
+			}
+			order = binary.LittleEndian
+			if order.Uint32(bom) != pcapngByteOrder {
+				order = binary.BigEndian
+			}
+			if order.Uint32(bom) != pcapngByteOrder {
+				return fmt.Errorf("pcapng section with byte order magic %x", bom)
+			}
+			interfaces = nil
+			_, err = readPcapngBody(reader, order.Uint32(head[4:]), 12)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		body, err := readPcapngBody(reader, order.Uint32(head[4:]), 8)
+		if err != nil {
+			return err
+		}
+		switch blockType {
+		case pcapngInterface:
+			if len(body) < 8 {
+				return fmt.Errorf("pcapng interface block of %v bytes", len(body))
+			}
+			interfaces = append(interfaces, pcapngInterfaceInfo{
+				linkType:   uint32(order.Uint16(body[0:])),
+				snapLen:    order.Uint32(body[4:]),
+				resolution: pcapngResolution(order, body[8:]),
+			})
+		case pcapngEnhancedPacket, pcapngPacketObsolete:
+			if len(body) < 20 {
+				return fmt.Errorf("pcapng packet block of %v bytes", len(body))
+			}
+			var id uint32
+			if blockType == pcapngEnhancedPacket {
+				id = order.Uint32(body[0:])
+			} else {
+				id = uint32(order.Uint16(body[0:]))
+			}
+			if int(id) >= len(interfaces) {
+				return fmt.Errorf("pcapng packet on undeclared interface %v", id)
+			}
+			length := order.Uint32(body[12:])
+			if uint64(length) > uint64(len(body)-20) {
+				return fmt.Errorf("pcapng packet of %v bytes in a block of %v", length, len(body))
+			}
+			timestamp := uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+			handle(packet{
+				time:     pcapngTime(timestamp, interfaces[id].resolution),
+				linkType: interfaces[id].linkType,
+				data:     body[20 : 20+length],
+			})
+		case pcapngSimplePacket:
+			if len(body) < 4 || len(interfaces) == 0 {
+				return fmt.Errorf("pcapng simple packet block without an interface")
+			}
+			length := uint64(order.Uint32(body[0:]))
+			if snapLen := uint64(interfaces[0].snapLen); snapLen != 0 && length > snapLen {
+				length = snapLen
+			}
+			if length > uint64(len(body)-4) {
+				length = uint64(len(body) - 4)
+			}
+			handle(packet{
+				linkType: interfaces[0].linkType,
+				data:     body[4 : 4+length],
+			})
+		}
+	}
+}
+
+// readPcapngBody reads the rest of a block whose total length is given,
+// once read bytes of it have been read, and returns the body without the
+// trailing copy of the length.
+func readPcapngBody(reader io.Reader, length uint32, read uint32) ([]byte, error) {
+	if length%4 != 0 || length < read+4 || length > 1<<28 {
+		return nil, fmt.Errorf("pcapng block of %v bytes", length)
+	}
+	body := make([]byte, length-read)
+	_, err := io.ReadFull(reader, body)
+	if err != nil {
+		return nil, err
+	}
+	return body[:len(body)-4], nil
+}
+
+// pcapngResolution finds the if_tsresol option among the options of an
+// interface block. Timestamps are in microseconds without it.
+func pcapngResolution(order binary.ByteOrder, options []byte) uint64 {
+	for len(options) >= 4 {
+		code := order.Uint16(options[0:])
+		length := int(order.Uint16(options[2:]))
+		if code == 0 || 4+length > len(options) {
+			break
+		}
+		if code == 9 && length >= 1 {
+			exponent := options[4]
+			if exponent&0x80 != 0 {
+				return 1 << (exponent & 0x7f)
+			}
+			return uint64(math.Pow10(int(exponent)))
+		}
+		options = options[4+(length+3)/4*4:]
+	}
+	return 1000000
+}
+
+// pcapngTime converts a timestamp in units of an interface's resolution.
+func pcapngTime(timestamp uint64, resolution uint64) time.Time {
+	if resolution == 0 {
+		return time.Time{}
+	}
+	seconds := timestamp / resolution
+	fraction := timestamp % resolution
+	var nanos uint64
+	if resolution <= 1000000000 {
+		nanos = fraction * 1000000000 / resolution
+	} else {
+		nanos = uint64(float64(fraction) * 1e9 / float64(resolution))
+	}
+	return time.Unix(int64(seconds), int64(nanos))
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/dmliao/gomongo"
+	"github.com/dmliao/gomongo/wireserver"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"sort"
+	"time"
+)
+
+// exchange is a request and the replies to it. Either may be missing from
+// the capture.
+type exchange struct {
+	request *message
+	replies []*message
+}
+
+// pair matches the messages of each connection into exchanges, in the order
+// their first message was captured. A reply answers the message whose
+// request ID is its responseTo, which is the request for the first reply
+// and the previous reply for the rest of an exhaust stream. Each side counts
+// request IDs on its own, so they are looked up by who sent them: the other
+// side for a request, and the same side for a previous reply.
+func pair(messages []*message) []*exchange {
+	var exchanges []*exchange
+	waiting := map[string]*exchange{}
+	for _, m := range messages {
+		requestID := int32(binary.LittleEndian.Uint32(m.data[4:]))
+		responseTo := int32(binary.LittleEndian.Uint32(m.data[8:]))
+
+		var e *exchange
+		if responseTo == 0 && opCode(m.data) != gomongo.OP_REPLY {
+			e = &exchange{
+				request: m,
+			}
+			exchanges = append(exchanges, e)
+		} else {
+			key := fmt.Sprintf("%v %v %v", m.to, m.from, responseTo)
+			e = waiting[key]
+			if e == nil {
+				key = fmt.Sprintf("%v %v %v", m.from, m.to, responseTo)
+				e = waiting[key]
+			}
+			if e == nil {
+				e = &exchange{}
+				exchanges = append(exchanges, e)
+			}
+			delete(waiting, key)
+			e.replies = append(e.replies, m)
+		}
+		waiting[fmt.Sprintf("%v %v %v", m.from, m.to, requestID)] = e
+	}
+	return exchanges
+}
+
+// opCode returns the opcode of a message, or of the message wrapped in an
+// OP_COMPRESSED.
+func opCode(data []byte) int32 {
+	op := int32(binary.LittleEndian.Uint32(data[12:]))
+	if op == gomongo.OP_COMPRESSED && len(data) >= 20 {
+		op = int32(binary.LittleEndian.Uint32(data[16:]))
+	}
+	return op
+}
+
+// describeExchange lays out an exchange for printing.
+func describeExchange(e *exchange) bson.D {
+	first := e.request
+	client, server := "", ""
+	if e.request != nil {
+		client, server = e.request.from, e.request.to
+	} else {
+		first = e.replies[0]
+		client, server = first.to, first.from
+	}
+
+	doc := bson.D{}
+	if !first.time.IsZero() {
+		doc = append(doc, bson.DocElem{"time", first.time.UTC().Format(time.RFC3339Nano)})
+	}
+	if client != "" {
+		doc = append(doc, bson.DocElem{"client", client}, bson.DocElem{"server", server})
+	}
+	if e.request != nil {
+		doc = append(doc, bson.DocElem{"request", describeMessage(e.request.data)})
+	}
+	if len(e.replies) > 0 {
+		replies := make([]interface{}, len(e.replies))
+		for i, reply := range e.replies {
+			replies[i] = describeMessage(reply.data)
+		}
+		doc = append(doc, bson.DocElem{"replies", replies})
+		if e.request != nil && !e.request.time.IsZero() {
+			doc = append(doc, bson.DocElem{"duration", e.replies[0].time.Sub(e.request.time).String()})
+		}
+	}
+	return doc
+}
+
+// flag bits and their names, by opcode
+var flagNames = map[int32][]struct {
+	bit  int32
+	name string
+}{
+	gomongo.OP_MSG: {
+		{1 << 0, "checksumPresent"},
+		{1 << 1, "moreToCome"},
+		{1 << 16, "exhaustAllowed"},
+	},
+	gomongo.OP_QUERY: {
+		{1 << 1, "tailableCursor"},
+		{1 << 2, "slaveOk"},
+		{1 << 3, "oplogReplay"},
+		{1 << 4, "noCursorTimeout"},
+		{1 << 5, "awaitData"},
+		{1 << 6, "exhaust"},
+		{1 << 7, "partial"},
+	},
+	gomongo.OP_REPLY: {
+		{1 << 0, "cursorNotFound"},
+		{1 << 1, "queryFailure"},
+		{1 << 2, "shardConfigStale"},
+		{1 << 3, "awaitCapable"},
+	},
+	gomongo.OP_INSERT: {
+		{1 << 0, "continueOnError"},
+	},
+	gomongo.OP_UPDATE: {
+		{1 << 0, "upsert"},
+		{1 << 1, "multiUpdate"},
+	},
+	gomongo.OP_DELETE: {
+		{1 << 0, "singleRemove"},
+	},
+}
+
+// describeFlags lists the names of the flags set in a message, and the
+// numbers of the bits it doesn't know.
+func describeFlags(op int32, flags int32) []interface{} {
+	names := []interface{}{}
+	for _, flag := range flagNames[op] {
+		if flags&flag.bit != 0 {
+			names = append(names, flag.name)
+			flags &^= flag.bit
+		}
+	}
+	for bit := uint(0); bit < 32; bit++ {
+		if flags&(1<<bit) != 0 {
+			names = append(names, fmt.Sprintf("bit %v", bit))
+		}
+	}
+	return names
+}
+
+var opCodeNames = map[int32]string{
+	gomongo.OP_REPLY:        "OP_REPLY",
+	gomongo.OP_UPDATE:       "OP_UPDATE",
+	gomongo.OP_INSERT:       "OP_INSERT",
+	gomongo.OP_QUERY:        "OP_QUERY",
+	gomongo.OP_GET_MORE:     "OP_GET_MORE",
+	gomongo.OP_DELETE:       "OP_DELETE",
+	gomongo.OP_KILL_CURSORS: "OP_KILL_CURSORS",
+	gomongo.OP_COMPRESSED:   "OP_COMPRESSED",
+	gomongo.OP_MSG:          "OP_MSG",
+}
+
+func opCodeName(op int32) interface{} {
+	name, ok := opCodeNames[op]
+	if !ok {
+		return int(op)
+	}
+	return name
+}
+
+var compressorNames = map[uint8]string{
+	gomongo.COMPRESSOR_NOOP:   "noop",
+	gomongo.COMPRESSOR_SNAPPY: "snappy",
+	gomongo.COMPRESSOR_ZLIB:   "zlib",
+	gomongo.COMPRESSOR_ZSTD:   "zstd",
+}
+
+// describeMessage decodes a message into its header and fields. A message
+// that can't be decoded is described as far as its header, with the error.
+func describeMessage(data []byte) bson.D {
+	doc := bson.D{
+		{"messageLength", len(data)},
+		{"requestID", int(int32(binary.LittleEndian.Uint32(data[4:])))},
+		{"responseTo", int(int32(binary.LittleEndian.Uint32(data[8:])))},
+		{"opCode", opCodeName(opCode(data))},
+	}
+	if binary.LittleEndian.Uint32(data[12:]) == uint32(gomongo.OP_COMPRESSED) && len(data) >= 25 {
+		compressor, ok := compressorNames[data[24]]
+		if !ok {
+			compressor = fmt.Sprintf("%v", data[24])
+		}
+		doc = append(doc, bson.DocElem{"compressed", bson.D{
+			{"compressor", compressor},
+			{"uncompressedSize", int(int32(binary.LittleEndian.Uint32(data[20:])))},
+		}})
+	}
+
+	var decoded interface{}
+	var err error
+	if opCode(data) == gomongo.OP_REPLY {
+		decoded, err = wireserver.ReadReply(bytes.NewReader(data), wireserver.DefaultMaxMessageSize)
+	} else {
+		decoded, err = wireserver.ReadRequest(bytes.NewReader(data), wireserver.DefaultMaxMessageSize)
+	}
+	if err != nil {
+		return append(doc, bson.DocElem{"error", err.Error()})
+	}
+
+	switch m := decoded.(type) {
+	case *gomongo.OpMsg:
+		doc = append(doc, bson.DocElem{"flagBits", describeFlags(gomongo.OP_MSG, int32(m.FlagBits))})
+		sections := []interface{}{}
+		for _, section := range m.Sections {
+			if section.Kind == 0 {
+				for _, body := range section.Documents {
+					sections = append(sections, bson.D{{"kind", 0}, {"body", document(body)}})
+				}
+				continue
+			}
+			sections = append(sections, bson.D{
+				{"kind", int(section.Kind)},
+				{"identifier", section.Identifier},
+				{"documents", documents(section.Documents)},
+			})
+		}
+		doc = append(doc, bson.DocElem{"sections", sections})
+		if m.FlagBits&gomongo.MSG_CHECKSUM_PRESENT != 0 {
+			doc = append(doc, bson.DocElem{"checksum", int64(m.Checksum)})
+		}
+	case *gomongo.OpQuery:
+		doc = append(doc,
+			bson.DocElem{"flags", describeFlags(gomongo.OP_QUERY, m.Flags)},
+			bson.DocElem{"fullCollectionName", m.FullCollectionName},
+			bson.DocElem{"numberToSkip", int(m.NumberToSkip)},
+			bson.DocElem{"numberToReturn", int(m.NumberToReturn)},
+			bson.DocElem{"query", document(m.Query.(bson.Raw).Data)})
+		if m.Projection != nil {
+			doc = append(doc, bson.DocElem{"returnFieldsSelector", document(m.Projection.(bson.Raw).Data)})
+		}
+	case *gomongo.OpResponse:
+		doc = append(doc,
+			bson.DocElem{"responseFlags", describeFlags(gomongo.OP_REPLY, m.ResponseFlags)},
+			bson.DocElem{"cursorID", m.CursorID},
+			bson.DocElem{"startingFrom", int(m.StartingFrom)},
+			bson.DocElem{"numberReturned", int(m.NumberReturned)},
+			bson.DocElem{"documents", documents(m.Document)})
+	case *gomongo.OpGetMore:
+		doc = append(doc,
+			bson.DocElem{"fullCollectionName", m.FullCollectionName},
+			bson.DocElem{"numberToReturn", int(m.NumberToReturn)},
+			bson.DocElem{"cursorID", m.CursorID})
+	case *gomongo.OpKillCursors:
+		cursorIDs := make([]interface{}, len(m.CursorIDs))
+		for i, id := range m.CursorIDs {
+			cursorIDs[i] = id
+		}
+		doc = append(doc, bson.DocElem{"cursorIDs", cursorIDs})
+	case *gomongo.OpInsert:
+		doc = append(doc,
+			bson.DocElem{"flags", describeFlags(gomongo.OP_INSERT, m.Flags)},
+			bson.DocElem{"fullCollectionName", m.FullCollectionName},
+			bson.DocElem{"documents", documents(m.Documents)})
+	case *gomongo.OpUpdate:
+		doc = append(doc,
+			bson.DocElem{"fullCollectionName", m.FullCollectionName},
+			bson.DocElem{"flags", describeFlags(gomongo.OP_UPDATE, m.Flags)},
+			bson.DocElem{"selector", document(m.Selector.(bson.Raw).Data)},
+			bson.DocElem{"update", document(m.Update.(bson.Raw).Data)})
+	case *gomongo.OpDelete:
+		doc = append(doc,
+			bson.DocElem{"fullCollectionName", m.FullCollectionName},
+			bson.DocElem{"flags", describeFlags(gomongo.OP_DELETE, m.Flags)},
+			bson.DocElem{"selector", document(m.Selector.(bson.Raw).Data)})
+	}
+	return doc
+}
+
+// document decodes a BSON document, keeping the order of its fields.
+func document(data []byte) interface{} {
+	var doc bson.D
+	err := bson.Unmarshal(data, &doc)
+	if err != nil {
+		return fmt.Sprintf("invalid BSON: %v", err)
+	}
+	return doc
+}
+
+func documents(docs [][]byte) []interface{} {
+	decoded := make([]interface{}, len(docs))
+	for i, data := range docs {
+		decoded[i] = document(data)
+	}
+	return decoded
+}
+
+// writeJSON writes a value as Extended JSON. The bson package encodes the
+// BSON types, but would encode a bson.D as an array, so documents are
+// written here with their fields in order.
+func writeJSON(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case bson.D:
+		buf.WriteByte('{')
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			err := writeJSON(buf, elem.Name)
+			if err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			err = writeJSON(buf, elem.Value)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	case bson.M:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		doc := make(bson.D, len(names))
+		for i, name := range names {
+			doc[i] = bson.DocElem{name, v[name]}
+		}
+		return writeJSON(buf, doc)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			err := writeJSON(buf, item)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	}
+	if f, ok := value.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		// JSON has no numbers for these
+		fmt.Fprintf(buf, `{"$numberDouble":"%v"}`, f)
+		return nil
+	}
+	data, err := bson.MarshalJSON(value)
+	if err != nil {
+		return err
+	}
+	buf.Write(bytes.TrimSpace(data))
+	return nil
+}
@@ -0,0 +1,127 @@
+// Command gomongo-wiredump decodes MongoDB wire protocol messages and prints
+// them as Extended JSON, each request together with its replies.
+//
+// Usage:
+//
+//	gomongo-wiredump [-port 27017] [-compact] [file ...]
+//
+// The files are pcap or pcapng captures, such as those written by tcpdump or
+// Wireshark, or hex dumps of messages. It reads standard input without any
+// files. Captures are searched for TCP connections to or from the port, or
+// for all TCP connections if the port is 0. A hex dump is the bytes of
+// whole messages one after another, in hex digits that may be split by
+// white space, with comments from # to the end of a line.
+//
+// Compressed messages are decompressed. Captures of TLS connections can't be
+// decoded.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+func main() {
+	port := flag.Int("port", 27017, "decode TCP connections to or from this port, or all of them if 0")
+	compact := flag.Bool("compact", false, "print each exchange on one line")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: gomongo-wiredump [flags] [file ...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	warn := func(format string, args ...interface{}) {
+		fmt.Fprintf(os.Stderr, "gomongo-wiredump: "+format+"\n", args...)
+	}
+	assembler := newAssembler(*port, warn)
+	failed := false
+	names := flag.Args()
+	if len(names) == 0 {
+		names = []string{"-"}
+	}
+	for _, name := range names {
+		err := read(assembler, name)
+		if err != nil {
+			warn("%v: %v", name, err)
+			failed = true
+		}
+	}
+	assembler.finish()
+
+	output := bufio.NewWriter(os.Stdout)
+	for _, e := range pair(assembler.messages) {
+		var buf bytes.Buffer
+		err := writeJSON(&buf, describeExchange(e))
+		if err != nil {
+			warn("%v", err)
+			failed = true
+			continue
+		}
+		if !*compact {
+			var indented bytes.Buffer
+			json.Indent(&indented, buf.Bytes(), "", "  ")
+			buf = indented
+		}
+		buf.WriteByte('\n')
+		output.Write(buf.Bytes())
+	}
+	output.Flush()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// read adds the messages of a capture or hex dump to the assembler.
+func read(assembler *assembler, name string) error {
+	var input io.Reader = os.Stdin
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+	reader := bufio.NewReader(input)
+	if isCapture(reader) {
+		return readCapture(reader, assembler.packet)
+	}
+	text, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	data, err := parseHex(string(text))
+	if err != nil {
+		return err
+	}
+	assembler.dump(data)
+	return nil
+}
+
+// parseHex decodes a hex dump, skipping white space and comments.
+func parseHex(text string) ([]byte, error) {
+	var digits strings.Builder
+	for number, line := range strings.Split(text, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		for _, field := range strings.Fields(line) {
+			if _, err := hex.DecodeString(strings.Repeat("0", len(field)%2) + field); err != nil {
+				return nil, fmt.Errorf("line %v: %q isn't hex", number+1, field)
+			}
+			digits.WriteString(field)
+		}
+	}
+	if digits.Len()%2 != 0 {
+		return nil, fmt.Errorf("odd number of hex digits")
+	}
+	return hex.DecodeString(digits.String())
+}
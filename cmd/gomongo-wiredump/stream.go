@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/dmliao/gomongo/wireserver"
+	"net"
+	"strconv"
+	"time"
+)
+
+// link layer types of capture files
+const (
+	linkNull      = 0
+	linkEthernet  = 1
+	linkRaw       = 101
+	linkLoop      = 108
+	linkLinuxSLL  = 113
+	linkIPv4      = 228
+	linkIPv6      = 229
+	linkLinuxSLL2 = 276
+)
+
+const tcpSYN = 1 << 1
+
+// message is a whole wire protocol message taken from a capture or dump,
+// with the time of the packet that completed it.
+type message struct {
+	time time.Time
+	from string
+	to   string
+	data []byte
+}
+
+// stream is one direction of a TCP connection being reassembled.
+type stream struct {
+	from    string
+	to      string
+	started bool
+	next    uint32
+	// segments that arrived ahead of a gap, by sequence number
+	pending map[uint32][]byte
+	// bytes of a message that isn't complete yet
+	buffered []byte
+}
+
+// assembler puts the TCP segments of a capture back together into streams,
+// and splits the streams into messages.
+type assembler struct {
+	// only connections to or from this port are decoded, unless it is 0
+	port     int
+	streams  map[string]*stream
+	messages []*message
+	warn     func(format string, args ...interface{})
+}
+
+func newAssembler(port int, warn func(format string, args ...interface{})) *assembler {
+	return &assembler{
+		port:    port,
+		streams: map[string]*stream{},
+		warn:    warn,
+	}
+}
+
+// packet takes a captured frame apart down to its TCP segment.
+func (a *assembler) packet(p packet) {
+	ip, ok := linkPayload(p.linkType, p.data)
+	if !ok {
+		return
+	}
+	var srcIP, dstIP net.IP
+	var segment []byte
+	switch {
+	case len(ip) >= 20 && ip[0]>>4 == 4:
+		headerLength := int(ip[0]&0x0f) * 4
+		totalLength := int(binary.BigEndian.Uint16(ip[2:]))
+		fragment := binary.BigEndian.Uint16(ip[6:])
+		// fragments are rare enough on a database connection that they
+		// aren't put back together
+		if ip[9] != 6 || fragment&0x3fff != 0 || headerLength < 20 || headerLength > len(ip) {
+			return
+		}
+		// a length of 0 is left by segmentation offload
+		if totalLength >= headerLength && totalLength < len(ip) {
+			ip = ip[:totalLength]
+		}
+		srcIP, dstIP = net.IP(ip[12:16]), net.IP(ip[16:20])
+		segment = ip[headerLength:]
+	case len(ip) >= 40 && ip[0]>>4 == 6:
+		payloadLength := int(binary.BigEndian.Uint16(ip[4:]))
+		next := ip[6]
+		srcIP, dstIP = net.IP(ip[8:24]), net.IP(ip[24:40])
+		segment = ip[40:]
+		if payloadLength != 0 && payloadLength < len(segment) {
+			segment = segment[:payloadLength]
+		}
+		// skip the hop-by-hop, routing and destination options headers
+		for (next == 0 || next == 43 || next == 60) && len(segment) >= 8 {
+			length := (int(segment[1]) + 1) * 8
+			if length > len(segment) {
+				return
+			}
+			next = segment[0]
+			segment = segment[length:]
+		}
+		if next != 6 {
+			return
+		}
+	default:
+		return
+	}
+
+	if len(segment) < 20 {
+		return
+	}
+	srcPort := int(binary.BigEndian.Uint16(segment[0:]))
+	dstPort := int(binary.BigEndian.Uint16(segment[2:]))
+	if a.port != 0 && srcPort != a.port && dstPort != a.port {
+		return
+	}
+	dataOffset := int(segment[12]>>4) * 4
+	if dataOffset < 20 || dataOffset > len(segment) {
+		return
+	}
+	from := net.JoinHostPort(srcIP.String(), strconv.Itoa(srcPort))
+	to := net.JoinHostPort(dstIP.String(), strconv.Itoa(dstPort))
+	a.segment(p.time, from, to, binary.BigEndian.Uint32(segment[4:]), segment[13], segment[dataOffset:])
+}
+
+// linkPayload returns the IP packet in a frame.
+func linkPayload(linkType uint32, data []byte) ([]byte, bool) {
+	switch linkType {
+	case linkEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType := binary.BigEndian.Uint16(data[12:])
+		data = data[14:]
+		// 802.1Q and 802.1ad tags
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(data) >= 4 {
+			etherType = binary.BigEndian.Uint16(data[2:])
+			data = data[4:]
+		}
+		return data, etherType == 0x0800 || etherType == 0x86dd
+	case linkNull, linkLoop:
+		// the address family, which is checked by the IP version instead
+		if len(data) < 4 {
+			return nil, false
+		}
+		return data[4:], true
+	case linkRaw, linkIPv4, linkIPv6:
+		return data, true
+	case linkLinuxSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		protocol := binary.BigEndian.Uint16(data[14:])
+		return data[16:], protocol == 0x0800 || protocol == 0x86dd
+	case linkLinuxSLL2:
+		if len(data) < 20 {
+			return nil, false
+		}
+		protocol := binary.BigEndian.Uint16(data[0:])
+		return data[20:], protocol == 0x0800 || protocol == 0x86dd
+	}
+	return nil, false
+}
+
+// segment adds a TCP segment to its stream, in sequence order.
+func (a *assembler) segment(t time.Time, from, to string, seq uint32, flags byte, payload []byte) {
+	key := from + " " + to
+	s := a.streams[key]
+	if s == nil {
+		s = &stream{
+			from:    from,
+			to:      to,
+			pending: map[uint32][]byte{},
+		}
+		a.streams[key] = s
+	}
+	if flags&tcpSYN != 0 {
+		// a new connection between the same ports starts over
+		s.started = true
+		s.next = seq + 1
+		s.pending = map[uint32][]byte{}
+		s.buffered = nil
+		seq++
+	}
+	if len(payload) == 0 {
+		return
+	}
+	if !s.started {
+		// the capture began in the middle of the connection, so this
+		// segment had better start a message
+		s.started = true
+		s.next = seq
+	}
+
+	ahead := int32(seq - s.next)
+	if ahead > 0 {
+		s.pending[seq] = append([]byte(nil), payload...)
+		return
+	}
+	if int(-ahead) >= len(payload) {
+		// a retransmission of what we already have
+		return
+	}
+	a.deliver(s, t, payload[-ahead:])
+	for len(s.pending) > 0 {
+		delivered := false
+		for seq, data := range s.pending {
+			ahead := int32(seq - s.next)
+			if ahead > 0 {
+				continue
+			}
+			delete(s.pending, seq)
+			if int(-ahead) < len(data) {
+				a.deliver(s, t, data[-ahead:])
+			}
+			delivered = true
+		}
+		if !delivered {
+			break
+		}
+	}
+}
+
+// deliver adds the next bytes of a stream, and takes the messages they
+// complete.
+func (a *assembler) deliver(s *stream, t time.Time, data []byte) {
+	s.next += uint32(len(data))
+	s.buffered = append(s.buffered, data...)
+	for len(s.buffered) >= 4 {
+		length := int(int32(binary.LittleEndian.Uint32(s.buffered)))
+		if length < 16 || length > wireserver.DefaultMaxMessageSize {
+			a.warn("%v -> %v: message length %v is out of range, skipping %v bytes", s.from, s.to, length,
+				len(s.buffered))
+			s.buffered = nil
+			return
+		}
+		if len(s.buffered) < length {
+			return
+		}
+		a.messages = append(a.messages, &message{
+			time: t,
+			from: s.from,
+			to:   s.to,
+			data: append([]byte(nil), s.buffered[:length]...),
+		})
+		s.buffered = s.buffered[length:]
+	}
+}
+
+// finish reports the streams that ended with bytes that never made a
+// whole message.
+func (a *assembler) finish() {
+	for _, s := range a.streams {
+		missing := 0
+		for _, data := range s.pending {
+			missing += len(data)
+		}
+		if missing > 0 {
+			a.warn("%v -> %v: %v bytes after a gap in the capture", s.from, s.to, missing)
+		}
+		if len(s.buffered) > 0 {
+			a.warn("%v -> %v: %v bytes of an incomplete message", s.from, s.to, len(s.buffered))
+		}
+	}
+}
+
+// dump splits a hex dump into messages. Where they came from isn't known.
+func (a *assembler) dump(data []byte) {
+	s := &stream{}
+	a.deliver(s, time.Time{}, data)
+	if len(s.buffered) > 0 {
+		a.warn("%v bytes of an incomplete message at the end of the dump", len(s.buffered))
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/dmliao/gomongo"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	clientAddress = [4]byte{10, 0, 0, 1}
+	serverAddress = [4]byte{10, 0, 0, 2}
+)
+
+// frame is a TCP segment of the test connection, as an Ethernet frame.
+type frame struct {
+	time     time.Time
+	toServer bool
+	seq      uint32
+	flags    byte
+	payload  []byte
+}
+
+func (f frame) bytes() []byte {
+	src, dst := clientAddress, serverAddress
+	srcPort, dstPort := uint16(40000), uint16(27017)
+	if !f.toServer {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+	}
+	data := make([]byte, 14+20+20)
+	binary.BigEndian.PutUint16(data[12:], 0x0800)
+	ip := data[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(40+len(f.payload)))
+	ip[9] = 6
+	copy(ip[12:], src[:])
+	copy(ip[16:], dst[:])
+	tcp := ip[20:]
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], f.seq)
+	tcp[12] = 5 << 4
+	tcp[13] = f.flags
+	return append(data, f.payload...)
+}
+
+// encodeMsg returns an OP_MSG whose body is doc.
+func encodeMsg(t *testing.T, requestID int32, responseTo int32, doc bson.D) []byte {
+	body, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gomongo.EncodeMsg(requestID, responseTo, &gomongo.OpMsg{
+		Sections: []gomongo.MsgSection{{Kind: 0, Documents: [][]byte{body}}},
+	})
+	defer w.Release()
+	return append([]byte(nil), w.Bytes()...)
+}
+
+// conversation returns the frames of a connection with two finds on it. The
+// first reply arrives in two segments, out of order, and the first request
+// is retransmitted.
+func conversation(t *testing.T) []frame {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	find1 := encodeMsg(t, 1, 0, bson.D{{"find", "a"}, {"$db", "test"}})
+	reply1 := encodeMsg(t, 100, 1, bson.D{{"ok", 1}, {"n", 1}})
+	find2 := encodeMsg(t, 2, 0, bson.D{{"find", "b"}, {"$db", "test"}})
+	reply2 := encodeMsg(t, 101, 2, bson.D{{"ok", 1}, {"n", 2}})
+
+	clientSeq, serverSeq := uint32(1000), uint32(5000)
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	return []frame{
+		{at(0), true, clientSeq, tcpSYN, nil},
+		{at(1), false, serverSeq, tcpSYN | 0x10, nil},
+		{at(2), true, clientSeq + 1, 0x18, find1},
+		{at(3), true, clientSeq + 1, 0x18, find1},
+		{at(4), false, serverSeq + 1 + 10, 0x18, reply1[10:]},
+		{at(5), false, serverSeq + 1, 0x18, reply1[:10]},
+		{at(6), true, clientSeq + 1 + uint32(len(find1)), 0x18, find2},
+		{at(7), false, serverSeq + 1 + uint32(len(reply1)), 0x18, reply2},
+	}
+}
+
+// writePcap writes frames as a little endian pcap file with microsecond
+// timestamps.
+func writePcap(frames []frame) []byte {
+	var buf bytes.Buffer
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagicMicros)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], linkEthernet)
+	buf.Write(header)
+	for _, f := range frames {
+		data := f.bytes()
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[0:], uint32(f.time.Unix()))
+		binary.LittleEndian.PutUint32(record[4:], uint32(f.time.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(record[8:], uint32(len(data)))
+		binary.LittleEndian.PutUint32(record[12:], uint32(len(data)))
+		buf.Write(record)
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+// writePcapng writes frames as a big endian pcapng file, whose interface
+// has nanosecond timestamps.
+func writePcapng(frames []frame) []byte {
+	var buf bytes.Buffer
+	order := binary.BigEndian
+	block := func(blockType uint32, body []byte) {
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+		length := uint32(12 + len(body))
+		head := make([]byte, 8)
+		order.PutUint32(head[0:], blockType)
+		order.PutUint32(head[4:], length)
+		buf.Write(head)
+		buf.Write(body)
+		tail := make([]byte, 4)
+		order.PutUint32(tail, length)
+		buf.Write(tail)
+	}
+
+	section := make([]byte, 16)
+	order.PutUint32(section[0:], pcapngByteOrder)
+	order.PutUint16(section[4:], 1)
+	order.PutUint64(section[8:], ^uint64(0))
+	block(pcapngSection, section)
+	// if_tsresol of 10^-9, and the end of the options
+	iface := make([]byte, 8, 20)
+	order.PutUint16(iface[0:], linkEthernet)
+	order.PutUint32(iface[4:], 65535)
+	iface = append(iface, 0, 9, 0, 1, 9, 0, 0, 0, 0, 0, 0, 0)
+	block(pcapngInterface, iface)
+
+	for _, f := range frames {
+		data := f.bytes()
+		body := make([]byte, 20, 20+len(data))
+		timestamp := uint64(f.time.UnixNano())
+		order.PutUint32(body[4:], uint32(timestamp>>32))
+		order.PutUint32(body[8:], uint32(timestamp))
+		order.PutUint32(body[12:], uint32(len(data)))
+		order.PutUint32(body[16:], uint32(len(data)))
+		block(pcapngEnhancedPacket, append(body, data...))
+	}
+	return buf.Bytes()
+}
+
+// decode runs a capture through the assembler, and returns the exchanges it
+// pairs up, the warnings and the error reading it.
+func decode(data []byte) ([]*exchange, []string, error) {
+	var warnings []string
+	a := newAssembler(27017, func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	})
+	reader := bufio.NewReader(bytes.NewReader(data))
+	if !isCapture(reader) {
+		return nil, nil, fmt.Errorf("not a capture")
+	}
+	err := readCapture(reader, a.packet)
+	a.finish()
+	return pair(a.messages), warnings, err
+}
+
+// checkExchanges checks that the two finds of the conversation were each
+// paired with their reply.
+func checkExchanges(t *testing.T, exchanges []*exchange) {
+	if len(exchanges) != 2 {
+		t.Fatalf("decoded %v exchanges", len(exchanges))
+	}
+	for i, e := range exchanges {
+		if e.request == nil || len(e.replies) != 1 {
+			t.Errorf("exchange %v has request %v and %v replies", i, e.request != nil, len(e.replies))
+			continue
+		}
+		request := describeMessage(e.request.data)
+		reply := describeMessage(e.replies[0].data)
+		if request.Map()["requestID"] != i+1 || reply.Map()["responseTo"] != i+1 {
+			t.Errorf("exchange %v paired %v with %v", i, request, reply)
+		}
+		if e.request.from != "10.0.0.1:40000" || e.request.to != "10.0.0.2:27017" {
+			t.Errorf("exchange %v is from %v to %v", i, e.request.from, e.request.to)
+		}
+	}
+	var buf bytes.Buffer
+	err := writeJSON(&buf, describeExchange(exchanges[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"find":"a"`, `"duration":"3ms"`, `"n":1`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("%v is missing from %v", want, buf.String())
+		}
+	}
+}
+
+func TestPcap(t *testing.T) {
+	exchanges, warnings, err := decode(writePcap(conversation(t)))
+	if err != nil || len(warnings) > 0 {
+		t.Fatalf("decoding with warnings %q: %v", warnings, err)
+	}
+	checkExchanges(t, exchanges)
+	if got := exchanges[1].request.time; !got.Equal(time.Date(2024, 5, 1, 12, 0, 0, 6000000, time.UTC)) {
+		t.Errorf("second request at %v", got)
+	}
+}
+
+func TestPcapng(t *testing.T) {
+	exchanges, warnings, err := decode(writePcapng(conversation(t)))
+	if err != nil || len(warnings) > 0 {
+		t.Fatalf("decoding with warnings %q: %v", warnings, err)
+	}
+	checkExchanges(t, exchanges)
+	if got := exchanges[1].request.time; !got.Equal(time.Date(2024, 5, 1, 12, 0, 0, 6000000, time.UTC)) {
+		t.Errorf("second request at %v", got)
+	}
+}
+
+// TestTruncatedCapture checks that a capture cut short gives back what it
+// has, and reports the rest.
+func TestTruncatedCapture(t *testing.T) {
+	frames := conversation(t)
+	data := writePcap(frames)
+	lastFrame := len(frames[len(frames)-1].bytes())
+	exchanges, _, err := decode(data[:len(data)-lastFrame/2])
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("reading a capture cut off in a record: %v", err)
+	}
+	if len(exchanges) != 2 || exchanges[1].request == nil || len(exchanges[1].replies) != 0 {
+		t.Errorf("decoded %v exchanges", len(exchanges))
+	}
+
+	// the end of the second request never made it into the capture
+	frames[6].payload = frames[6].payload[:20]
+	_, warnings, err := decode(writePcap(frames[:7]))
+	if err != nil || len(warnings) != 1 || !strings.Contains(warnings[0], "incomplete message") {
+		t.Errorf("decoding a stream that ends in a message: %q, %v", warnings, err)
+	}
+
+	// the start of the first reply is missing, so none of the replies can
+	// be put together
+	frames = conversation(t)
+	_, warnings, err = decode(writePcap(append(frames[:5:5], frames[6:]...)))
+	if err != nil || len(warnings) != 1 || !strings.Contains(warnings[0], "after a gap") {
+		t.Errorf("decoding a stream with a gap: %q, %v", warnings, err)
+	}
+}
+
+// TestPairExhaust checks that every reply of an exhaust stream goes with the
+// request that started it.
+func TestPairExhaust(t *testing.T) {
+	messages := []*message{
+		{from: "c", to: "s", data: encodeMsg(t, 1, 0, bson.D{{"getMore", int64(7)}})},
+		{from: "s", to: "c", data: encodeMsg(t, 10, 1, bson.D{{"ok", 1}})},
+		{from: "s", to: "c", data: encodeMsg(t, 11, 10, bson.D{{"ok", 1}})},
+		{from: "s", to: "c", data: encodeMsg(t, 12, 11, bson.D{{"ok", 1}})},
+		// a reply to a request that was before the capture
+		{from: "s", to: "c", data: encodeMsg(t, 13, 99, bson.D{{"ok", 1}})},
+	}
+	exchanges := pair(messages)
+	if len(exchanges) != 2 || len(exchanges[0].replies) != 3 || exchanges[1].request != nil {
+		t.Errorf("paired %v exchanges", len(exchanges))
+	}
+}
+
+// TestHexDump decodes the hex dump in testdata.
+func TestHexDump(t *testing.T) {
+	text, err := ioutil.ReadFile("testdata/ping.hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := parseHex(string(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var warnings []string
+	a := newAssembler(0, func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	})
+	a.dump(data)
+	exchanges := pair(a.messages)
+	if len(warnings) > 0 || len(exchanges) != 1 || len(exchanges[0].replies) != 1 {
+		t.Fatalf("decoded %v exchanges with warnings %q", len(exchanges), warnings)
+	}
+	var buf bytes.Buffer
+	err = writeJSON(&buf, describeExchange(exchanges[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"ping":1`) || !strings.Contains(buf.String(), `"ok":1`) {
+		t.Errorf("decoded %v", buf.String())
+	}
+
+	_, err = parseHex("00 0g")
+	if err == nil {
+		t.Error("parsed a hex dump with a digit that isn't hex")
+	}
+}
@@ -1,219 +1,242 @@
 package gomongo
 
 import (
-	"bytes"
-	"encoding/binary"
-	"github.com/dmliao/gomongo/buffer"
+	"context"
 	"github.com/dmliao/gomongo/convert"
 	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"sync"
 )
 
 const (
+	OP_REPLY        int32 = 1
 	OP_UPDATE       int32 = 2001
 	OP_INSERT             = 2002
 	OP_QUERY              = 2004
 	OP_GET_MORE           = 2005
 	OP_DELETE             = 2006
 	OP_KILL_CURSORS       = 2007
+	OP_COMPRESSED         = 2012
+	OP_MSG                = 2013
 )
 
 type Collection interface {
 	Find(query interface{}, options *FindOpts) (Cursor, error)
-	Insert(docs ...interface{}) error
-	Update(selector interface{}, update interface{}, options *UpdateOpts) error
-	Remove(selector interface{}, options *RemoveOpts) error
+	Insert(docs ...interface{}) (*WriteResult, error)
+	Update(selector interface{}, update interface{}, options *UpdateOpts) (*WriteResult, error)
+	Remove(selector interface{}, options *RemoveOpts) (*WriteResult, error)
 	GetMore(cursor Cursor) (Cursor, error)
 	KillCursors(cursors ...Cursor) error
 	// GetCount(query interface{}) int64
+
+	// The Context variants stop waiting on the server, and abandon the
+	// operation, when the context is done. A context deadline is also sent
+	// to the server as maxTimeMS.
+	FindContext(ctx context.Context, query interface{}, options *FindOpts) (Cursor, error)
+	InsertContext(ctx context.Context, docs ...interface{}) (*WriteResult, error)
+	UpdateContext(ctx context.Context, selector interface{}, update interface{}, options *UpdateOpts) (*WriteResult, error)
+	RemoveContext(ctx context.Context, selector interface{}, options *RemoveOpts) (*WriteResult, error)
+	GetMoreContext(ctx context.Context, cursor Cursor) (Cursor, error)
+	KillCursorsContext(ctx context.Context, cursors ...Cursor) error
+
+	// WithReadPreference returns a copy of the collection that reads with
+	// the given read preference, unless a query has one of its own.
+	WithReadPreference(*ReadPreference) Collection
 }
 
 type C struct {
 	name     string
 	database *DB
-	cursors  map[int64]*cursorObj
+	// readPreference overrides the database's, if set
+	readPreference *ReadPreference
+	cursors        *cursorRegistry
 }
 
-func (c *C) Find(query interface{}, options *FindOpts) (Cursor, error) {
-	namespace := c.database.GetName() + "." + c.name
-	requestID := c.database.mongo.nextID()
-
-	limit := int32(0)
-	skip := int32(0)
-	batchSize := int32(20)
+// cursorRegistry tracks the open cursors of a collection. Collections derived
+// from one with another read preference share its registry.
+type cursorRegistry struct {
+	mu   sync.Mutex
+	byID map[int64]*cursorObj
+}
 
-	if options != nil {
-		limit = options.Limit
-		skip = options.Skip
-		if options.BatchSize > 1 {
-			batchSize = options.BatchSize
-		}
+func newCursorRegistry() *cursorRegistry {
+	return &cursorRegistry{
+		byID: make(map[int64]*cursorObj),
+	}
+}
 
+func (c *C) WithReadPreference(readPreference *ReadPreference) Collection {
+	return &C{
+		name:           c.name,
+		database:       c.database,
+		readPreference: readPreference,
+		cursors:        c.cursors,
 	}
-	if limit > 1 && batchSize > limit {
-		batchSize = limit
+}
+
+// readPreferenceFor returns the read preference of a query: its own, or else
+// the collection's, the database's or the client's.
+func (c *C) readPreferenceFor(options *FindOpts) *ReadPreference {
+	switch {
+	case options != nil && options.ReadPreference != nil:
+		return options.ReadPreference
+	case c.readPreference != nil:
+		return c.readPreference
+	case c.database.readPreference != nil:
+		return c.database.readPreference
 	}
+	return c.database.mongo.options.readPreference()
+}
 
-	responseTo := int32(0)
+func (c *C) Find(query interface{}, options *FindOpts) (Cursor, error) {
+	return c.FindContext(context.Background(), query, options)
+}
 
-	// flags
-	flags := int32(0)
-	if options != nil {
-		flags = convert.WriteBit32LE(flags, 1, options.Tailable)
-		flags = convert.WriteBit32LE(flags, 4, options.NoCursorTimeout)
-		flags = convert.WriteBit32LE(flags, 5, options.AwaitData)
-		flags = convert.WriteBit32LE(flags, 7, options.Partial)
+func (c *C) FindContext(ctx context.Context, query interface{}, options *FindOpts) (Cursor, error) {
+	connection, err := c.database.mongo.checkoutRead(ctx, c.readPreferenceFor(options))
+	if err != nil {
+		return nil, err
 	}
 
-	queryBytes, err := bson.Marshal(query)
+	var cursor *cursorObj
+	if connection.supportsFindCommand() {
+		cursor, err = c.find(ctx, connection, query, options)
+	} else {
+		cursor, err = c.findLegacy(ctx, connection, query, options)
+	}
 	if err != nil {
+		// an error that broke the connection is reported by checkin
+		if connection.Error() == nil {
+			c.database.mongo.serverError(connection, err)
+		}
+		c.database.mongo.checkin(connection)
 		return nil, err
 	}
-	fullCollectionBytes := []byte(namespace)
-	fullCollectionBytes = append(fullCollectionBytes, byte('\x00'))
 
-	buf := new(bytes.Buffer)
-	buffer.WriteToBuf(buf, int32(0), requestID, responseTo, int32(OP_QUERY), flags, fullCollectionBytes,
-		skip, batchSize, queryBytes)
+	// the server that opened the cursor is the one to ask for more
+	cursor.address = connection.address
+
+	// an exhaust cursor keeps its connection until the server has sent all
+	// of its results. Behind a load balancer every cursor does, since only
+	// the mongos it was opened on knows about it. Servers that can't stream
+	// the batches are asked for them one at a time instead.
+	cursor.exhaust = options != nil && options.Exhaust && connection.supportsExhaust()
+	if cursor.cursorID != 0 && (cursor.exhaust || c.database.mongo.options.loadBalanced()) {
+		cursor.connection = connection
+	} else {
+		c.database.mongo.checkin(connection)
+	}
+	return cursor, nil
+}
+
+// find runs the find command on a connection.
+func (c *C) find(ctx context.Context, connection *Connection, query interface{}, options *FindOpts) (*cursorObj, error) {
+	limit, skip, batchSize, flags := cursorOptions(options)
+	if query == nil {
+		query = bson.M{}
+	}
 
+	findCommand := bson.D{{"find", c.name}, {"filter", query}}
 	if options != nil {
+		if options.Sort != nil {
+			findCommand = append(findCommand, bson.DocElem{"sort", options.Sort})
+		}
 		if options.Projection != nil {
-			projectionBytes, err := bson.Marshal(options.Projection)
-			if err != nil {
-				return nil, err
-			}
-			buffer.WriteToBuf(buf, projectionBytes)
+			findCommand = append(findCommand, bson.DocElem{"projection", options.Projection})
+		}
+		if options.Skip > 0 {
+			findCommand = append(findCommand, bson.DocElem{"skip", skip})
+		}
+		if options.Limit < 0 {
+			findCommand = append(findCommand, bson.DocElem{"singleBatch", true})
+		}
+		if options.Tailable {
+			findCommand = append(findCommand, bson.DocElem{"tailable", true})
+		}
+		if options.AwaitData {
+			findCommand = append(findCommand, bson.DocElem{"awaitData", true})
+		}
+		if options.NoCursorTimeout {
+			findCommand = append(findCommand, bson.DocElem{"noCursorTimeout", true})
+		}
+		if options.Partial {
+			findCommand = append(findCommand, bson.DocElem{"allowPartialResults", true})
+		}
+		if options.OplogReplay {
+			findCommand = append(findCommand, bson.DocElem{"oplogReplay", true})
 		}
 	}
+	if limit > 0 {
+		findCommand = append(findCommand, bson.DocElem{"limit", limit})
+	}
+	findCommand = append(findCommand, bson.DocElem{"batchSize", batchSize})
 
-	input := buf.Bytes()
-
-	respSize := make([]byte, 4)
-	binary.LittleEndian.PutUint32(respSize, uint32(len(input)))
-	input[0] = respSize[0]
-	input[1] = respSize[1]
-	input[2] = respSize[2]
-	input[3] = respSize[3]
-
-	res, err := c.database.mongo.conn.sendWithResponse(input)
+	var reply cursorReply
+	err := c.database.run(ctx, connection, findCommand, &reply)
 	if err != nil {
 		return nil, err
 	}
+	if reply.Ok != 1 {
+		return nil, reply.error()
+	}
 
 	cursor := cursorObj{
 		collection: c,
-		requestID:  requestID,
 		limit:      limit,
 		batchSize:  batchSize,
 		flags:      flags,
 	}
+	receiveCursorReply(&reply, &cursor)
 
-	receiveFindResponse(res, &cursor)
-
-	if err != nil {
-		return nil, err
-	}
-
-	c.cursors[cursor.cursorID] = &cursor
+	c.addCursor(&cursor)
 
 	return &cursor, nil
 }
 
-func (c *C) Insert(docs ...interface{}) error {
-	collection := c.name
-
-	insertCommand := bson.D{{"insert", collection}, {"documents", docs}}
-
-	var result bson.M
-	c.database.ExecuteCommand(insertCommand, &result)
-
-	if convert.ToInt(result["ok"]) == 1 {
-		return nil
-	}
-
-	writeConcernError := convert.ToBSONMap(result["writeConcernError"])
-	if writeConcernError != nil {
-		return WriteConcernError{
-			Code:   convert.ToInt32(writeConcernError["code"]),
-			ErrMsg: convert.ToString(writeConcernError["errmsg"]),
-		}
-	}
+func (c *C) Insert(docs ...interface{}) (*WriteResult, error) {
+	return c.InsertContext(context.Background(), docs...)
+}
 
-	writeErrors, err := convert.ConvertToBSONMapSlice(result["writeErrors"])
-	if err == nil {
-		errors := WriteErrors{}
-		errors.Errors = make([]WriteError, len(writeErrors))
-		for i := 0; i < len(writeErrors); i++ {
-			writeError := WriteError{
-				Index:  convert.ToInt32(writeErrors[i]["index"]),
-				Code:   convert.ToInt32(writeErrors[i]["code"]),
-				ErrMsg: convert.ToString(writeErrors[i]["errmsg"]),
-			}
-			errors.Errors[i] = writeError
-		}
-		return errors
+func (c *C) InsertContext(ctx context.Context, docs ...interface{}) (*WriteResult, error) {
+	docBytes, err := marshalDocuments(docs)
+	if err != nil {
+		return nil, err
 	}
 
-	return MongoError{
-		message: "Something failed",
-	}
+	insertCommand := c.withWriteConcern(bson.D{{"insert", c.name}})
+	return c.executeWrite(ctx, insertCommand, "documents", docBytes)
 }
 
-func (c *C) Update(selector interface{}, update interface{}, options *UpdateOpts) error {
-	collection := c.name
+func (c *C) Update(selector interface{}, update interface{}, options *UpdateOpts) (*WriteResult, error) {
+	return c.UpdateContext(context.Background(), selector, update, options)
+}
 
+func (c *C) UpdateContext(ctx context.Context, selector interface{}, update interface{},
+	options *UpdateOpts) (*WriteResult, error) {
 	multi := false
 	if options != nil {
 		multi = options.Multi
 	}
 
-	updates := make([]bson.M, 1)
-	updates[0] = bson.M{
+	updateBytes, err := bson.Marshal(bson.M{
 		"q":      selector,
 		"u":      update,
 		"upsert": false,
 		"multi":  multi,
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	updateCommand := bson.D{{"update", collection}, {"updates", updates}}
-
-	var result bson.M
-	c.database.ExecuteCommand(updateCommand, &result)
-
-	if convert.ToInt(result["ok"]) == 1 {
-		return nil
-	}
-
-	writeConcernError := convert.ToBSONMap(result["writeConcernError"])
-	if writeConcernError != nil {
-		return WriteConcernError{
-			Code:   convert.ToInt32(writeConcernError["code"]),
-			ErrMsg: convert.ToString(writeConcernError["errmsg"]),
-		}
-	}
-
-	writeErrors, err := convert.ConvertToBSONMapSlice(result["writeErrors"])
-	if err == nil {
-		errors := WriteErrors{}
-		errors.Errors = make([]WriteError, len(writeErrors))
-		for i := 0; i < len(writeErrors); i++ {
-			writeError := WriteError{
-				Index:  convert.ToInt32(writeErrors[i]["index"]),
-				Code:   convert.ToInt32(writeErrors[i]["code"]),
-				ErrMsg: convert.ToString(writeErrors[i]["errmsg"]),
-			}
-			errors.Errors[i] = writeError
-		}
-		return errors
-	}
-
-	return MongoError{
-		message: "Something failed",
-	}
+	updateCommand := c.withWriteConcern(bson.D{{"update", c.name}})
+	return c.executeWrite(ctx, updateCommand, "updates", [][]byte{updateBytes})
 }
 
-func (c *C) Remove(selector interface{}, options *RemoveOpts) error {
-	collection := c.name
+func (c *C) Remove(selector interface{}, options *RemoveOpts) (*WriteResult, error) {
+	return c.RemoveContext(context.Background(), selector, options)
+}
 
+func (c *C) RemoveContext(ctx context.Context, selector interface{}, options *RemoveOpts) (*WriteResult, error) {
 	limit := 1
 	if options != nil {
 		if options.Multi {
@@ -221,125 +244,223 @@ func (c *C) Remove(selector interface{}, options *RemoveOpts) error {
 		}
 	}
 
-	deletes := make([]bson.M, 1)
-	deletes[0] = bson.M{
+	deleteBytes, err := bson.Marshal(bson.M{
 		"q":     selector,
 		"limit": limit,
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	deleteCommand := bson.D{{"delete", collection}, {"deletes", deletes}}
-
-	var result bson.M
-	c.database.ExecuteCommand(deleteCommand, &result)
-
-	if convert.ToInt(result["ok"]) == 1 {
-		return nil
-	}
+	deleteCommand := c.withWriteConcern(bson.D{{"delete", c.name}})
+	return c.executeWrite(ctx, deleteCommand, "deletes", [][]byte{deleteBytes})
+}
 
-	writeConcernError := convert.ToBSONMap(result["writeConcernError"])
-	if writeConcernError != nil {
-		return WriteConcernError{
-			Code:   convert.ToInt32(writeConcernError["code"]),
-			ErrMsg: convert.ToString(writeConcernError["errmsg"]),
-		}
-	}
+func (c *C) GetMore(cursor Cursor) (Cursor, error) {
+	return c.GetMoreContext(context.Background(), cursor)
+}
 
-	writeErrors, err := convert.ConvertToBSONMapSlice(result["writeErrors"])
-	if err == nil {
-		errors := WriteErrors{}
-		errors.Errors = make([]WriteError, len(writeErrors))
-		for i := 0; i < len(writeErrors); i++ {
-			writeError := WriteError{
-				Index:  convert.ToInt32(writeErrors[i]["index"]),
-				Code:   convert.ToInt32(writeErrors[i]["code"]),
-				ErrMsg: convert.ToString(writeErrors[i]["errmsg"]),
-			}
-			errors.Errors[i] = writeError
+func (c *C) GetMoreContext(ctx context.Context, cursor Cursor) (Cursor, error) {
+	cObj := c.cursorObjFor(cursor, 0)
+	// a pinned cursor is only known on its own connection, which behind a
+	// load balancer may be to another mongos than one from the pool
+	if cObj.connection != nil {
+		err := cObj.getMorePinned(ctx)
+		if err != nil {
+			return nil, err
 		}
-		return errors
+		return cObj, nil
 	}
 
-	return MongoError{
-		message: "Something failed",
+	connection, err := c.database.mongo.checkoutCursor(ctx, cObj.address)
+	if err != nil {
+		return nil, err
 	}
+	defer c.database.mongo.checkin(connection)
+	return c.getMore(ctx, connection, cursor)
 }
 
-func (c *C) GetMore(cursor Cursor) (Cursor, error) {
-	requestID := c.database.mongo.nextID()
-	responseTo := int32(0)
-
-	fullCollectionBytes := []byte(cursor.Namespace())
-	fullCollectionBytes = append(fullCollectionBytes, byte('\x00'))
-
-	numberToReturn := cursor.BatchSize()
-	buf := new(bytes.Buffer)
-	buffer.WriteToBuf(buf, int32(0), requestID, responseTo, int32(OP_GET_MORE), int32(0), fullCollectionBytes,
-		numberToReturn, cursor.ID())
-
-	input := buf.Bytes()
+// getMore fetches the next batch of a cursor on a connection.
+func (c *C) getMore(ctx context.Context, connection *Connection, cursor Cursor) (Cursor, error) {
+	if !connection.supportsFindCommand() {
+		return c.getMoreLegacy(ctx, connection, cursor)
+	}
 
-	respSize := make([]byte, 4)
-	binary.LittleEndian.PutUint32(respSize, uint32(len(input)))
-	input[0] = respSize[0]
-	input[1] = respSize[1]
-	input[2] = respSize[2]
-	input[3] = respSize[3]
+	getMoreCommand := bson.D{
+		{"getMore", cursor.ID()},
+		{"collection", collectionName(cursor.Namespace())},
+		{"batchSize", cursor.BatchSize()},
+	}
 
-	res, err := c.database.mongo.conn.sendWithResponse(input)
+	var reply cursorReply
+	err := c.database.run(ctx, connection, getMoreCommand, &reply)
 	if err != nil {
 		return nil, err
 	}
+	if reply.Ok != 1 {
+		return nil, reply.error()
+	}
 
-	cObj, ok := cursor.(*cursorObj)
-	if !ok {
-		var ok2 bool
-		cObj, ok2 = c.cursors[cursor.ID()]
-		if !ok2 {
-			cObj = &cursorObj{
-				collection: c,
-				cursorID:   cursor.ID(),
-				requestID:  requestID,
-				namespace:  cursor.Namespace(),
-				limit:      cursor.Limit(),
-				batchSize:  cursor.BatchSize(),
-				err:        cursor.Error(),
+	cObj := c.cursorObjFor(cursor, 0)
+	receiveCursorReply(&reply, cObj)
+	return cObj, nil
+}
+
+func (c *C) KillCursors(cursors ...Cursor) error {
+	return c.KillCursorsContext(context.Background(), cursors...)
+}
+
+func (c *C) KillCursorsContext(ctx context.Context, cursors ...Cursor) error {
+	// cursors are killed on the servers they were opened on, and pinned
+	// cursors on their own connections
+	servers := make(map[string][]Cursor)
+	for _, cursor := range cursors {
+		address := ""
+		if cObj, ok := cursor.(*cursorObj); ok {
+			if cObj.connection != nil && !cObj.moreToCome {
+				err := c.killCursors(ctx, cObj.connection, cObj)
+				cObj.release()
+				if err != nil {
+					return err
+				}
+				continue
 			}
-			c.cursors[cursor.ID()] = cObj
+			// a connection that the server is still streaming batches on
+			// can't be used for anything else, so it is closed
+			cObj.release()
+			address = cObj.address
 		}
+		servers[address] = append(servers[address], cursor)
 	}
 
-	receiveFindResponse(res, cObj)
-
-	if err != nil {
-		return nil, err
+	for address, cursors := range servers {
+		connection, err := c.database.mongo.checkoutCursor(ctx, address)
+		if err != nil {
+			return err
+		}
+		err = c.killCursors(ctx, connection, cursors...)
+		c.database.mongo.checkin(connection)
+		if err != nil {
+			return err
+		}
 	}
-	return cObj, nil
+	return nil
 }
 
-func (c *C) KillCursors(cursors ...Cursor) error {
-	requestID := c.database.mongo.nextID()
-	responseTo := int32(0)
-	buf := new(bytes.Buffer)
-	buffer.WriteToBuf(buf, int32(0), requestID, responseTo, int32(OP_KILL_CURSORS), int32(len(cursors)))
+// killCursors kills cursors on a connection.
+func (c *C) killCursors(ctx context.Context, connection *Connection, cursors ...Cursor) error {
+	if !connection.supportsFindCommand() {
+		return c.killCursorsLegacy(ctx, connection, cursors...)
+	}
+
+	// the killCursors command works on a single collection at a time
+	ids := make(map[string][]int64)
 	for _, cursor := range cursors {
-		buffer.WriteToBuf(buf, cursor.ID())
+		name := collectionName(cursor.Namespace())
+		ids[name] = append(ids[name], cursor.ID())
 	}
-	input := buf.Bytes()
 
-	respSize := make([]byte, 4)
-	binary.LittleEndian.PutUint32(respSize, uint32(len(input)))
-	input[0] = respSize[0]
-	input[1] = respSize[1]
-	input[2] = respSize[2]
-	input[3] = respSize[3]
+	for name, cursorIDs := range ids {
+		killCursorsCommand := bson.D{{"killCursors", name}, {"cursors", cursorIDs}}
 
-	err := c.database.mongo.conn.send(input)
-	if err != nil {
-		return err
+		var result bson.M
+		err := c.database.run(ctx, connection, killCursorsCommand, &result)
+		if err != nil {
+			return err
+		}
 	}
 	for _, cursor := range cursors {
-		c.cursors[cursor.ID()] = nil
+		c.removeCursor(cursor.ID())
 	}
 
 	return nil
 }
+
+func (c *C) addCursor(cursor *cursorObj) {
+	c.cursors.mu.Lock()
+	defer c.cursors.mu.Unlock()
+	c.cursors.byID[cursor.cursorID] = cursor
+}
+
+func (c *C) removeCursor(cursorID int64) {
+	c.cursors.mu.Lock()
+	defer c.cursors.mu.Unlock()
+	delete(c.cursors.byID, cursorID)
+}
+
+// cursorObjFor returns the cursorObj that tracks the given cursor, creating
+// it if the cursor was created elsewhere.
+func (c *C) cursorObjFor(cursor Cursor, requestID int32) *cursorObj {
+	cObj, ok := cursor.(*cursorObj)
+	if ok {
+		return cObj
+	}
+
+	c.cursors.mu.Lock()
+	defer c.cursors.mu.Unlock()
+	cObj, ok = c.cursors.byID[cursor.ID()]
+	if ok && cObj != nil {
+		return cObj
+	}
+	cObj = &cursorObj{
+		collection: c,
+		cursorID:   cursor.ID(),
+		requestID:  requestID,
+		namespace:  cursor.Namespace(),
+		limit:      cursor.Limit(),
+		batchSize:  cursor.BatchSize(),
+		err:        cursor.Error(),
+	}
+	c.cursors.byID[cursor.ID()] = cObj
+	return cObj
+}
+
+// cursorOptions returns the limit, skip, batch size and OP_QUERY flags for a
+// query from its options.
+func cursorOptions(options *FindOpts) (limit int32, skip int32, batchSize int32, flags int32) {
+	batchSize = int32(20)
+
+	if options != nil {
+		limit = options.Limit
+		skip = options.Skip
+		if options.BatchSize > 1 {
+			batchSize = options.BatchSize
+		}
+
+		flags = convert.WriteBit32LE(flags, 1, options.Tailable)
+		flags = convert.WriteBit32LE(flags, 3, options.OplogReplay)
+		flags = convert.WriteBit32LE(flags, 4, options.NoCursorTimeout)
+		flags = convert.WriteBit32LE(flags, 5, options.AwaitData)
+		flags = convert.WriteBit32LE(flags, 6, options.Exhaust)
+		flags = convert.WriteBit32LE(flags, 7, options.Partial)
+	}
+
+	// a negative limit asks for a single batch
+	if limit < 0 {
+		limit = -limit
+		batchSize = limit
+	}
+	if limit > 1 && batchSize > limit {
+		batchSize = limit
+	}
+	return
+}
+
+// withWriteConcern adds the client's write concern, if it has one, to a
+// write command.
+func (c *C) withWriteConcern(command bson.D) bson.D {
+	writeConcern := c.database.mongo.options.WriteConcern
+	if writeConcern == nil {
+		return command
+	}
+	return append(command, bson.DocElem{"writeConcern", writeConcern.document()})
+}
+
+// collectionName returns the collection part of a "db.collection" namespace.
+func collectionName(namespace string) string {
+	i := strings.Index(namespace, ".")
+	if i < 0 {
+		return namespace
+	}
+	return namespace[i+1:]
+}
@@ -0,0 +1,31 @@
+package gomongo
+
+import (
+	"testing"
+)
+
+// TestWithReadPreferenceCursors checks that a cursor opened through a
+// collection with another read preference is tracked with the cursors of the
+// collection it came from.
+func TestWithReadPreferenceCursors(t *testing.T) {
+	parent := (&DB{name: "test"}).GetCollection("c").(*C)
+	derived := parent.WithReadPreference(&ReadPreference{Mode: "secondary"}).(*C)
+	cursor := &cursorObj{
+		collection: derived,
+		cursorID:   42,
+	}
+	derived.addCursor(cursor)
+	if parent.cursorObjFor(testCursor{cursor}, 0) != cursor {
+		t.Error("the cursor isn't tracked with the parent collection's")
+	}
+	parent.removeCursor(42)
+	if len(derived.cursors.byID) != 0 {
+		t.Error("removing the cursor from the parent collection left it in the derived one")
+	}
+}
+
+// testCursor hides that a cursor is a cursorObj, as a cursor created
+// elsewhere would be.
+type testCursor struct {
+	Cursor
+}
@@ -0,0 +1,139 @@
+package gomongo_test
+
+import (
+	"github.com/dmliao/gomongo"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"testing"
+)
+
+// TestPinnedCursors checks that behind a load balancer the getMores and
+// killCursors of a cursor go to the connection it was opened on, which is
+// the only one whose mongos knows about it.
+func TestPinnedCursors(t *testing.T) {
+	f := newFakeServer(t)
+	f.pinCursors = true
+	f.hello["msg"] = "isdbgrid"
+	f.hello["serviceId"] = bson.NewObjectId()
+	loadBalanced := true
+	m := f.connect(&gomongo.ClientOptions{
+		LoadBalanced: &loadBalanced,
+	})
+	c := m.GetDB("test").GetCollection("c")
+	for i := 0; i < 10; i++ {
+		_, err := c.Insert(bson.M{"i": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cursor, err := c.Find(nil, &gomongo.FindOpts{BatchSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.GetMore(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.KillCursors(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if open := f.openCursors(); open != 0 {
+		t.Errorf("%v cursors left open on the server", open)
+	}
+
+	cursor, err = c.Find(nil, &gomongo.FindOpts{BatchSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := 0
+	var doc bson.M
+	for cursor.Next(&doc) == nil {
+		read++
+	}
+	if read != 10 {
+		t.Errorf("read %v documents instead of 10: %v", read, cursor.Error())
+	}
+	if stats := m.Stats()[f.address()]; stats.InUse != 0 {
+		t.Errorf("%v connections still in use", stats.InUse)
+	}
+}
+
+// The benchmarks run against the fake server in the same process, so its
+// allocations are counted along with the driver's.
+
+// TestCompression checks that a compressor is negotiated during the
+// handshake, skipping the ones the driver doesn't know, and that documents
+// sent through it come back intact.
+func TestCompression(t *testing.T) {
+	f := newFakeServer(t)
+	f.compressors = []string{"zlib"}
+	m := f.connect(&gomongo.ClientOptions{
+		Compressors: []string{"lz4", "zlib"},
+	})
+	c := m.GetDB("test").GetCollection("c")
+	text := strings.Repeat("compressible ", 1000)
+	_, err := c.Insert(bson.M{"text": text})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cursor, err := c.Find(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.M
+	err = cursor.Next(&doc)
+	if err != nil || doc["text"] != text {
+		t.Errorf("read back %.20q: %v", doc["text"], err)
+	}
+
+	stats := m.Stats()[f.address()].Compression
+	if stats.CompressedBytesSent >= stats.UncompressedBytesSent-int64(len(text)/2) {
+		t.Errorf("sent %v bytes for %v", stats.CompressedBytesSent, stats.UncompressedBytesSent)
+	}
+	if stats.UncompressedBytesReceived < int64(len(text)) {
+		t.Errorf("received %v bytes", stats.UncompressedBytesReceived)
+	}
+}
+
+func BenchmarkFind(b *testing.B) {
+	f := newFakeServer(b)
+	m := f.connect(nil)
+	c := m.GetDB("test").GetCollection("c")
+	_, err := c.Insert(bson.M{"a": 1, "s": "some string value"})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cursor, err := c.Find(bson.M{"a": 1}, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var doc bson.M
+		err = cursor.Next(&doc)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInsert(b *testing.B) {
+	f := newFakeServer(b)
+	m := f.connect(nil)
+	c := m.GetDB("test").GetCollection("c")
+	doc := bson.M{"a": 1, "s": "some string value"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := c.Insert(doc)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -11,6 +11,13 @@ type FindOpts struct {
 	NoCursorTimeout bool
 	AwaitData       bool
 	Partial         bool
+	// Exhaust has the server stream every batch of the cursor back to back
+	// on a connection of its own, instead of waiting for a getMore for each.
+	// MongoDB 3.2 and 3.4 can't stream the batches of the find command, so
+	// they are still fetched with a getMore each.
+	Exhaust bool
+	// ReadPreference overrides the read preference of the collection.
+	ReadPreference *ReadPreference
 }
 
 type UpdateOpts struct {
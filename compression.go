@@ -0,0 +1,277 @@
+package gomongo
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Compressor IDs used in OP_COMPRESSED
+const (
+	COMPRESSOR_NOOP   uint8 = 0
+	COMPRESSOR_SNAPPY uint8 = 1
+	COMPRESSOR_ZLIB   uint8 = 2
+	COMPRESSOR_ZSTD   uint8 = 3
+)
+
+// commands that must never be compressed, since they may carry credentials
+// or take part in the handshake
+var uncompressibleCommands = map[string]bool{
+	"hello":           true,
+	"isMaster":        true,
+	"ismaster":        true,
+	"saslStart":       true,
+	"saslContinue":    true,
+	"getnonce":        true,
+	"authenticate":    true,
+	"createUser":      true,
+	"updateUser":      true,
+	"copydbSaslStart": true,
+	"copydbgetnonce":  true,
+	"copydb":          true,
+}
+
+type compressor interface {
+	id() uint8
+	name() string
+	compress(src []byte) ([]byte, error)
+	decompress(src []byte, uncompressedSize int32) ([]byte, error)
+}
+
+// newCompressor returns the compressor with the given name, as it appears in
+// the "compression" field of the handshake.
+func newCompressor(name string, zlibLevel int) (compressor, error) {
+	switch name {
+	case "snappy":
+		return snappyCompressor{}, nil
+	case "zlib":
+		return zlibCompressor{level: zlibLevel}, nil
+	case "zstd":
+		return zstdCompressor{}, nil
+	}
+	return nil, fmt.Errorf("unsupported compressor %v", name)
+}
+
+// compressorByID returns the compressor for a compressor ID read off the
+// wire.
+func compressorByID(id uint8) (compressor, error) {
+	switch id {
+	case COMPRESSOR_NOOP:
+		return noopCompressor{}, nil
+	case COMPRESSOR_SNAPPY:
+		return snappyCompressor{}, nil
+	case COMPRESSOR_ZLIB:
+		return zlibCompressor{level: zlib.DefaultCompression}, nil
+	case COMPRESSOR_ZSTD:
+		return zstdCompressor{}, nil
+	}
+	return nil, fmt.Errorf("unsupported compressor id %v", id)
+}
+
+type noopCompressor struct{}
+
+func (noopCompressor) id() uint8 {
+	return COMPRESSOR_NOOP
+}
+
+func (noopCompressor) name() string {
+	return "noop"
+}
+
+func (noopCompressor) compress(src []byte) ([]byte, error) {
+	return src, nil
+}
+
+func (noopCompressor) decompress(src []byte, uncompressedSize int32) ([]byte, error) {
+	return src, nil
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) id() uint8 {
+	return COMPRESSOR_SNAPPY
+}
+
+func (snappyCompressor) name() string {
+	return "snappy"
+}
+
+func (snappyCompressor) compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (snappyCompressor) decompress(src []byte, uncompressedSize int32) ([]byte, error) {
+	length, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if length != int(uncompressedSize) {
+		return nil, fmt.Errorf("snappy data decodes to %v bytes instead of %v", length, uncompressedSize)
+	}
+	return snappy.Decode(make([]byte, uncompressedSize), src)
+}
+
+type zlibCompressor struct {
+	level int
+}
+
+func (zlibCompressor) id() uint8 {
+	return COMPRESSOR_ZLIB
+}
+
+func (zlibCompressor) name() string {
+	return "zlib"
+}
+
+func (z zlibCompressor) compress(src []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	writer, err := zlib.NewWriterLevel(buf, z.level)
+	if err != nil {
+		return nil, err
+	}
+	_, err = writer.Write(src)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (zlibCompressor) decompress(src []byte, uncompressedSize int32) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	// read one byte more than expected, so that a size mismatch is caught
+	// without inflating all of an oversized message
+	return ioutil.ReadAll(io.LimitReader(reader, int64(uncompressedSize)+1))
+}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	// the decoder writes no more than the capacity of the buffer it is
+	// given, so that a small frame can't inflate past the size of the
+	// message it claims to be
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecodeAllCapLimit(true),
+		zstd.WithDecoderMaxMemory(uint64(defaultMaxMessageSizeBytes)))
+)
+
+type zstdCompressor struct{}
+
+func (zstdCompressor) id() uint8 {
+	return COMPRESSOR_ZSTD
+}
+
+func (zstdCompressor) name() string {
+	return "zstd"
+}
+
+func (zstdCompressor) compress(src []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(src, nil), nil
+}
+
+func (zstdCompressor) decompress(src []byte, uncompressedSize int32) ([]byte, error) {
+	original, err := zstdDecoder.DecodeAll(src, make([]byte, 0, uncompressedSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(original) != int(uncompressedSize) {
+		return nil, fmt.Errorf("zstd data decodes to %v bytes instead of %v", len(original), uncompressedSize)
+	}
+	return original, nil
+}
+
+// compressMessage wraps a complete message in an OP_COMPRESSED.
+func compressMessage(message []byte, c compressor) ([]byte, error) {
+	compressed, err := c.compress(message[16:])
+	if err != nil {
+		return nil, err
+	}
+
+	output := make([]byte, 25, 25+len(compressed))
+	copy(output, message[:16])
+	binary.LittleEndian.PutUint32(output[0:], uint32(25+len(compressed)))
+	binary.LittleEndian.PutUint32(output[12:], uint32(OP_COMPRESSED))
+	copy(output[16:], message[12:16])
+	binary.LittleEndian.PutUint32(output[20:], uint32(len(message)-16))
+	output[24] = c.id()
+	return append(output, compressed...), nil
+}
+
+// DecompressMessage unwraps the contents of an OP_COMPRESSED following the
+// message header, and returns the header and contents of the original message.
+// The original message may be at most maxSize bytes long.
+func DecompressMessage(header MsgHeader, contents []byte, maxSize int32) (MsgHeader, []byte, error) {
+	if len(contents) < 9 {
+		return header, nil, fmt.Errorf("OP_COMPRESSED too short: %v bytes", len(contents))
+	}
+	compressed := OpCompressed{
+		Header:            header,
+		OriginalOpcode:    int32(binary.LittleEndian.Uint32(contents[0:])),
+		UncompressedSize:  int32(binary.LittleEndian.Uint32(contents[4:])),
+		CompressorID:      contents[8],
+		CompressedMessage: contents[9:],
+	}
+	if compressed.UncompressedSize < 0 || compressed.UncompressedSize > maxSize-16 {
+		return header, nil, fmt.Errorf("invalid uncompressed size %v", compressed.UncompressedSize)
+	}
+
+	c, err := compressorByID(compressed.CompressorID)
+	if err != nil {
+		return header, nil, err
+	}
+	original, err := c.decompress(compressed.CompressedMessage, compressed.UncompressedSize)
+	if err != nil {
+		return header, nil, err
+	}
+	if int32(len(original)) != compressed.UncompressedSize {
+		return header, nil, fmt.Errorf("decompressed %v bytes instead of %v", len(original),
+			compressed.UncompressedSize)
+	}
+
+	header.OpCode = compressed.OriginalOpcode
+	header.MessageLength = 16 + compressed.UncompressedSize
+	return header, original, nil
+}
+
+// compressible returns whether a message may be sent compressed. Only
+// OP_QUERY and OP_MSG are inspected for the command being run.
+func compressible(message []byte) bool {
+	if len(message) < 16 {
+		return false
+	}
+	var doc []byte
+	switch int32(binary.LittleEndian.Uint32(message[12:])) {
+	case OP_MSG:
+		if len(message) < 21 || message[20] != 0 {
+			return true
+		}
+		doc = message[21:]
+	case OP_QUERY:
+		end := bytes.IndexByte(message[20:], 0)
+		if end < 0 || len(message) < 20+end+1+8 {
+			return false
+		}
+		namespace := string(message[20 : 20+end])
+		if !strings.HasSuffix(namespace, ".$cmd") {
+			return true
+		}
+		doc = message[20+end+1+8:]
+	case OP_COMPRESSED:
+		return false
+	default:
+		return true
+	}
+
+	return !uncompressibleCommands[commandName(doc)]
+}
@@ -0,0 +1,38 @@
+package gomongo
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestDecompressOversized checks that every compressor refuses data that
+// decompresses to more than the size the message claims, without inflating
+// all of it.
+func TestDecompressOversized(t *testing.T) {
+	original := bytes.Repeat([]byte{0}, 1<<20)
+	for _, name := range []string{"snappy", "zlib", "zstd"} {
+		c, err := newCompressor(name, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed, err := c.compress(original)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decompressed, err := c.decompress(compressed, int32(len(original)))
+		if err != nil || !bytes.Equal(decompressed, original) {
+			t.Errorf("%v: round trip failed: %v", name, err)
+		}
+		header := MsgHeader{OpCode: OP_COMPRESSED}
+		contents := append([]byte{0xdd, 0x07, 0, 0, 100, 0, 0, 0, c.id()}, compressed...)
+		_, _, err = DecompressMessage(header, contents, defaultMaxMessageSizeBytes)
+		if err == nil {
+			t.Errorf("%v: %v bytes accepted as 100", name, len(original))
+		}
+		decompressed, _ = c.decompress(compressed, 100)
+		if len(decompressed) > 101 {
+			t.Errorf("%v: inflated %v bytes for a message of 100", name, len(decompressed))
+		}
+	}
+}
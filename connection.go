@@ -1,9 +1,15 @@
 package gomongo
 
 import (
+	"bufio"
+	"context"
+	"encoding/binary"
 	"fmt"
-	"gopkg.in/fatih/pool.v2"
+	"gopkg.in/mgo.v2/bson"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Conn interface {
@@ -12,36 +18,61 @@ type Conn interface {
 }
 
 type Connection struct {
-	connPool pool.Pool
-	conn     net.Conn
-	address  string
-	err      error
+	reader        *bufio.Reader
+	conn          net.Conn
+	address       string
+	pool          *pool
+	generation    uint64
+	idleSince     time.Time
+	socketTimeout time.Duration
+	description   *ServerDescription
+	compressor    compressor
+	err           error
+	// stats are shared by the connections to the server, and reported with
+	// its pool's
+	stats *CompressionStats
+
+	// readPreference is sent as $readPreference with the commands of a read
+	// while the connection is checked out for it, and secondaryOk sets the
+	// bit of the same name on OP_QUERY
+	readPreference bson.D
+	secondaryOk    bool
+
+	// Replies are matched to requests by their responseTo field, so several
+	// requests can be in flight on the connection at once. Only one goroutine
+	// reads from the socket at a time; replies it reads for other requests
+	// are kept until their owner collects them.
+	writeMu sync.Mutex
+	readMu  sync.Mutex
+	mu      sync.Mutex
+	pending map[int32]bool
+	replies map[int32]Reply
 }
 
-func (c *Connection) connect() error {
-	factory := func() (net.Conn, error) {
-		return net.Dial("tcp", fmt.Sprintf("%v", c.address))
-	}
-	p, err := pool.NewChannelPool(5, 30, factory)
-	if err != nil {
-		return err
-	}
-	if c.conn != nil {
-		c.conn.Close()
-	}
-	if c.connPool != nil {
-		c.connPool.Close()
-	}
-	c.connPool = p
-	c.conn, err = p.Get()
-	if err != nil {
-		return err
-	}
+// CompressionStats counts the bytes sent to and received from a server. The
+// uncompressed counters hold the size of every message before compression,
+// and the compressed counters hold the size actually sent over the wire, so
+// both are equal for messages that were not compressed.
+type CompressionStats struct {
+	CompressedBytesSent       int64
+	UncompressedBytesSent     int64
+	CompressedBytesReceived   int64
+	UncompressedBytesReceived int64
+}
 
-	return nil
+// load returns a copy of counters that are being updated concurrently.
+func (s *CompressionStats) load() CompressionStats {
+	return CompressionStats{
+		CompressedBytesSent:       atomic.LoadInt64(&s.CompressedBytesSent),
+		UncompressedBytesSent:     atomic.LoadInt64(&s.UncompressedBytesSent),
+		CompressedBytesReceived:   atomic.LoadInt64(&s.CompressedBytesReceived),
+		UncompressedBytesReceived: atomic.LoadInt64(&s.UncompressedBytesReceived),
+	}
 }
 
 func (c *Connection) fatal(err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.err == nil {
 		c.Close()
 		c.err = err
@@ -50,34 +81,249 @@ func (c *Connection) fatal(err error) error {
 }
 
 func (c *Connection) Close() error {
-	c.conn.Close()
-	c.conn = nil
-	c.connPool.Close()
-	return nil
+	return c.conn.Close()
 }
 
 func (c *Connection) Error() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.err
 }
 
-func (c *Connection) send(message []byte) error {
-	if c.err != nil {
-		return c.err
+func (c *Connection) countSent(wireLength int, length int) {
+	if c.stats == nil {
+		return
+	}
+	atomic.AddInt64(&c.stats.CompressedBytesSent, int64(wireLength))
+	atomic.AddInt64(&c.stats.UncompressedBytesSent, int64(length))
+}
+
+func (c *Connection) countReceived(wireLength int32, length int32) {
+	if c.stats == nil {
+		return
+	}
+	atomic.AddInt64(&c.stats.CompressedBytesReceived, int64(wireLength))
+	atomic.AddInt64(&c.stats.UncompressedBytesReceived, int64(length))
+}
+
+// watch applies the context deadline, or the socket timeout if it is sooner,
+// to the socket with setDeadline, and interrupts blocked I/O if the context
+// is cancelled before stop is called.
+func (c *Connection) watch(ctx context.Context, setDeadline func(time.Time) error) (stop func()) {
+	deadline, ok := ctx.Deadline()
+	if c.socketTimeout > 0 {
+		timeout := time.Now().Add(c.socketTimeout)
+		if !ok || timeout.Before(deadline) {
+			deadline = timeout
+		}
+	}
+	setDeadline(deadline)
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			setDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// ioError turns an error from the socket into the context's error if the
+// context is why the I/O failed. Either way the connection can't be used
+// afterwards, since a message may have been cut short.
+func (c *Connection) ioError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		// the socket deadline can go off a moment before the context's timer
+		deadline, ok := ctx.Deadline()
+		if ok && !time.Now().Before(deadline) {
+			err = context.DeadlineExceeded
+		}
+	}
+	return c.fatal(err)
+}
+
+func (c *Connection) send(ctx context.Context, message []byte) error {
+	err := c.Error()
+	if err != nil {
+		return err
 	}
 	connection := c.conn
 
-	_, err := connection.Write(message)
+	output := message
+	if c.compressor != nil && compressible(message) {
+		var err error
+		output, err = compressMessage(message, c.compressor)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.writeMu.Lock()
+	stop := c.watch(ctx, connection.SetWriteDeadline)
+	_, err = connection.Write(output)
+	stop()
+	c.writeMu.Unlock()
 	if err != nil {
-		return c.fatal(err)
+		return c.ioError(ctx, err)
 	}
+	c.countSent(len(output), len(message))
 
 	return nil
 }
 
-func (c *Connection) sendWithResponse(message []byte) (*OpResponse, error) {
-	err := c.send(message)
+func (c *Connection) sendWithResponse(ctx context.Context, message []byte) (Reply, error) {
+	requestID, err := c.sendRequest(ctx, message)
 	if err != nil {
 		return nil, err
 	}
-	return c.receive()
+	return c.receiveResponse(ctx, requestID)
+}
+
+// sendRequest sends a message that expects a reply, and returns its request
+// ID to collect the reply with receiveResponse. Several requests can be sent
+// before any of their replies are collected.
+func (c *Connection) sendRequest(ctx context.Context, message []byte) (int32, error) {
+	requestID := int32(binary.LittleEndian.Uint32(message[4:8]))
+	c.expect(requestID)
+
+	err := c.send(ctx, message)
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, requestID)
+		c.mu.Unlock()
+		return 0, err
+	}
+	return requestID, nil
+}
+
+// expect marks a reply to requestID as awaited.
+func (c *Connection) expect(requestID int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending == nil {
+		c.pending = make(map[int32]bool)
+		c.replies = make(map[int32]Reply)
+	}
+	c.pending[requestID] = true
+}
+
+// receiveMoreToCome waits for the next reply of a stream, such as the
+// batches of an exhaust cursor. Each reply of a stream answers the previous
+// reply rather than a request.
+func (c *Connection) receiveMoreToCome(ctx context.Context, previousRequestID int32) (Reply, error) {
+	c.expect(previousRequestID)
+	return c.receiveResponse(ctx, previousRequestID)
+}
+
+// receiveResponse waits for the reply to the request with the given ID.
+// Replies to other requests in flight are set aside for their owners, and a
+// reply to a request that is not in flight is fatal to the connection.
+//
+// If the context is done before the reply arrives, the connection is closed,
+// since the reply would otherwise still be waiting on the socket.
+func (c *Connection) receiveResponse(ctx context.Context, requestID int32) (Reply, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	stop := c.watch(ctx, c.conn.SetReadDeadline)
+	defer stop()
+
+	for {
+		c.mu.Lock()
+		reply, ok := c.replies[requestID]
+		if ok {
+			delete(c.replies, requestID)
+			delete(c.pending, requestID)
+		}
+		err := c.err
+		c.mu.Unlock()
+		if ok {
+			return reply, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		reply, err = c.receive()
+		if err != nil {
+			return nil, c.ioError(ctx, err)
+		}
+
+		responseTo := reply.MessageHeader().ResponseTo
+		c.mu.Lock()
+		if responseTo == requestID {
+			delete(c.pending, requestID)
+			c.mu.Unlock()
+			return reply, nil
+		}
+		if !c.pending[responseTo] {
+			c.mu.Unlock()
+			return nil, c.fatal(UnexpectedReplyError{
+				RequestID:  reply.MessageHeader().RequestID,
+				ResponseTo: responseTo,
+			})
+		}
+		c.replies[responseTo] = reply
+		c.mu.Unlock()
+	}
+}
+
+// sendWithOpReply sends a legacy request, which the server must answer with
+// an OP_REPLY.
+func (c *Connection) sendWithOpReply(ctx context.Context, message []byte) (*OpResponse, error) {
+	res, err := c.sendWithResponse(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	reply, ok := res.(*OpResponse)
+	if !ok {
+		return nil, fmt.Errorf("expected OP_REPLY, got opcode %v", res.MessageHeader().OpCode)
+	}
+	return reply, nil
+}
+
+// supportsFindCommand returns whether the server supports the find, getMore
+// and killCursors commands.
+func (c *Connection) supportsFindCommand() bool {
+	return c.maxWireVersion() >= 4
+}
+
+// supportsOpMsg returns whether the server is new enough to accept OP_MSG.
+func (c *Connection) supportsOpMsg() bool {
+	return c.maxWireVersion() >= 6
+}
+
+// supportsExhaust returns whether the server can stream the batches of a
+// cursor: with OP_MSG, or with OP_QUERY for servers that predate the find
+// command. Servers in between only stream the results of OP_QUERY, which
+// cursors opened with the find command don't use.
+func (c *Connection) supportsExhaust() bool {
+	return c.supportsOpMsg() || !c.supportsFindCommand()
+}
+
+// maxWireVersion returns the server's wire version, which is zero until the
+// handshake is done.
+func (c *Connection) maxWireVersion() int32 {
+	if c.description == nil {
+		return 0
+	}
+	return c.description.MaxWireVersion
+}
+
+// serviceID returns the ID of the mongos behind a load balancer that the
+// connection is to, or "" outside of load balanced mode.
+func (c *Connection) serviceID() bson.ObjectId {
+	if c.description == nil {
+		return ""
+	}
+	return c.description.ServiceID
 }
@@ -0,0 +1,113 @@
+package gomongo
+
+import (
+	"bufio"
+	"context"
+	"gopkg.in/mgo.v2/bson"
+	"net"
+	"testing"
+	"time"
+)
+
+// encodeTestMsg returns an OP_MSG with an empty body.
+func encodeTestMsg(requestID int32, responseTo int32) []byte {
+	body, _ := bson.Marshal(bson.M{})
+	w := EncodeMsg(requestID, responseTo, &OpMsg{
+		Sections: []MsgSection{{Kind: 0, Documents: [][]byte{body}}},
+	})
+	defer w.Release()
+	return append([]byte(nil), w.Bytes()...)
+}
+
+// testConnection returns a connection to a server that reads the given
+// number of requests, and then sends replies to the request IDs in
+// responseTo, in that order.
+func testConnection(t *testing.T, requests int, responseTo ...int32) *Connection {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	go func() {
+		for i := 0; i < requests; i++ {
+			_, err := ReadMessage(server, defaultMaxMessageSizeBytes)
+			if err != nil {
+				return
+			}
+		}
+		for i, id := range responseTo {
+			_, err := server.Write(encodeTestMsg(int32(100+i), id))
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return &Connection{
+		conn:   client,
+		reader: bufio.NewReader(client),
+	}
+}
+
+// TestPipelinedReplies checks that replies that come back out of order go
+// to the requests they answer.
+func TestPipelinedReplies(t *testing.T) {
+	c := testConnection(t, 3, 3, 1, 2)
+	ctx := context.Background()
+	for id := int32(1); id <= 3; id++ {
+		_, err := c.sendRequest(ctx, encodeTestMsg(id, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []int32{2, 1, 3} {
+		reply, err := c.receiveResponse(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if responseTo := reply.MessageHeader().ResponseTo; responseTo != id {
+			t.Errorf("got the reply to %v for request %v", responseTo, id)
+		}
+	}
+	if len(c.pending) != 0 || len(c.replies) != 0 {
+		t.Errorf("left %v pending requests and %v replies", c.pending, c.replies)
+	}
+}
+
+// TestStrayReply checks that a reply to a request that isn't in flight
+// breaks the connection.
+func TestStrayReply(t *testing.T) {
+	c := testConnection(t, 1, 99)
+	ctx := context.Background()
+	_, err := c.sendRequest(ctx, encodeTestMsg(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.receiveResponse(ctx, 1)
+	if unexpected, ok := err.(UnexpectedReplyError); !ok || unexpected.ResponseTo != 99 {
+		t.Fatalf("received a reply to 99 for request 1: %v", err)
+	}
+	if c.Error() == nil {
+		t.Error("the connection is still usable")
+	}
+}
+
+// TestReplyAfterTimeout checks that a request that timed out leaves the
+// connection closed, so that its late reply isn't taken for the answer to
+// the next request.
+func TestReplyAfterTimeout(t *testing.T) {
+	c := testConnection(t, 2)
+	_, err := c.sendRequest(context.Background(), encodeTestMsg(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = c.receiveResponse(ctx, 1)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("waiting for a reply that never comes: %v", err)
+	}
+	_, err = c.sendRequest(context.Background(), encodeTestMsg(2, 0))
+	if err != context.DeadlineExceeded {
+		t.Errorf("sent a request after one timed out: %v", err)
+	}
+}
@@ -1,6 +1,8 @@
 package gomongo
 
 import (
+	"context"
+	"github.com/dmliao/gomongo/convert"
 	"gopkg.in/mgo.v2/bson"
 	"io"
 )
@@ -16,6 +18,11 @@ type Cursor interface {
 
 	HasNext() bool
 	Next(result interface{}) error
+
+	// The Context variants give up on fetching the next batch when the
+	// context is done, which also closes the cursor.
+	HasNextContext(ctx context.Context) bool
+	NextContext(ctx context.Context, result interface{}) error
 }
 
 type cursorObj struct {
@@ -30,6 +37,54 @@ type cursorObj struct {
 	docs       [][]byte
 	err        error
 	flags      int32
+	// address is the server the cursor was opened on
+	address string
+
+	// connection is where a cursor pinned to a connection gets its
+	// batches: an exhaust cursor, or any cursor behind a load balancer.
+	// While moreToCome is set the server is still streaming the batches of
+	// an exhaust cursor, each one in answer to the reply with lastRequestID.
+	connection    *Connection
+	exhaust       bool
+	moreToCome    bool
+	lastRequestID int32
+}
+
+// cursorReply is the reply to a find or getMore command.
+type cursorReply struct {
+	Cursor struct {
+		ID         int64      `bson:"id"`
+		Namespace  string     `bson:"ns"`
+		FirstBatch []bson.Raw `bson:"firstBatch"`
+		NextBatch  []bson.Raw `bson:"nextBatch"`
+	} `bson:"cursor"`
+	Ok     float64 `bson:"ok"`
+	ErrMsg string  `bson:"errmsg"`
+	Code   int32   `bson:"code"`
+}
+
+func (r *cursorReply) error() error {
+	return MongoError{
+		message: r.ErrMsg,
+		code:    r.Code,
+	}
+}
+
+// receiveCursorReply loads the batch from a find or getMore reply into the
+// cursor.
+func receiveCursorReply(reply *cursorReply, cursor *cursorObj) {
+	batch := reply.Cursor.FirstBatch
+	if batch == nil {
+		batch = reply.Cursor.NextBatch
+	}
+	cursor.docs = make([][]byte, len(batch))
+	for i, doc := range batch {
+		cursor.docs[i] = doc.Data
+	}
+	cursor.cursorID = reply.Cursor.ID
+	if reply.Cursor.Namespace != "" {
+		cursor.namespace = reply.Cursor.Namespace
+	}
 }
 
 func (c *cursorObj) fatal(err error) error {
@@ -45,6 +100,9 @@ func (c *cursorObj) ID() int64 {
 }
 
 func (c *cursorObj) Namespace() string {
+	if c.namespace != "" {
+		return c.namespace
+	}
 	return c.collection.database.name + "." + c.collection.name
 }
 
@@ -60,12 +118,11 @@ func (c *cursorObj) Close() error {
 	if c.err != nil {
 		return nil
 	}
-	if c.requestID != 0 {
-		c.collection.cursors[c.cursorID] = nil
-	}
+	c.collection.removeCursor(c.cursorID)
 	if c.cursorID != 0 {
-		c.collection.KillCursors(c)
+		c.kill()
 	}
+	c.release()
 	c.err = MongoError{
 		message: "Cursor closed",
 	}
@@ -73,11 +130,38 @@ func (c *cursorObj) Close() error {
 	return nil
 }
 
+// kill kills the cursor on the server. It is only cleanup, so it gives up
+// after the socket timeout, or after killOperationsTimeout if there is none,
+// rather than holding up Close until a connection frees up.
+func (c *cursorObj) kill() {
+	timeout := killOperationsTimeout
+	socketTimeout := c.collection.database.mongo.options.SocketTimeout
+	if socketTimeout > 0 && socketTimeout < timeout {
+		timeout = socketTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	c.collection.KillCursorsContext(ctx, c)
+}
+
+// getMorePinned fetches the next batch of a cursor on the connection it is
+// pinned to, and gives the connection back once the cursor is exhausted.
+func (c *cursorObj) getMorePinned(ctx context.Context) error {
+	if c.exhaust {
+		return c.getMoreExhaust(ctx)
+	}
+	_, err := c.collection.getMore(ctx, c.connection, c)
+	if err == nil && c.cursorID == 0 {
+		c.release()
+	}
+	return err
+}
+
 func (c *cursorObj) Error() error {
 	return c.err
 }
 
-func (c *cursorObj) getNextBatch() error {
+func (c *cursorObj) getNextBatch(ctx context.Context) error {
 	if c.err != nil {
 		return c.err
 	}
@@ -89,7 +173,7 @@ func (c *cursorObj) getNextBatch() error {
 		return c.fatal(io.EOF)
 	}
 
-	_, err := c.collection.GetMore(c)
+	_, err := c.collection.GetMoreContext(ctx, c)
 	if err != nil {
 		return c.fatal(err)
 	}
@@ -98,6 +182,10 @@ func (c *cursorObj) getNextBatch() error {
 }
 
 func (c *cursorObj) HasNext() bool {
+	return c.HasNextContext(context.Background())
+}
+
+func (c *cursorObj) HasNextContext(ctx context.Context) bool {
 	if c.err != nil {
 		return false
 	}
@@ -105,20 +193,25 @@ func (c *cursorObj) HasNext() bool {
 	if c.limit > 0 && c.count >= c.limit {
 		return false
 	}
-	if c.docCount < int32(len(c.docs)) {
-		return true
+	for c.docCount >= int32(len(c.docs)) {
+		err := c.getNextBatch(ctx)
+		if err != nil {
+			return false
+		}
+		// a tailable cursor returns empty batches until new data arrives
+		if len(c.docs) == 0 && convert.ReadBit32LE(c.flags, 1) {
+			return false
+		}
 	}
-
-	err := c.getNextBatch()
-	if err != nil {
-		return false
-	}
-	c.docCount = 0
 	return true
 }
 
 func (c *cursorObj) Next(result interface{}) error {
-	if !c.HasNext() {
+	return c.NextContext(context.Background(), result)
+}
+
+func (c *cursorObj) NextContext(ctx context.Context, result interface{}) error {
+	if !c.HasNextContext(ctx) {
 		return io.EOF
 	}
 	r := c.docs[c.docCount]
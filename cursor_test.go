@@ -0,0 +1,150 @@
+package gomongo_test
+
+import (
+	"fmt"
+	"github.com/dmliao/gomongo"
+	"gopkg.in/mgo.v2/bson"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentCursors runs finds, getMores and killCursors on collections
+// shared by many goroutines, through a pool too small for all of them. Each
+// collection holds documents of its own, so a reply handed to the wrong
+// operation shows up as a document from another collection. Run it with
+// -race.
+func TestConcurrentCursors(t *testing.T) {
+	const (
+		collections = 8
+		docs        = 30
+		workers     = 16
+		iterations  = 21
+	)
+	f := newFakeServer(t)
+	m := f.connect(&gomongo.ClientOptions{
+		MaxPoolSize: 4,
+	})
+	db := m.GetDB("test")
+
+	shared := make([]gomongo.Collection, collections)
+	for g := range shared {
+		shared[g] = db.GetCollection(fmt.Sprintf("c%v", g))
+		batch := make([]interface{}, docs)
+		for i := range batch {
+			batch[i] = bson.M{"g": g, "i": i}
+		}
+		_, err := shared[g].Insert(batch...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			g := w % collections
+			c := shared[g]
+			for n := 0; n < iterations; n++ {
+				cursor, err := c.Find(nil, &gomongo.FindOpts{BatchSize: 4})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				switch n % 3 {
+				case 0:
+					// read every batch
+					read(t, cursor, g, docs)
+				case 1:
+					// read part of the results, and kill the cursor when
+					// closing it
+					read(t, cursor, g, 5)
+					cursor.Close()
+				case 2:
+					_, err = c.GetMore(cursor)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if cursor.ID() == 0 {
+						t.Errorf("cursor exhausted after two batches of %v", docs)
+					}
+					err = c.KillCursors(cursor)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if open := f.openCursors(); open != 0 {
+		t.Errorf("%v cursors left open on the server", open)
+	}
+	if kills := f.commandCount("killCursors"); kills != workers*iterations*2/3 {
+		t.Errorf("%v killCursors, expected %v", kills, workers*iterations*2/3)
+	}
+}
+
+// read reads the first n documents of a cursor on collection g, checking
+// that they come from it in order.
+func read(t *testing.T, cursor gomongo.Cursor, g int, n int) {
+	for i := 0; i < n; i++ {
+		var doc struct {
+			G int `bson:"g"`
+			I int `bson:"i"`
+		}
+		err := cursor.Next(&doc)
+		if err != nil {
+			t.Errorf("document %v: %v", i, err)
+			return
+		}
+		if doc.G != g || doc.I != i {
+			t.Errorf("document %v of collection %v is document %v of collection %v", i, g, doc.I, doc.G)
+			return
+		}
+	}
+}
+
+// TestCloseTimeout checks that closing a cursor doesn't wait for a
+// connection to kill it with for longer than the socket timeout.
+func TestCloseTimeout(t *testing.T) {
+	f := newFakeServer(t)
+	m := f.connect(&gomongo.ClientOptions{
+		MaxPoolSize:   1,
+		SocketTimeout: 200 * time.Millisecond,
+	})
+	c := m.GetDB("test").GetCollection("c")
+	for i := 0; i < 10; i++ {
+		_, err := c.Insert(bson.M{"i": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cursor, err := c.Find(nil, &gomongo.FindOpts{BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an exhaust cursor keeps the only connection until it is done with
+	exhaust, err := c.Find(nil, &gomongo.FindOpts{BatchSize: 2, Exhaust: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exhaust.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		cursor.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close is still waiting for a connection to kill the cursor with")
+	}
+}
@@ -1,10 +1,10 @@
 package gomongo
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
 	"github.com/dmliao/gomongo/buffer"
 	"gopkg.in/mgo.v2/bson"
+	"time"
 )
 
 type Database interface {
@@ -13,72 +13,243 @@ type Database interface {
 	GetCollection(string) Collection
 	// DropCollection(Collection) bool
 	ExecuteCommand(interface{}, interface{}) error
+	ExecuteCommandContext(context.Context, interface{}, interface{}) error
 	// DropDatabase() bool
+
+	// WithReadPreference returns a copy of the database whose collections
+	// read with the given read preference, unless they have one of their
+	// own. Commands always run on the primary.
+	WithReadPreference(*ReadPreference) Database
 }
 
 type DB struct {
 	name  string
 	mongo *MongoDB
+	// readPreference overrides the client's, if set
+	readPreference *ReadPreference
 }
 
 func (d *DB) GetName() string {
 	return d.name
 }
 
+func (d *DB) WithReadPreference(readPreference *ReadPreference) Database {
+	return &DB{
+		name:           d.name,
+		mongo:          d.mongo,
+		readPreference: readPreference,
+	}
+}
+
 func (d *DB) GetCollection(cName string) Collection {
 	return &C{
 		name:     cName,
 		database: d,
-		cursors:  make(map[int64]*cursorObj),
+		cursors:  newCursorRegistry(),
 	}
 }
 
-func (d *DB) run(socket *Connection, command interface{}, result interface{}) error {
+// run executes a command on the given socket and unmarshals the reply into
+// result. Any document sequences are sent as kind 1 sections of an OP_MSG, or
+// folded into the command for servers that do not support OP_MSG.
+func (d *DB) run(ctx context.Context, socket *Connection, command interface{}, result interface{},
+	sequences ...MsgSection) error {
 	commandBytes, err := bson.Marshal(command)
 	if err != nil {
 		return err
 	}
+	commandBytes, err = withMaxTimeMS(ctx, commandBytes)
+	if err != nil {
+		return err
+	}
 
-	namespace := d.name + ".$cmd"
+	if !socket.supportsOpMsg() {
+		for _, sequence := range sequences {
+			docs := make([]bson.Raw, len(sequence.Documents))
+			for i, doc := range sequence.Documents {
+				docs[i] = bson.Raw{Kind: 0x03, Data: doc}
+			}
+			commandBytes, err = appendElements(commandBytes, bson.D{{sequence.Identifier, docs}})
+			if err != nil {
+				return err
+			}
+		}
+		return d.runQuery(ctx, socket, commandBytes, result)
+	}
 
-	requestID := d.mongo.nextID()
+	if socket.readPreference != nil {
+		commandBytes, err = appendElements(commandBytes, bson.D{{"$readPreference", socket.readPreference}})
+		if err != nil {
+			return err
+		}
+	}
+	res, err := d.runMsg(ctx, socket, 0, commandBytes, sequences...)
+	if err != nil {
+		return err
+	}
 
-	limit := int32(-1)
-	skip := int32(0)
-	responseTo := int32(0)
+	docs := res.Documents()
+	if len(docs) == 0 {
+		return MongoError{
+			message: "Empty command reply",
+		}
+	}
+	return bson.Unmarshal(docs[0], result)
+}
 
-	// flags
-	flags := int32(0)
-	fullCollectionBytes := []byte(namespace)
-	fullCollectionBytes = append(fullCollectionBytes, byte('\x00'))
+// encodeCommand builds an OP_MSG for a marshalled command against the
+// database. The message must be released once it has been sent.
+func (d *DB) encodeCommand(flags uint32, commandBytes []byte,
+	sequences ...MsgSection) (int32, *buffer.MessageWriter, error) {
+	commandBytes, err := d.withServerAPI(commandBytes)
+	if err != nil {
+		return 0, nil, err
+	}
+	commandBytes, err = appendElements(commandBytes, bson.D{{"$db", d.name}})
+	if err != nil {
+		return 0, nil, err
+	}
+	requestID := d.mongo.nextID()
+	return requestID, encodeMsg(requestID, flags, commandBytes, sequences...), nil
+}
 
-	buf := new(bytes.Buffer)
-	buffer.WriteToBuf(buf, int32(0), requestID, responseTo, int32(OP_QUERY), flags, fullCollectionBytes,
-		skip, limit, commandBytes)
+// runMsg sends a marshalled command in an OP_MSG with the given flags, and
+// returns the reply. The server must support OP_MSG.
+func (d *DB) runMsg(ctx context.Context, socket *Connection, flags uint32, commandBytes []byte,
+	sequences ...MsgSection) (Reply, error) {
+	requestID, message, err := d.encodeCommand(flags, commandBytes, sequences...)
+	if err != nil {
+		return nil, err
+	}
 
-	input := buf.Bytes()
+	_, err = socket.sendRequest(ctx, message.Bytes())
+	message.Release()
+	if err != nil {
+		return nil, err
+	}
+	res, err := socket.receiveResponse(ctx, requestID)
+	if err != nil {
+		if isContextError(err) {
+			go d.mongo.killOperations(socket)
+		}
+		return nil, err
+	}
+	return res, nil
+}
 
-	respSize := make([]byte, 4)
-	binary.LittleEndian.PutUint32(respSize, uint32(len(input)))
-	input[0] = respSize[0]
-	input[1] = respSize[1]
-	input[2] = respSize[2]
-	input[3] = respSize[3]
+// sendMsg sends a marshalled command in an OP_MSG with the moreToCome flag
+// set, which tells the server not to reply. The server must support OP_MSG.
+func (d *DB) sendMsg(ctx context.Context, socket *Connection, commandBytes []byte, sequences ...MsgSection) error {
+	_, message, err := d.encodeCommand(MSG_MORE_TO_COME, commandBytes, sequences...)
+	if err != nil {
+		return err
+	}
+	defer message.Release()
+	return socket.send(ctx, message.Bytes())
+}
 
-	err = socket.send(input)
+// runQuery executes a marshalled command as a legacy OP_QUERY against the
+// $cmd collection.
+func (d *DB) runQuery(ctx context.Context, socket *Connection, commandBytes []byte, result interface{}) error {
+	commandBytes, err := d.withServerAPI(commandBytes)
+	if err != nil {
+		return err
+	}
+	commandBytes, err = withQueryReadPreference(socket, commandBytes)
 	if err != nil {
 		return err
 	}
+	namespace := d.name + ".$cmd"
+
+	requestID := d.mongo.nextID()
 
-	res, err := socket.receive()
+	limit := int32(-1)
+	skip := int32(0)
+	responseTo := int32(0)
+
+	flags := queryFlags(socket, 0)
+
+	message := startMessage(requestID, responseTo, OP_QUERY)
+	defer message.Release()
+	message.WriteInt32(flags)
+	message.WriteCString(namespace)
+	message.WriteInt32(skip)
+	message.WriteInt32(limit)
+	message.WriteBytes(commandBytes)
+	message.PatchLength(0)
+
+	res, err := socket.sendWithOpReply(ctx, message.Bytes())
 	if err != nil {
+		if isContextError(err) {
+			go d.mongo.killOperations(socket)
+		}
 		return err
 	}
+	if len(res.Document) == 0 {
+		return MongoError{
+			message: "Empty command reply",
+		}
+	}
 
 	resultBytes := res.Document[0]
 	return bson.Unmarshal(resultBytes, result)
 }
 
 func (d *DB) ExecuteCommand(command interface{}, result interface{}) error {
-	return d.run(d.mongo.conn, command, result)
+	return d.ExecuteCommandContext(context.Background(), command, result)
+}
+
+func (d *DB) ExecuteCommandContext(ctx context.Context, command interface{}, result interface{}) error {
+	return d.executeCommand(ctx, command, result)
+}
+
+func (d *DB) executeCommand(ctx context.Context, command interface{}, result interface{},
+	sequences ...MsgSection) error {
+	connection, err := d.mongo.checkout(ctx)
+	if err != nil {
+		return err
+	}
+	defer d.mongo.checkin(connection)
+	return d.run(ctx, connection, command, result, sequences...)
+}
+
+// withMaxTimeMS sends the time left before the context deadline along with
+// a command as maxTimeMS, so that the server gives up on the command when we
+// do. Commands that already have a maxTimeMS are left alone.
+func withMaxTimeMS(ctx context.Context, commandBytes []byte) ([]byte, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return commandBytes, nil
+	}
+	name := commandName(commandBytes)
+	if name == "getMore" || name == "killCursors" || hasElement(commandBytes, "maxTimeMS") {
+		return commandBytes, nil
+	}
+
+	remaining := deadline.Sub(time.Now())
+	if remaining <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+	maxTimeMS := int64(remaining / time.Millisecond)
+	if maxTimeMS == 0 {
+		maxTimeMS = 1
+	}
+	return appendElements(commandBytes, bson.D{{"maxTimeMS", maxTimeMS}})
+}
+
+// withServerAPI declares the client's stable API version on a command. The
+// version goes on every command, commitTransaction and abortTransaction
+// included, so that the server can check each command of a transaction
+// against the first. getMore is the exception: it runs under the version of
+// the command that opened the cursor. Commands that declare a version of
+// their own are left alone.
+func (d *DB) withServerAPI(commandBytes []byte) ([]byte, error) {
+	api := d.mongo.options.ServerAPI
+	if api == nil {
+		return commandBytes, nil
+	}
+	if commandName(commandBytes) == "getMore" || hasElement(commandBytes, "apiVersion") {
+		return commandBytes, nil
+	}
+	return appendElements(commandBytes, api.document())
 }
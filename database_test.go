@@ -0,0 +1,78 @@
+package gomongo_test
+
+import (
+	"bytes"
+	"github.com/dmliao/gomongo"
+	"github.com/dmliao/gomongo/wireserver"
+	"github.com/dmliao/gomongo/wiretest"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+// TestServerAPI records the commands sent with a stable API version, and
+// checks that every one of them declares it except getMore, which the
+// server takes the version of from the command that opened the cursor.
+func TestServerAPI(t *testing.T) {
+	f := newFakeServer(t)
+	recorder := &wiretest.Recorder{}
+	strict, deprecationErrors := true, false
+	m := f.connect(&gomongo.ClientOptions{
+		Dialer: recorder,
+		ServerAPI: &gomongo.ServerAPI{
+			Version:           gomongo.ServerAPIVersion1,
+			Strict:            &strict,
+			DeprecationErrors: &deprecationErrors,
+		},
+	})
+	c := m.GetDB("test").GetCollection("c")
+	_, err := c.Insert(bson.M{"a": 1}, bson.M{"a": 2}, bson.M{"a": 3}, bson.M{"a": 4}, bson.M{"a": 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := c.Find(nil, &gomongo.FindOpts{BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.M
+	for cursor.Next(&doc) == nil {
+	}
+	m.Close()
+
+	commands := make(map[string]int)
+	for _, conversation := range recorder.Fixture().Conversations {
+		for _, message := range conversation.Messages {
+			if message.From != wiretest.FromClient {
+				continue
+			}
+			request, err := wireserver.ReadRequest(bytes.NewReader(message.Data), wireserver.DefaultMaxMessageSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, ok := request.(*gomongo.OpMsg)
+			if !ok {
+				t.Errorf("sent a %T with a stable API version", request)
+				continue
+			}
+			var command bson.D
+			err = bson.Unmarshal(msg.Sections[0].Documents[0], &command)
+			if err != nil {
+				t.Fatal(err)
+			}
+			name := command[0].Name
+			commands[name]++
+			fields := command.Map()
+			if name == "getMore" {
+				if _, ok := fields["apiVersion"]; ok {
+					t.Errorf("getMore declares the API version: %v", command)
+				}
+				continue
+			}
+			if fields["apiVersion"] != "1" || fields["apiStrict"] != true || fields["apiDeprecationErrors"] != false {
+				t.Errorf("%v doesn't declare the API version: %v", name, command)
+			}
+		}
+	}
+	if commands["hello"] == 0 || commands["insert"] != 1 || commands["find"] != 1 || commands["getMore"] < 2 {
+		t.Errorf("sent %v", commands)
+	}
+}
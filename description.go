@@ -0,0 +1,182 @@
+package gomongo
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	driverName    = "gomongo"
+	driverVersion = "0.1.0"
+
+	// the range of wire versions the driver can talk to
+	minSupportedWireVersion int32 = 0
+	maxSupportedWireVersion int32 = 17
+
+	// limits assumed for servers that don't report them
+	defaultMaxBSONObjectSize   int32 = 16 * 1024 * 1024
+	defaultMaxMessageSizeBytes int32 = 48000000
+	defaultMaxWriteBatchSize   int32 = 1000
+)
+
+// ServerDescription is what a server reported about itself in the handshake,
+// or in the latest check of the server.
+type ServerDescription struct {
+	Address string `bson:"-"`
+	// UpdatedAt is when the description was recorded. It is zero for servers
+	// that haven't been checked yet.
+	UpdatedAt time.Time `bson:"-"`
+	// Kind is the role of the server, worked out from the rest of the
+	// description.
+	Kind ServerKind `bson:"-"`
+	// RTT is the average round trip time of the checks of the server.
+	RTT time.Duration `bson:"-"`
+	// Error is why the server couldn't be checked, for Unknown servers.
+	Error error `bson:"-"`
+
+	IsMaster bool `bson:"ismaster"`
+	// IsWritablePrimary is what hello calls IsMaster.
+	IsWritablePrimary bool `bson:"isWritablePrimary"`
+	Secondary         bool `bson:"secondary"`
+	ArbiterOnly       bool `bson:"arbiterOnly"`
+	Hidden            bool `bson:"hidden"`
+	// IsReplicaSet is set by members of a replica set that isn't initiated
+	// yet.
+	IsReplicaSet bool     `bson:"isreplicaset"`
+	SetName      string   `bson:"setName"`
+	Me           string   `bson:"me"`
+	Primary      string   `bson:"primary"`
+	Hosts        []string `bson:"hosts"`
+	Passives     []string `bson:"passives"`
+	Arbiters     []string `bson:"arbiters"`
+	// Tags are the replica set tags of the member.
+	Tags map[string]string `bson:"tags"`
+	// LastWrite is when the member last wrote to its oplog, which tells
+	// how far behind the primary a secondary is.
+	LastWrite struct {
+		Date time.Time `bson:"lastWriteDate"`
+	} `bson:"lastWrite"`
+	// SetVersion and ElectionID tell the primaries of successive elections
+	// apart. SetVersion is zero if the server didn't report one.
+	SetVersion int64         `bson:"setVersion"`
+	ElectionID bson.ObjectId `bson:"electionId,omitempty"`
+	// Msg is "isdbgrid" for mongos routers.
+	Msg string `bson:"msg"`
+
+	MinWireVersion      int32 `bson:"minWireVersion"`
+	MaxWireVersion      int32 `bson:"maxWireVersion"`
+	MaxBSONObjectSize   int32 `bson:"maxBsonObjectSize"`
+	MaxMessageSizeBytes int32 `bson:"maxMessageSizeBytes"`
+	MaxWriteBatchSize   int32 `bson:"maxWriteBatchSize"`
+	// LogicalSessionTimeoutMinutes is nil if the server doesn't support
+	// sessions.
+	LogicalSessionTimeoutMinutes *int32 `bson:"logicalSessionTimeoutMinutes"`
+	// SASLSupportedMechs lists the mechanisms the user from the connection
+	// string can authenticate with. It is only sent when there is one.
+	SASLSupportedMechs []string `bson:"saslSupportedMechs"`
+	Compression        []string `bson:"compression"`
+
+	ConnectionID int32 `bson:"connectionId"`
+	// ServiceID identifies the mongos behind a load balancer that the
+	// connection ended up on. It is only sent in load balanced mode.
+	ServiceID bson.ObjectId `bson:"serviceId,omitempty"`
+}
+
+// init records where the description came from, works out the kind of
+// server, and fills in the default limits for servers that leave them out.
+// Host names are compared case insensitively, so they are lowercased.
+func (d *ServerDescription) init(address string) {
+	d.Address = address
+	d.UpdatedAt = time.Now()
+	d.IsMaster = d.IsMaster || d.IsWritablePrimary
+	d.Me = strings.ToLower(d.Me)
+	d.Primary = strings.ToLower(d.Primary)
+	for _, hosts := range [][]string{d.Hosts, d.Passives, d.Arbiters} {
+		for i, host := range hosts {
+			hosts[i] = strings.ToLower(host)
+		}
+	}
+
+	switch {
+	case d.IsReplicaSet:
+		d.Kind = ServerRSGhost
+	case d.Msg == "isdbgrid":
+		d.Kind = ServerMongos
+	case d.SetName != "" && d.Hidden:
+		// hidden members say they are secondaries, but mustn't be read from
+		d.Kind = ServerRSOther
+	case d.SetName != "" && d.IsMaster:
+		d.Kind = ServerRSPrimary
+	case d.SetName != "" && d.Secondary:
+		d.Kind = ServerRSSecondary
+	case d.SetName != "" && d.ArbiterOnly:
+		d.Kind = ServerRSArbiter
+	case d.SetName != "":
+		d.Kind = ServerRSOther
+	default:
+		d.Kind = ServerStandalone
+	}
+
+	if d.MaxBSONObjectSize == 0 {
+		d.MaxBSONObjectSize = defaultMaxBSONObjectSize
+	}
+	if d.MaxMessageSizeBytes == 0 {
+		d.MaxMessageSizeBytes = defaultMaxMessageSizeBytes
+	}
+	if d.MaxWriteBatchSize == 0 {
+		d.MaxWriteBatchSize = defaultMaxWriteBatchSize
+	}
+}
+
+// compatible returns an error if the server's wire versions don't overlap
+// with the ones the driver supports.
+func (d *ServerDescription) compatible() error {
+	if d.MinWireVersion > maxSupportedWireVersion {
+		return fmt.Errorf("server at %v requires wire version %v, but this driver only supports up to %v",
+			d.Address, d.MinWireVersion, maxSupportedWireVersion)
+	}
+	if d.MaxWireVersion < minSupportedWireVersion {
+		return fmt.Errorf("server at %v reports wire version %v, but this driver requires at least %v",
+			d.Address, d.MaxWireVersion, minSupportedWireVersion)
+	}
+	return nil
+}
+
+// members returns every member of the replica set the server knows about.
+func (d *ServerDescription) members() []string {
+	members := make([]string, 0, len(d.Hosts)+len(d.Passives)+len(d.Arbiters))
+	members = append(members, d.Hosts...)
+	members = append(members, d.Passives...)
+	return append(members, d.Arbiters...)
+}
+
+// unknownDescription describes a server that hasn't been checked yet, or
+// whose check failed with err.
+func unknownDescription(address string, err error) *ServerDescription {
+	d := &ServerDescription{
+		Address: address,
+		Kind:    ServerUnknown,
+		Error:   err,
+	}
+	if err != nil {
+		d.UpdatedAt = time.Now()
+	}
+	return d
+}
+
+// clientMetadata returns the document that identifies the driver and the
+// application to the server in the handshake.
+func clientMetadata(appName string) bson.D {
+	metadata := bson.D{}
+	if appName != "" {
+		metadata = append(metadata, bson.DocElem{"application", bson.D{{"name", appName}}})
+	}
+	return append(metadata,
+		bson.DocElem{"driver", bson.D{{"name", driverName}, {"version", driverVersion}}},
+		bson.DocElem{"os", bson.D{{"type", runtime.GOOS}, {"architecture", runtime.GOARCH}}},
+		bson.DocElem{"platform", runtime.Version()},
+	)
+}
@@ -0,0 +1,222 @@
+package gomongo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const defaultProxyPort = 1080
+
+// SOCKS5 protocol constants, from RFC 1928 and RFC 1929
+const (
+	socks5Version          = 5
+	socks5AuthNone         = 0
+	socks5AuthPassword     = 2
+	socks5NoAcceptableAuth = 0xff
+	socks5PasswordVersion  = 1
+	socks5Connect          = 1
+	socks5AddressIPv4      = 1
+	socks5AddressDomain    = 3
+	socks5AddressIPv6      = 4
+)
+
+// replies to a SOCKS5 connect request, by code
+var socks5Errors = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// Dialer opens the network connections to servers, for example through a
+// tunnel or, in tests, to an in-memory server. *net.Dialer implements it.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// dialer returns the dialer that connections to servers are opened with:
+// the Dialer option, or a plain net.Dialer, behind the SOCKS5 proxy if there
+// is one.
+func (o *ClientOptions) dialer() Dialer {
+	var dialer Dialer = o.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	if o.ProxyHost == "" {
+		return dialer
+	}
+	port := o.ProxyPort
+	if port == 0 {
+		port = defaultProxyPort
+	}
+	return &socks5Dialer{
+		proxy:    net.JoinHostPort(o.ProxyHost, strconv.Itoa(port)),
+		username: o.ProxyUsername,
+		password: o.ProxyPassword,
+		forward:  dialer,
+	}
+}
+
+// socks5Dialer connects through a SOCKS5 proxy, which it reaches with the
+// forward dialer.
+type socks5Dialer struct {
+	proxy    string
+	username string
+	password string
+	forward  Dialer
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("socks5 proxy %v: unsupported network %v", d.proxy, network)
+	}
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxy)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	err = d.connect(conn, address)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 proxy %v: %v", d.proxy, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// connect runs the SOCKS5 handshake on a connection to the proxy, asking it
+// to connect to address.
+func (d *socks5Dialer) connect(conn net.Conn, address string) error {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 0xffff {
+		return fmt.Errorf("invalid port %v", portString)
+	}
+
+	methods := []byte{socks5AuthNone}
+	if d.username != "" {
+		methods = append(methods, socks5AuthPassword)
+	}
+	_, err = conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected version %v", reply[0])
+	}
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if d.username == "" {
+			return fmt.Errorf("proxy asked for a username and password")
+		}
+		err = d.authenticate(conn)
+		if err != nil {
+			return err
+		}
+	case socks5NoAcceptableAuth:
+		return fmt.Errorf("no acceptable authentication method")
+	default:
+		return fmt.Errorf("unexpected authentication method %v", reply[1])
+	}
+
+	request := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			request = append(request, socks5AddressIPv4)
+			request = append(request, ip4...)
+		} else {
+			request = append(request, socks5AddressIPv6)
+			request = append(request, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %v is too long", host)
+		}
+		request = append(request, socks5AddressDomain, byte(len(host)))
+		request = append(request, host...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	_, err = conn.Write(request)
+	if err != nil {
+		return err
+	}
+
+	// the reply ends with the address the proxy connected from, which
+	// isn't needed but has to be read past
+	header := make([]byte, 4)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unexpected version %v", header[0])
+	}
+	if header[1] != 0 {
+		message, ok := socks5Errors[header[1]]
+		if !ok {
+			message = "error " + strconv.Itoa(int(header[1]))
+		}
+		return fmt.Errorf("connecting to %v: %v", address, message)
+	}
+	var length int
+	switch header[3] {
+	case socks5AddressIPv4:
+		length = net.IPv4len
+	case socks5AddressIPv6:
+		length = net.IPv6len
+	case socks5AddressDomain:
+		size := make([]byte, 1)
+		_, err = io.ReadFull(conn, size)
+		if err != nil {
+			return err
+		}
+		length = int(size[0])
+	default:
+		return fmt.Errorf("unexpected address type %v", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, length+2))
+	return err
+}
+
+// authenticate sends the username and password to the proxy.
+func (d *socks5Dialer) authenticate(conn net.Conn) error {
+	request := []byte{socks5PasswordVersion, byte(len(d.username))}
+	request = append(request, d.username...)
+	request = append(request, byte(len(d.password)))
+	request = append(request, d.password...)
+	_, err := conn.Write(request)
+	if err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+	if reply[0] != socks5PasswordVersion {
+		return fmt.Errorf("unexpected authentication version %v", reply[0])
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("authentication failed")
+	}
+	return nil
+}
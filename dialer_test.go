@@ -0,0 +1,34 @@
+package gomongo
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestSOCKS5AuthenticateReply checks that a reply to the username and
+// password is only taken as success when it has the right version.
+func TestSOCKS5AuthenticateReply(t *testing.T) {
+	replies := map[[2]byte]string{
+		{1, 0}: "",
+		{1, 1}: "authentication failed",
+		{5, 0}: "unexpected authentication version",
+	}
+	for reply, message := range replies {
+		client, proxy := net.Pipe()
+		go func(reply [2]byte) {
+			defer proxy.Close()
+			// version, "u", "p"
+			io.ReadFull(proxy, make([]byte, 5))
+			proxy.Write(reply[:])
+		}(reply)
+
+		d := &socks5Dialer{username: "u", password: "p"}
+		err := d.authenticate(client)
+		client.Close()
+		if message == "" && err != nil || message != "" && (err == nil || !strings.Contains(err.Error(), message)) {
+			t.Errorf("authenticating with the reply %v: %v", reply, err)
+		}
+	}
+}
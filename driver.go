@@ -1,16 +1,88 @@
 package gomongo
 
 import (
+	"context"
+	"fmt"
 	"strings"
 )
 
-func Connect(address string) (Mongo, error) {
-	if strings.LastIndex(address, ":") <= strings.LastIndex(address, "]") {
-		address = address + ":27017"
+// Connect connects to the deployment described by a mongodb:// connection
+// string. A bare "host[:port]" is accepted as well.
+func Connect(uri string) (Mongo, error) {
+	return ConnectContext(context.Background(), uri)
+}
+
+// ConnectContext connects to a deployment, giving up when the context is
+// done.
+func ConnectContext(ctx context.Context, uri string) (Mongo, error) {
+	if !strings.Contains(uri, "://") {
+		uri = uriScheme + uri
+	}
+	options, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	return ConnectWithOptionsContext(ctx, options)
+}
+
+// ConnectWithOptions connects to the deployment described by the options.
+func ConnectWithOptions(options *ClientOptions) (Mongo, error) {
+	return ConnectWithOptionsContext(context.Background(), options)
+}
+
+// ConnectWithOptionsContext connects to the deployment described by the
+// options, giving up when the context is done.
+func ConnectWithOptionsContext(ctx context.Context, options *ClientOptions) (Mongo, error) {
+	if options == nil {
+		return nil, fmt.Errorf("no hosts to connect to")
+	}
+	err := options.validate()
+	if err != nil {
+		return nil, err
+	}
+	// connecting without the credentials would only fail later, on the
+	// first operation that needs them
+	if options.Auth != nil {
+		return nil, fmt.Errorf("authentication is not supported, connect without credentials")
+	}
+
+	tlsConfig, err := options.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if options.SRVHost != "" {
+		options, err = resolveSRV(ctx, options)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	m := MongoDB{
-		servers: make(map[string]*Connection),
+		servers:   make(map[string]*server),
+		options:   options,
+		tlsConfig: tlsConfig,
+		changed:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	// host names are compared case insensitively with those the servers
+	// report
+	seeds := make([]string, len(options.Hosts))
+	for i, host := range options.Hosts {
+		address, err := parseHost(host)
+		if err != nil {
+			return nil, err
+		}
+		seeds[i] = strings.ToLower(address)
+	}
+	err = m.connect(ctx, seeds)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	if options.SRVHost != "" && (m.Topology() == TopologyUnknown || m.Topology() == TopologySharded) {
+		go m.pollSRV()
 	}
-	return &m, m.connect(address)
+	return &m, nil
 }
@@ -1,5 +1,10 @@
 package gomongo
 
+import (
+	"fmt"
+	"time"
+)
+
 type MongoError struct {
 	message string
 	code    int32
@@ -11,9 +16,9 @@ func (m MongoError) Error() string {
 }
 
 type WriteError struct {
-	Index  int32
-	Code   int32
-	ErrMsg string
+	Index  int32  `bson:"index"`
+	Code   int32  `bson:"code"`
+	ErrMsg string `bson:"errmsg"`
 }
 
 type WriteErrors struct {
@@ -21,14 +26,63 @@ type WriteErrors struct {
 }
 
 func (i WriteErrors) Error() string {
-	return "Insert write errors!"
+	if len(i.Errors) == 0 {
+		return "Write errors"
+	}
+	first := i.Errors[0]
+	return fmt.Sprintf("%v write errors, the first at index %v: %v", len(i.Errors), first.Index, first.ErrMsg)
 }
 
 type WriteConcernError struct {
-	Code   int32
-	ErrMsg string
+	Code   int32  `bson:"code"`
+	ErrMsg string `bson:"errmsg"`
 }
 
 func (w WriteConcernError) Error() string {
 	return "Write concern error with message: " + w.ErrMsg
 }
+
+// UnexpectedReplyError is returned when the server sends a reply that does
+// not answer any request in flight on the connection, such as a late reply to
+// an abandoned request. The connection can't be used after this.
+type UnexpectedReplyError struct {
+	RequestID  int32
+	ResponseTo int32
+}
+
+func (u UnexpectedReplyError) Error() string {
+	return fmt.Sprintf("unexpected reply %v to request %v", u.RequestID, u.ResponseTo)
+}
+
+// WaitQueueTimeoutError is returned when an operation waited too long for a
+// connection from a pool that was at its maximum size.
+type WaitQueueTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (w WaitQueueTimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %v waiting for a connection", w.Timeout)
+}
+
+// FramingError is returned when a message read off a connection is malformed,
+// such as one whose length is out of range or whose contents don't add up to
+// its length. The connection can't be used after this.
+type FramingError struct {
+	Reason string
+}
+
+func (f FramingError) Error() string {
+	return "malformed message: " + f.Reason
+}
+
+// framingError reports an error from parsing a message that was read in full
+// as a FramingError. Running out of bytes there means the message is
+// inconsistent, not that the connection was cut.
+func framingError(err error) error {
+	if _, ok := err.(FramingError); ok {
+		return err
+	}
+	return FramingError{
+		Reason: err.Error(),
+	}
+}
@@ -0,0 +1,79 @@
+package gomongo
+
+import (
+	"context"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// getMoreExhaust fetches the next batch of an exhaust cursor on its own
+// connection. The first getMore allows the server to stream the rest of the
+// batches, which are then read one by one as they arrive. The connection
+// goes back to the pool with the last batch.
+func (c *cursorObj) getMoreExhaust(ctx context.Context) error {
+	var reply Reply
+	var err error
+	if c.moreToCome {
+		reply, err = c.connection.receiveMoreToCome(ctx, c.lastRequestID)
+	} else {
+		reply, err = c.startExhaust(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch r := reply.(type) {
+	case *OpResponse:
+		err = receiveFindResponse(r, c)
+		c.moreToCome = c.cursorID != 0
+	case *OpMsg:
+		var result cursorReply
+		err = bson.Unmarshal(r.Sections[0].Documents[0], &result)
+		if err == nil && result.Ok != 1 {
+			err = result.error()
+		}
+		if err == nil {
+			receiveCursorReply(&result, c)
+		}
+		c.moreToCome = r.FlagBits&MSG_MORE_TO_COME != 0
+	}
+	c.lastRequestID = reply.MessageHeader().RequestID
+	if err != nil {
+		return err
+	}
+
+	if c.cursorID == 0 {
+		c.release()
+	}
+	return nil
+}
+
+// startExhaust sends the getMore that lets the server stream the remaining
+// batches of the cursor.
+func (c *cursorObj) startExhaust(ctx context.Context) (Reply, error) {
+	getMoreCommand, err := bson.Marshal(bson.D{
+		{"getMore", c.cursorID},
+		{"collection", collectionName(c.Namespace())},
+		{"batchSize", c.batchSize},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.collection.database.runMsg(ctx, c.connection, MSG_EXHAUST_ALLOWED, getMoreCommand)
+}
+
+// release gives the connection of a pinned cursor back to its pool. A
+// connection that the server is still streaming batches on can't be reused,
+// so it is closed instead.
+func (c *cursorObj) release() {
+	if c.connection == nil {
+		return
+	}
+	if c.moreToCome {
+		c.connection.fatal(MongoError{
+			message: "Exhaust cursor closed before its last batch",
+		})
+		c.moreToCome = false
+	}
+	c.collection.database.mongo.checkin(c.connection)
+	c.connection = nil
+}
@@ -0,0 +1,49 @@
+package gomongo_test
+
+import (
+	"github.com/dmliao/gomongo"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+// TestExhaustWithoutOpMsg checks that exhaust cursors on servers with the
+// find command but without OP_MSG get their batches with ordinary getMores,
+// since those servers can't stream the batches of the find command.
+func TestExhaustWithoutOpMsg(t *testing.T) {
+	f := newFakeServer(t)
+	f.hello["maxWireVersion"] = 5
+	m := f.connect(nil)
+	c := m.GetDB("test").GetCollection("c")
+	for i := 0; i < 10; i++ {
+		_, err := c.Insert(bson.M{"i": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cursor, err := c.Find(nil, &gomongo.FindOpts{BatchSize: 3, Exhaust: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := 0
+	var doc bson.M
+	for cursor.HasNext() {
+		err = cursor.Next(&doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read++
+	}
+	if err := cursor.Error(); err != nil && read != 10 {
+		t.Fatal(err)
+	}
+	if read != 10 {
+		t.Errorf("read %v documents instead of 10", read)
+	}
+	if getMores := f.commandCount("getMore"); getMores != 3 {
+		t.Errorf("%v getMores instead of 3", getMores)
+	}
+	if stats := m.Stats()[f.address()]; stats.InUse != 0 {
+		t.Errorf("%v connections still in use", stats.InUse)
+	}
+}
@@ -0,0 +1,333 @@
+package gomongo_test
+
+import (
+	"github.com/dmliao/gomongo"
+	"github.com/dmliao/gomongo/wireserver"
+	"gopkg.in/mgo.v2/bson"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeServer is a standalone server that keeps the documents inserted into
+// it and serves them back through cursors. It checks that every request on a
+// connection has a request ID of its own, since replies are matched to
+// requests by it.
+type fakeServer struct {
+	t        testing.TB
+	server   *wireserver.Server
+	listener net.Listener
+	// hello is the reply to the handshake and to the checks of the monitor
+	hello bson.M
+	// pinCursors makes cursors known only on the connection that opened
+	// them, as they are behind a load balancer, where each connection may
+	// be to another mongos
+	pinCursors bool
+	// compressors are the compressors the server supports, which it picks
+	// from the ones a handshake offers
+	compressors []string
+
+	mu           sync.Mutex
+	docs         map[string][]bson.Raw
+	cursors      map[int64]*fakeCursor
+	nextCursorID int64
+	requestIDs   map[*wireserver.Conn]map[int32]bool
+	commands     []string
+	// insertBatches are the numbers of documents sent with each insert
+	insertBatches []int
+}
+
+// fakeCursor is a cursor opened on the fake server, with the documents it
+// hasn't returned yet.
+type fakeCursor struct {
+	namespace string
+	docs      []bson.Raw
+	conn      *wireserver.Conn
+}
+
+func newFakeServer(t testing.TB) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveFake(t, listener)
+}
+
+// serveFake starts a fake server on the listener, which is closed at the
+// end of the test.
+func serveFake(t testing.TB, listener net.Listener) *fakeServer {
+	f := &fakeServer{
+		t:        t,
+		listener: listener,
+		hello: bson.M{
+			"ismaster":       true,
+			"maxWireVersion": 13,
+			"ok":             1,
+		},
+		docs:       make(map[string][]bson.Raw),
+		cursors:    make(map[int64]*fakeCursor),
+		requestIDs: make(map[*wireserver.Conn]map[int32]bool),
+	}
+	f.server = &wireserver.Server{
+		Handler: f,
+	}
+	go f.server.Serve(listener)
+	t.Cleanup(func() {
+		f.server.Close()
+	})
+	return f
+}
+
+func (f *fakeServer) address() string {
+	return f.listener.Addr().String()
+}
+
+// connect connects a client to the fake server, which is closed at the end
+// of the test.
+func (f *fakeServer) connect(options *gomongo.ClientOptions) gomongo.Mongo {
+	if options == nil {
+		options = &gomongo.ClientOptions{}
+	}
+	options.Hosts = []string{f.address()}
+	m, err := gomongo.ConnectWithOptions(options)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.t.Cleanup(func() {
+		m.Close()
+	})
+	return m
+}
+
+// openCursors returns the number of cursors that are neither exhausted nor
+// killed.
+func (f *fakeServer) openCursors() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.cursors)
+}
+
+func (f *fakeServer) wireVersion() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return toInt(f.hello["maxWireVersion"])
+}
+
+// commandCount returns how many times the command was run.
+func (f *fakeServer) commandCount(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := 0
+	for _, command := range f.commands {
+		if command == name {
+			count++
+		}
+	}
+	return count
+}
+
+// insertSizes returns the number of documents sent with each insert so far.
+func (f *fakeServer) insertSizes() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int(nil), f.insertBatches...)
+}
+
+func (f *fakeServer) Handle(conn *wireserver.Conn, request wireserver.Request) error {
+	f.checkRequestID(conn, request.MessageHeader().RequestID)
+
+	var command bson.D
+	var sequences []gomongo.MsgSection
+	switch r := request.(type) {
+	case *gomongo.OpQuery:
+		if !strings.HasSuffix(r.FullCollectionName, ".$cmd") {
+			f.t.Errorf("unexpected query on %v", r.FullCollectionName)
+			return conn.Respond(request, bson.M{"$err": "not a command", "code": 2})
+		}
+		err := r.Query.(bson.Raw).Unmarshal(&command)
+		if err != nil {
+			return err
+		}
+		database := strings.TrimSuffix(r.FullCollectionName, ".$cmd")
+		command = append(command, bson.DocElem{"$db", database})
+	case *gomongo.OpMsg:
+		if f.wireVersion() < 6 {
+			f.t.Errorf("OP_MSG sent to a server with wire version %v", f.wireVersion())
+		}
+		err := bson.Unmarshal(r.Sections[0].Documents[0], &command)
+		if err != nil {
+			return err
+		}
+		sequences = r.Sections[1:]
+	default:
+		f.t.Errorf("unexpected request %T", request)
+		return nil
+	}
+	return conn.Respond(request, f.run(conn, command, sequences))
+}
+
+func (f *fakeServer) HandleClose(conn *wireserver.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.requestIDs, conn)
+}
+
+// checkRequestID fails the test if a request reuses the ID of an earlier
+// request on the same connection.
+func (f *fakeServer) checkRequestID(conn *wireserver.Conn, requestID int32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := f.requestIDs[conn]
+	if ids == nil {
+		ids = make(map[int32]bool)
+		f.requestIDs[conn] = ids
+	}
+	if ids[requestID] {
+		f.t.Errorf("request ID %v reused on connection from %v", requestID, conn.RemoteAddr())
+	}
+	ids[requestID] = true
+}
+
+// run runs a command, with the documents of an OP_MSG's document sequences
+// or of the command's own array.
+func (f *fakeServer) run(conn *wireserver.Conn, command bson.D, sequences []gomongo.MsgSection) bson.M {
+	name := command[0].Name
+	database := ""
+	fields := make(map[string]interface{})
+	for _, element := range command {
+		fields[element.Name] = element.Value
+		if element.Name == "$db" {
+			database = element.Value.(string)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, name)
+
+	switch name {
+	case "isMaster", "ismaster", "hello":
+		offered, _ := fields["compression"].([]interface{})
+		if len(offered) == 0 || len(f.compressors) == 0 {
+			return f.hello
+		}
+		reply := bson.M{}
+		for key, value := range f.hello {
+			reply[key] = value
+		}
+		var compression []string
+		for _, name := range offered {
+			for _, supported := range f.compressors {
+				if name == supported {
+					compression = append(compression, supported)
+				}
+			}
+		}
+		reply["compression"] = compression
+		return reply
+	case "insert":
+		namespace := database + "." + command[0].Value.(string)
+		var docs []bson.Raw
+		for _, sequence := range sequences {
+			for _, doc := range sequence.Documents {
+				docs = append(docs, bson.Raw{Kind: 0x03, Data: doc})
+			}
+		}
+		if array, ok := fields["documents"].([]interface{}); ok {
+			for _, doc := range array {
+				data, _ := bson.Marshal(doc)
+				docs = append(docs, bson.Raw{Kind: 0x03, Data: data})
+			}
+		}
+		f.insertBatches = append(f.insertBatches, len(docs))
+		// inserts are ordered, so they stop at the first document that is
+		// marked to fail
+		for i, doc := range docs {
+			var fields bson.M
+			doc.Unmarshal(&fields)
+			if fields["fail"] == true {
+				f.docs[namespace] = append(f.docs[namespace], docs[:i]...)
+				return bson.M{"ok": 1, "n": i, "writeErrors": []bson.M{{
+					"index":  i,
+					"code":   11000,
+					"errmsg": "duplicate key",
+				}}}
+			}
+		}
+		f.docs[namespace] = append(f.docs[namespace], docs...)
+		return bson.M{"ok": 1, "n": len(docs)}
+	case "find":
+		namespace := database + "." + command[0].Value.(string)
+		docs := append([]bson.Raw{}, f.docs[namespace]...)
+		batch, id := f.batch(conn, namespace, docs, toInt(fields["batchSize"]), 0)
+		return bson.M{"ok": 1, "cursor": bson.M{"id": id, "ns": namespace, "firstBatch": batch}}
+	case "getMore":
+		id := command[0].Value.(int64)
+		cursor := f.cursor(conn, id)
+		if cursor == nil {
+			return bson.M{"ok": 0, "code": 43, "errmsg": "cursor id not found"}
+		}
+		delete(f.cursors, id)
+		batch, id := f.batch(conn, cursor.namespace, cursor.docs, toInt(fields["batchSize"]), id)
+		return bson.M{"ok": 1, "cursor": bson.M{"id": id, "ns": cursor.namespace, "nextBatch": batch}}
+	case "killCursors":
+		var killed []int64
+		for _, id := range fields["cursors"].([]interface{}) {
+			if f.cursor(conn, id.(int64)) != nil {
+				delete(f.cursors, id.(int64))
+				killed = append(killed, id.(int64))
+			}
+		}
+		return bson.M{"ok": 1, "cursorsKilled": killed}
+	}
+	return bson.M{"ok": 1}
+}
+
+// batch returns the first batch of docs, and keeps the rest in the cursor
+// with the given ID, or in a new one if the ID is zero. It returns the ID of
+// the cursor, which is zero once there is nothing left. The caller must hold
+// the lock.
+func (f *fakeServer) batch(conn *wireserver.Conn, namespace string, docs []bson.Raw, batchSize int,
+	id int64) ([]bson.Raw, int64) {
+	if batchSize <= 0 || batchSize > len(docs) {
+		batchSize = len(docs)
+	}
+	if batchSize == len(docs) {
+		return docs, 0
+	}
+	if id == 0 {
+		f.nextCursorID++
+		id = f.nextCursorID
+	}
+	f.cursors[id] = &fakeCursor{
+		namespace: namespace,
+		docs:      docs[batchSize:],
+		conn:      conn,
+	}
+	return docs[:batchSize], id
+}
+
+// cursor returns the open cursor with the ID, if the connection can see it.
+// The caller must hold the lock.
+func (f *fakeServer) cursor(conn *wireserver.Conn, id int64) *fakeCursor {
+	cursor := f.cursors[id]
+	if cursor != nil && f.pinCursors && cursor.conn != conn {
+		return nil
+	}
+	return cursor
+}
+
+func toInt(v interface{}) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return 0
+}
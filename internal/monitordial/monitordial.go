@@ -0,0 +1,22 @@
+// Package monitordial marks the dials a server's monitor makes, so that the
+// wiretest recorder can tell its connections from the pool's without the
+// driver exporting the difference.
+package monitordial
+
+import (
+	"context"
+)
+
+type key struct{}
+
+// Mark returns a context for dialing the connection a monitor checks its
+// server on.
+func Mark(ctx context.Context) context.Context {
+	return context.WithValue(ctx, key{}, true)
+}
+
+// Is reports whether a dial is for a monitor's connection.
+func Is(ctx context.Context) bool {
+	monitor, _ := ctx.Value(key{}).(bool)
+	return monitor
+}
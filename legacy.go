@@ -0,0 +1,131 @@
+package gomongo
+
+import (
+	"context"
+	"github.com/dmliao/gomongo/convert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// findLegacy runs a query with OP_QUERY, for servers that do not support the
+// find command.
+func (c *C) findLegacy(ctx context.Context, connection *Connection, query interface{},
+	options *FindOpts) (*cursorObj, error) {
+	namespace := c.database.GetName() + "." + c.name
+	requestID := c.database.mongo.nextID()
+
+	limit, skip, batchSize, flags := cursorOptions(options)
+	responseTo := int32(0)
+
+	// sorted queries need to be wrapped in a $query document
+	if options != nil && options.Sort != nil {
+		query = bson.D{{"$query", query}, {"$orderby", options.Sort}}
+	}
+
+	queryBytes, err := bson.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	queryBytes, err = withQueryReadPreference(connection, queryBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	message := startMessage(requestID, responseTo, OP_QUERY)
+	defer message.Release()
+	message.WriteInt32(queryFlags(connection, flags))
+	message.WriteCString(namespace)
+	message.WriteInt32(skip)
+	message.WriteInt32(batchSize)
+	message.WriteBytes(queryBytes)
+
+	if options != nil {
+		if options.Projection != nil {
+			projectionBytes, err := bson.Marshal(options.Projection)
+			if err != nil {
+				return nil, err
+			}
+			message.WriteBytes(projectionBytes)
+		}
+	}
+	message.PatchLength(0)
+
+	res, err := connection.sendWithOpReply(ctx, message.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	cursor := cursorObj{
+		collection: c,
+		requestID:  requestID,
+		namespace:  namespace,
+		limit:      limit,
+		batchSize:  batchSize,
+		flags:      flags,
+	}
+
+	err = receiveFindResponse(res, &cursor)
+	if err != nil {
+		return nil, err
+	}
+	// with the exhaust flag, the server keeps sending replies until the
+	// cursor is exhausted
+	if convert.ReadBit32LE(flags, 6) {
+		cursor.moreToCome = cursor.cursorID != 0
+		cursor.lastRequestID = res.Header.RequestID
+	}
+
+	c.addCursor(&cursor)
+
+	return &cursor, nil
+}
+
+// getMoreLegacy fetches the next batch of a cursor with OP_GET_MORE.
+func (c *C) getMoreLegacy(ctx context.Context, connection *Connection, cursor Cursor) (Cursor, error) {
+	requestID := c.database.mongo.nextID()
+	responseTo := int32(0)
+
+	numberToReturn := cursor.BatchSize()
+	message := startMessage(requestID, responseTo, OP_GET_MORE)
+	defer message.Release()
+	message.WriteInt32(0)
+	message.WriteCString(cursor.Namespace())
+	message.WriteInt32(numberToReturn)
+	message.WriteInt64(cursor.ID())
+	message.PatchLength(0)
+
+	res, err := connection.sendWithOpReply(ctx, message.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	cObj := c.cursorObjFor(cursor, requestID)
+	err = receiveFindResponse(res, cObj)
+	if err != nil {
+		return nil, err
+	}
+	return cObj, nil
+}
+
+// killCursorsLegacy kills cursors with OP_KILL_CURSORS.
+func (c *C) killCursorsLegacy(ctx context.Context, connection *Connection, cursors ...Cursor) error {
+	requestID := c.database.mongo.nextID()
+	responseTo := int32(0)
+	message := startMessage(requestID, responseTo, OP_KILL_CURSORS)
+	defer message.Release()
+	message.WriteInt32(0)
+	message.WriteInt32(int32(len(cursors)))
+	for _, cursor := range cursors {
+		message.WriteInt64(cursor.ID())
+	}
+	message.PatchLength(0)
+
+	err := connection.send(ctx, message.Bytes())
+	if err != nil {
+		return err
+	}
+	for _, cursor := range cursors {
+		c.removeCursor(cursor.ID())
+	}
+
+	return nil
+}
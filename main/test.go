@@ -35,9 +35,9 @@ func main() {
 
 	c := mongo.GetDB("test").GetCollection("driver")
 
-	err = c.Insert(bson.M{"price": 5})
-	err = c.Update(bson.M{"price": 5}, bson.M{"price": 15}, nil)
-	err = c.Remove(bson.M{"price": 15}, nil)
+	_, err = c.Insert(bson.M{"price": 5})
+	_, err = c.Update(bson.M{"price": 5}, bson.M{"price": 15}, nil)
+	_, err = c.Remove(bson.M{"price": 15}, nil)
 	cursor2, err := c.Find(bson.M{}, nil)
 	for cursor2.HasNext() {
 		err = cursor2.Next(&result)
@@ -0,0 +1,220 @@
+package gomongo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/dmliao/gomongo/buffer"
+	"gopkg.in/mgo.v2/bson"
+	"hash/crc32"
+)
+
+// OP_MSG flag bits
+const (
+	MSG_CHECKSUM_PRESENT uint32 = 1 << 0
+	MSG_MORE_TO_COME     uint32 = 1 << 1
+	MSG_EXHAUST_ALLOWED  uint32 = 1 << 16
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// startMessage begins a message in a pooled writer with the standard
+// header. Its length is filled in by finishing it with PatchLength(0), and
+// the writer must be released once the message has been sent.
+func startMessage(requestID int32, responseTo int32, opCode int32) *buffer.MessageWriter {
+	w := buffer.NewMessageWriter()
+	w.ReserveInt32()
+	w.WriteInt32(requestID)
+	w.WriteInt32(responseTo)
+	w.WriteInt32(opCode)
+	return w
+}
+
+// EncodeMsg builds an OP_MSG with the flags and sections of msg, answering
+// the message with ID responseTo, or none if it is zero. If the checksum flag
+// is set, a CRC-32C of the message is appended. The writer must be released
+// once the message has been sent.
+func EncodeMsg(requestID int32, responseTo int32, msg *OpMsg) *buffer.MessageWriter {
+	w := startMessage(requestID, responseTo, OP_MSG)
+	w.WriteUint32(msg.FlagBits)
+	for _, section := range msg.Sections {
+		writeSection(w, section)
+	}
+	return finishMsg(w, msg.FlagBits)
+}
+
+// encodeMsg builds a request the same way as EncodeMsg, with a kind 0 body
+// section followed by a kind 1 section for each of the document sequences.
+// It saves putting the sections together in an OpMsg for every command.
+func encodeMsg(requestID int32, flags uint32, body []byte, sequences ...MsgSection) *buffer.MessageWriter {
+	w := startMessage(requestID, 0, OP_MSG)
+	w.WriteUint32(flags)
+	w.WriteUint8(0)
+	w.WriteBytes(body)
+	for _, sequence := range sequences {
+		writeSection(w, sequence)
+	}
+	return finishMsg(w, flags)
+}
+
+// writeSection adds a section to an OP_MSG: the documents of a kind 0
+// section as they are, and a kind 1 section with its size and identifier.
+func writeSection(w *buffer.MessageWriter, section MsgSection) {
+	w.WriteUint8(section.Kind)
+	if section.Kind == 0 {
+		for _, doc := range section.Documents {
+			w.WriteBytes(doc)
+		}
+		return
+	}
+	size := w.ReserveInt32()
+	w.WriteCString(section.Identifier)
+	for _, doc := range section.Documents {
+		w.WriteBytes(doc)
+	}
+	w.PatchLength(size)
+}
+
+// finishMsg fills in the length of an OP_MSG, and appends the checksum if
+// the flags ask for one.
+func finishMsg(w *buffer.MessageWriter, flags uint32) *buffer.MessageWriter {
+	if flags&MSG_CHECKSUM_PRESENT != 0 {
+		// the checksum covers the length, which already counts it
+		w.PatchInt32(0, int32(w.Len()+4))
+		w.WriteUint32(crc32.Checksum(w.Bytes(), castagnoli))
+	} else {
+		w.PatchLength(0)
+	}
+	return w
+}
+
+// DecodeMsg parses the contents of an OP_MSG following the message header,
+// for requests and replies alike. The header bytes are needed to verify the
+// checksum, if there is one.
+func DecodeMsg(header MsgHeader, headerBytes []byte, contents []byte) (*OpMsg, error) {
+	if len(contents) < 4 {
+		return nil, fmt.Errorf("OP_MSG too short: %v bytes", len(contents))
+	}
+	msg := &OpMsg{
+		Header:   header,
+		FlagBits: binary.LittleEndian.Uint32(contents),
+	}
+
+	sections := contents[4:]
+	if msg.FlagBits&MSG_CHECKSUM_PRESENT != 0 {
+		if len(sections) < 4 {
+			return nil, fmt.Errorf("OP_MSG checksum missing")
+		}
+		msg.Checksum = binary.LittleEndian.Uint32(sections[len(sections)-4:])
+		sections = sections[:len(sections)-4]
+
+		checksum := crc32.Update(crc32.Checksum(headerBytes, castagnoli), castagnoli,
+			contents[:len(contents)-4])
+		if checksum != msg.Checksum {
+			return nil, fmt.Errorf("OP_MSG checksum mismatch: got %v, expected %v", checksum, msg.Checksum)
+		}
+	}
+
+	reader := bytes.NewReader(sections)
+	for reader.Len() > 0 {
+		kind, _ := reader.ReadByte()
+		section := MsgSection{
+			Kind: kind,
+		}
+		switch kind {
+		case 0:
+			_, doc, err := buffer.ReadDocumentRaw(reader)
+			if err != nil {
+				return nil, err
+			}
+			section.Documents = [][]byte{doc}
+		case 1:
+			size, err := buffer.ReadInt32LE(reader)
+			if err != nil {
+				return nil, err
+			}
+			n, identifier, err := buffer.ReadNullTerminatedString(reader, size-4)
+			if err != nil {
+				return nil, err
+			}
+			section.Identifier = identifier
+			remaining := size - 4 - n
+			for remaining > 0 {
+				docSize, doc, err := buffer.ReadDocumentRaw(reader)
+				if err != nil {
+					return nil, err
+				}
+				section.Documents = append(section.Documents, doc)
+				remaining -= docSize
+			}
+			if remaining < 0 {
+				return nil, fmt.Errorf("OP_MSG document sequence %v overruns its size", identifier)
+			}
+		default:
+			return nil, fmt.Errorf("unknown OP_MSG section kind %v", kind)
+		}
+		msg.Sections = append(msg.Sections, section)
+	}
+	if len(msg.Sections) == 0 || msg.Sections[0].Kind != 0 {
+		return nil, fmt.Errorf("OP_MSG has no body section")
+	}
+	return msg, nil
+}
+
+// appendElements adds the elements to the end of a marshalled BSON document,
+// and returns the new document.
+func appendElements(doc []byte, elements bson.D) ([]byte, error) {
+	if len(doc) < 5 {
+		return nil, fmt.Errorf("invalid BSON document")
+	}
+	elementBytes, err := bson.Marshal(elements)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]byte, 0, len(doc)+len(elementBytes)-5)
+	result = append(result, doc[:len(doc)-1]...)
+	result = append(result, elementBytes[4:]...)
+	binary.LittleEndian.PutUint32(result, uint32(len(result)))
+	return result, nil
+}
+
+// marshalDocuments marshals each of the documents into BSON.
+func marshalDocuments(docs []interface{}) ([][]byte, error) {
+	result := make([][]byte, len(docs))
+	for i, doc := range docs {
+		docBytes, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = docBytes
+	}
+	return result, nil
+}
+
+// commandName returns the name of the command in a marshalled command
+// document, which is the name of its first element.
+func commandName(doc []byte) string {
+	if len(doc) < 6 {
+		return ""
+	}
+	end := bytes.IndexByte(doc[5:], 0)
+	if end < 0 {
+		return ""
+	}
+	return string(doc[5 : 5+end])
+}
+
+// hasElement returns whether a marshalled document has a top level element
+// with the given name.
+func hasElement(doc []byte, name string) bool {
+	var raw bson.RawD
+	if bson.Unmarshal(doc, &raw) != nil {
+		return false
+	}
+	for _, element := range raw {
+		if element.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package gomongo
+
+import (
+	"bytes"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"testing"
+)
+
+// TestMsgRoundTrip encodes OP_MSGs with EncodeMsg and reads them back with
+// ReadMessage, plain and compressed, with and without a checksum.
+func TestMsgRoundTrip(t *testing.T) {
+	body, _ := bson.Marshal(bson.M{"insert": "c", "$db": "test"})
+	doc, _ := bson.Marshal(bson.M{"a": 1})
+	msg := &OpMsg{
+		Sections: []MsgSection{
+			{Kind: 0, Documents: [][]byte{body}},
+			{Kind: 1, Identifier: "documents", Documents: [][]byte{doc, doc}},
+		},
+	}
+
+	for _, flags := range []uint32{0, MSG_CHECKSUM_PRESENT} {
+		for _, c := range []compressor{nil, snappyCompressor{}} {
+			msg.FlagBits = flags
+			w := EncodeMsg(7, 3, msg)
+			data := append([]byte(nil), w.Bytes()...)
+			w.Release()
+			if c != nil {
+				var err error
+				data, err = compressMessage(data, c)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			message, err := ReadMessage(bytes.NewReader(data), defaultMaxMessageSizeBytes)
+			if err != nil {
+				t.Fatalf("flags %v, compressed %v: %v", flags, c != nil, err)
+			}
+			if message.WireLength != int32(len(data)) || message.Header.RequestID != 7 ||
+				message.Header.ResponseTo != 3 || message.Header.OpCode != OP_MSG {
+				t.Errorf("flags %v, compressed %v: read %+v", flags, c != nil, message.Header)
+			}
+			decoded, err := DecodeMsg(message.Header, message.HeaderBytes, message.Contents)
+			if err != nil {
+				t.Fatalf("flags %v, compressed %v: %v", flags, c != nil, err)
+			}
+			if decoded.FlagBits != flags || !reflect.DeepEqual(decoded.Sections, msg.Sections) {
+				t.Errorf("flags %v, compressed %v: decoded %+v", flags, c != nil, decoded)
+			}
+		}
+	}
+
+	_, err := ReadMessage(bytes.NewReader([]byte{1, 0, 0, 0}), defaultMaxMessageSizeBytes)
+	if err == nil {
+		t.Error("read a truncated header")
+	}
+	_, err = ReadMessage(bytes.NewReader(make([]byte, 16)), defaultMaxMessageSizeBytes)
+	if _, ok := err.(FramingError); !ok {
+		t.Errorf("read a message of length 0: %v", err)
+	}
+}
@@ -1,81 +1,454 @@
 package gomongo
 
 import (
-	"github.com/dmliao/gomongo/convert"
+	"context"
+	"crypto/tls"
 	"gopkg.in/mgo.v2/bson"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// how long to spend killing the server side of an abandoned operation or of
+// a cursor that is closed
+const killOperationsTimeout = 10 * time.Second
+
 type Mongo interface {
 	GetDB(string) Database
 	//GetDBNameList() []string
 
+	// Servers returns the latest description of each server.
+	Servers() map[string]ServerDescription
+
+	// Topology returns the kind of deployment the client is connected to.
+	Topology() TopologyKind
+
+	// Stats returns the connection pool statistics of each server.
+	Stats() map[string]PoolStats
+
 	Close() error
 	Error() error
 }
 
 type MongoDB struct {
-	conn      *Connection
-	servers   map[string]*Connection
-	master    *Connection
+	options   *ClientOptions
+	tlsConfig *tls.Config
 	requestID int32
 	err       error
+
+	// mu guards the topology and the servers that are monitored, one for
+	// each server of the topology
+	mu       sync.Mutex
+	topology *topology
+	servers  map[string]*server
+	// changed is closed and replaced whenever the topology changes, to wake
+	// up the operations waiting for a server
+	changed chan struct{}
+	closed  bool
+	done    chan struct{}
 }
 
-func (m *MongoDB) connectToSeed(seed string) error {
-	connection := &Connection{
-		address: seed,
+// handshake runs isMaster on a new connection, identifying the driver to
+// the server, and records what the server supports on it.
+func (m *MongoDB) handshake(ctx context.Context, connection *Connection) error {
+	isMaster := m.heartbeatCommand()
+	isMaster = append(isMaster, bson.DocElem{"client", clientMetadata(m.options.AppName)})
+	if compressors := m.options.compressors(); len(compressors) > 0 {
+		isMaster = append(isMaster, bson.DocElem{"compression", compressors})
+	}
+	if m.options.loadBalanced() {
+		isMaster = append(isMaster, bson.DocElem{"loadBalanced", true})
+	}
+	// ask which mechanisms the user can authenticate with, so that one can
+	// be picked without another round trip
+	if auth := m.options.Auth; auth != nil && auth.Username != "" {
+		isMaster = append(isMaster, bson.DocElem{"saslSupportedMechs", m.options.authSource() + "." + auth.Username})
+	}
+	// the handshake uses OP_QUERY, since we don't know yet whether the
+	// server supports OP_MSG. Servers with the stable API all do, and expect
+	// hello over OP_MSG from clients that declare an API version.
+	description, err := m.isMaster(ctx, connection, isMaster, m.options.ServerAPI != nil)
+	if err != nil {
+		return err
+	}
+	if m.options.loadBalanced() && description.ServiceID == "" {
+		return MongoError{
+			message: "Server " + connection.address + " did not report a serviceId; is it behind a load balancer?",
+		}
+	}
+	connection.description = description
+
+	// the server replies with the compressors it supports from our list, in
+	// our order of preference
+	if len(description.Compression) > 0 {
+		connection.compressor, err = newCompressor(description.Compression[0], m.options.zlibLevel())
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	connection.connect()
+// heartbeatCommand returns the command that asks a server what it is.
+func (m *MongoDB) heartbeatCommand() bson.D {
+	if m.options.ServerAPI != nil {
+		return bson.D{{"hello", 1}}
+	}
+	return bson.D{{"isMaster", 1}}
+}
 
+// isMaster runs an isMaster or hello command on a connection, in an OP_MSG
+// or an OP_QUERY, and returns the description of the server. Servers the
+// driver can't talk to are reported as an error.
+func (m *MongoDB) isMaster(ctx context.Context, connection *Connection, command bson.D,
+	opMsg bool) (*ServerDescription, error) {
 	db := &DB{
 		name:  "admin",
 		mongo: m,
 	}
-	var result bson.M
-	db.run(connection, bson.M{"isMaster": 1}, &result)
-
-	meRaw, ok := result["me"]
-	me := seed
-	if ok {
-		me = convert.ToString(meRaw)
-		_, ok := m.servers[me]
-		if ok {
-			connection.Close()
-			return nil
+	commandBytes, err := bson.Marshal(command)
+	if err != nil {
+		return nil, err
+	}
+	description := &ServerDescription{}
+	if opMsg {
+		res, err := db.runMsg(ctx, connection, 0, commandBytes)
+		if err != nil {
+			return nil, err
+		}
+		docs := res.Documents()
+		if len(docs) == 0 {
+			return nil, MongoError{
+				message: "Empty command reply",
+			}
+		}
+		err = bson.Unmarshal(docs[0], description)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = db.runQuery(ctx, connection, commandBytes, description)
+		if err != nil {
+			return nil, err
 		}
 	}
-
-	isMaster := convert.ToBool(result["ismaster"])
-	if isMaster {
-		m.master = connection
-		m.conn = connection
+	description.init(connection.address)
+	err = description.compatible()
+	if err != nil {
+		return nil, err
 	}
+	return description, nil
+}
 
-	m.servers[me] = connection
+// connect starts monitoring the seeds, and waits until they and the servers
+// they report have all been checked once, so that the client starts out
+// knowing the whole deployment. It fails if none of them can be used. If
+// some are still being checked when the server selection timeout is up, it
+// settles for the ones that were.
+//
+// Behind a load balancer there is nothing to discover or monitor, since
+// every connection may end up on a different mongos. The load balancer is
+// checked once with a connection from the pool.
+func (m *MongoDB) connect(ctx context.Context, seeds []string) error {
+	m.mu.Lock()
+	m.topology = newTopology(m.options, seeds)
+	m.mu.Unlock()
 
-	hostsRaw, ok := result["hosts"]
-	if ok {
-		hosts, err := convert.ConvertToStringSlice(hostsRaw)
+	if m.options.loadBalanced() {
+		s := newServer(seeds[0], m)
+		connection, err := s.pool.get(ctx)
 		if err != nil {
+			s.close()
 			return err
 		}
-		for i := 0; i < len(hosts); i++ {
-			m.connectToSeed(hosts[i])
+		description := *connection.description
+		description.Kind = ServerLoadBalancer
+		s.pool.put(connection)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.servers[s.address] = s
+		m.topology.update(&description)
+		return nil
+	}
+
+	timer := time.NewTimer(m.options.serverSelectionTimeout())
+	defer timer.Stop()
+
+	m.mu.Lock()
+	m.syncServers()
+	for {
+		if m.closed {
+			m.mu.Unlock()
+			return MongoError{
+				message: "Client is closed",
+			}
+		}
+		discovered, err := m.topology.discovered()
+		changed := m.changed
+		m.mu.Unlock()
+		if discovered {
+			return err
 		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			m.mu.Lock()
+			known := m.topology.known()
+			m.mu.Unlock()
+			if known {
+				return nil
+			}
+			return MongoError{
+				message: "Timed out discovering the servers of the deployment",
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		m.mu.Lock()
 	}
+}
 
-	return nil
+// updateServer records what the monitor of a server found, and brings the
+// servers in line with the topology: the servers that joined are monitored
+// from now on, and those that left are closed.
+func (m *MongoDB) updateServer(s *server, description *ServerDescription) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed || m.servers[s.address] != s {
+		return
+	}
+	m.topology.update(description)
+	m.syncServers()
+}
 
+// syncServers starts monitoring the servers that were added to the topology
+// and closes those that were removed, and wakes up the operations waiting
+// for a server. The caller must hold the lock.
+func (m *MongoDB) syncServers() {
+	for address, s := range m.servers {
+		if m.topology.servers[address] == nil {
+			s.close()
+			delete(m.servers, address)
+		}
+	}
+	for address := range m.topology.servers {
+		if m.servers[address] == nil {
+			s := newServer(address, m)
+			m.servers[address] = s
+			go s.monitor()
+		}
+	}
+	close(m.changed)
+	m.changed = make(chan struct{})
 }
 
-func (m *MongoDB) connect(seed string) error {
-	return m.connectToSeed(seed)
+// the codes of the errors that mean a server is no longer primary, or is
+// shutting down or recovering
+var stateChangeCodes = map[int32]bool{
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	10058: true, // LegacyNotPrimary
+	10107: true, // NotWritablePrimary
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotPrimaryNoSecondaryOk
+	13436: true, // NotPrimaryOrSecondary
+}
+
+// serverError marks the server of a connection as Unknown if an operation on
+// it failed in a way that shows the server isn't what the topology thinks
+// it is, such as a primary that stepped down. The server is checked again
+// right away.
+func (m *MongoDB) serverError(connection *Connection, err error) {
+	if m.options.loadBalanced() {
+		return
+	}
+	mongoErr, ok := err.(MongoError)
+	if !isNetworkError(err) && (!ok || !stateChangeCodes[mongoErr.code]) {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.servers[connection.address]
+	if m.closed || s == nil || s.pool != connection.pool {
+		return
+	}
+	m.topology.update(unknownDescription(connection.address, err))
+	m.syncServers()
+	s.requestCheck()
 }
 
 func (m *MongoDB) nextID() int32 {
-	m.requestID += 1
-	return m.requestID
+	return atomic.AddInt32(&m.requestID, 1)
+}
+
+// checkout takes a connection to the primary out of its pool for the
+// exclusive use of one operation. It must be given back with checkin.
+func (m *MongoDB) checkout(ctx context.Context) (*Connection, error) {
+	s, _, err := m.selectServer(ctx, primaryPreference)
+	if err != nil {
+		return nil, err
+	}
+	return s.pool.get(ctx)
+}
+
+// checkoutRead takes a connection for a read out of the pool of a server
+// that the read preference allows. Commands run on it tell the server about
+// the read preference while it is checked out.
+func (m *MongoDB) checkoutRead(ctx context.Context, readPreference *ReadPreference) (*Connection, error) {
+	err := readPreference.validate(m.options.heartbeatInterval())
+	if err != nil {
+		return nil, err
+	}
+	s, topologyKind, err := m.selectServer(ctx, readPreference)
+	if err != nil {
+		return nil, err
+	}
+	connection, err := s.pool.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	connection.readPreference, connection.secondaryOk = sendReadPreference(readPreference, topologyKind,
+		m.serverKind(s.address))
+	return connection, nil
+}
+
+// checkoutCursor takes a connection to the server a cursor was opened on,
+// which is the only one that knows about it. Cursors from elsewhere are
+// assumed to be on the primary.
+func (m *MongoDB) checkoutCursor(ctx context.Context, address string) (*Connection, error) {
+	if address == "" {
+		return m.checkout(ctx)
+	}
+	m.mu.Lock()
+	s := m.servers[address]
+	m.mu.Unlock()
+	if s == nil {
+		return nil, MongoError{
+			message: "Server " + address + " of the cursor is no longer available",
+		}
+	}
+	return s.pool.get(ctx)
+}
+
+// serverKind returns the latest kind of a server.
+func (m *MongoDB) serverKind(address string) ServerKind {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if description := m.topology.servers[address]; description != nil {
+		return description.Kind
+	}
+	return ServerUnknown
+}
+
+// selectServer returns a server that the read preference allows, picking
+// at random among the closest ones, along with the kind of topology it was
+// picked from. If there is none, such as during an election, it asks for
+// every server to be checked and waits for the topology to change, up to
+// the server selection timeout.
+func (m *MongoDB) selectServer(ctx context.Context, readPreference *ReadPreference) (*server, TopologyKind, error) {
+	var timeout <-chan time.Time
+	for {
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return nil, TopologyUnknown, MongoError{
+				message: "Client is closed",
+			}
+		}
+		var s *server
+		suitable := m.topology.suitable(readPreference, m.options.heartbeatInterval())
+		if description := nearby(suitable, m.options.localThreshold()); description != nil {
+			s = m.servers[description.Address]
+		}
+		topologyKind := m.topology.kind
+		changed := m.changed
+		if s == nil {
+			for _, s := range m.servers {
+				s.requestCheck()
+			}
+		}
+		m.mu.Unlock()
+		if s != nil {
+			return s, topologyKind, nil
+		}
+
+		if timeout == nil {
+			timer := time.NewTimer(m.options.serverSelectionTimeout())
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			if readPreference.mode() == "primary" {
+				return nil, topologyKind, MongoError{
+					message: "No primary server available",
+				}
+			}
+			return nil, topologyKind, MongoError{
+				message: "No server available for read preference " + readPreference.mode(),
+			}
+		case <-ctx.Done():
+			return nil, topologyKind, ctx.Err()
+		}
+	}
+}
+
+// checkin returns a connection to the pool it was checked out from. A
+// network error on the connection marks its server as Unknown.
+func (m *MongoDB) checkin(connection *Connection) {
+	if err := connection.Error(); err != nil {
+		m.serverError(connection, err)
+	}
+	connection.readPreference = nil
+	connection.secondaryOk = false
+	connection.pool.put(connection)
+}
+
+// killOperations kills whatever the server is still running for a connection
+// whose operation was abandoned when its context was done. The connection
+// itself is closed by then, so the operations are looked up by the server's
+// ID for it on another connection.
+func (m *MongoDB) killOperations(abandoned *Connection) {
+	// monitoring connections have no pool, and only ever run isMaster
+	if abandoned.description == nil || abandoned.description.ConnectionID == 0 || abandoned.pool == nil {
+		return
+	}
+	// behind a load balancer the other connection may well be to another
+	// mongos, where the connection ID means something else
+	if m.options.loadBalanced() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), killOperationsTimeout)
+	defer cancel()
+
+	connection, err := abandoned.pool.get(ctx)
+	if err != nil {
+		return
+	}
+	defer m.checkin(connection)
+
+	admin := &DB{
+		name:  "admin",
+		mongo: m,
+	}
+	var result struct {
+		InProgress []struct {
+			OpID interface{} `bson:"opid"`
+		} `bson:"inprog"`
+	}
+	err = admin.run(ctx, connection, bson.D{{"currentOp", 1}, {"connectionId", abandoned.description.ConnectionID}}, &result)
+	if err != nil {
+		return
+	}
+	for _, op := range result.InProgress {
+		var killResult bson.M
+		admin.run(ctx, connection, bson.D{{"killOp", 1}, {"op", op.OpID}}, &killResult)
+	}
 }
 
 func (m *MongoDB) GetDB(dName string) Database {
@@ -85,31 +458,46 @@ func (m *MongoDB) GetDB(dName string) Database {
 	}
 }
 
-func (m *MongoDB) Close() error {
-	return nil
+func (m *MongoDB) Servers() map[string]ServerDescription {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	descriptions := make(map[string]ServerDescription)
+	for address, description := range m.topology.servers {
+		descriptions[address] = *description
+	}
+	return descriptions
 }
 
-func (m *MongoDB) Error() error {
-	return nil
+func (m *MongoDB) Topology() TopologyKind {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.topology.kind
 }
 
-// checks if a mongo's connection is alive, if not, spins up a new
-// connection from the pool.
-func (m *MongoDB) checkAlive() error {
-
-	// ping the server
-	c := m.conn
+func (m *MongoDB) Stats() map[string]PoolStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make(map[string]PoolStats)
+	for address, s := range m.servers {
+		stats[address] = s.stats()
+	}
+	return stats
+}
 
-	admin := m.GetDB("admin")
-	var result bson.M
-	err := admin.ExecuteCommand(bson.M{"isMaster": 1}, &result)
-	if err != nil {
-		var err2 error
-		c.conn, err2 = c.connPool.Get()
-		if err2 != nil {
-			return err2
-		}
+func (m *MongoDB) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.done)
+		close(m.changed)
+	}
+	for _, s := range m.servers {
+		s.close()
 	}
 	return nil
+}
 
+func (m *MongoDB) Error() error {
+	return nil
 }
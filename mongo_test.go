@@ -0,0 +1,36 @@
+package gomongo_test
+
+import (
+	"github.com/dmliao/gomongo"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestConnectHungSeed checks that a seed that never answers doesn't keep the
+// client from connecting to the ones that do.
+func TestConnectHungSeed(t *testing.T) {
+	f := newFakeServer(t)
+	f.hello["msg"] = "isdbgrid"
+	hung, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hung.Close()
+
+	start := time.Now()
+	m, err := gomongo.ConnectWithOptions(&gomongo.ClientOptions{
+		Hosts:                  []string{f.address(), hung.Addr().String()},
+		ServerSelectionTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("connecting took %v", elapsed)
+	}
+	if m.Topology() != gomongo.TopologySharded {
+		t.Errorf("connected to a %v", m.Topology())
+	}
+}
@@ -0,0 +1,105 @@
+package gomongo
+
+import (
+	"context"
+	"github.com/dmliao/gomongo/internal/monitordial"
+	"time"
+)
+
+// the weight of the latest check in the average round trip time of a server
+const rttWeight = 0.2
+
+// monitor checks the server every heartbeat interval, and sooner when asked
+// to, and hands what it finds to the topology. It keeps a connection of its
+// own for this, outside of the pool, so that checks don't wait behind
+// operations. It runs until the server is closed.
+func (s *server) monitor() {
+	var connection *Connection
+	defer func() {
+		if connection != nil {
+			connection.Close()
+		}
+	}()
+
+	var rtt time.Duration
+	for {
+		description, err := s.check(&connection)
+		// a server that was fine a moment ago gets a second chance right
+		// away, since its connection may just have been closed under it
+		if err != nil && isNetworkError(err) && rtt != 0 && s.ctx.Err() == nil {
+			description, err = s.check(&connection)
+		}
+		if s.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			rtt = 0
+			description = unknownDescription(s.address, err)
+			s.pool.reset()
+		} else {
+			if rtt == 0 {
+				rtt = description.RTT
+			} else {
+				rtt = time.Duration(rttWeight*float64(description.RTT) + (1-rttWeight)*float64(rtt))
+			}
+			description.RTT = rtt
+		}
+		s.mongo.updateServer(s, description)
+
+		if !s.wait() {
+			return
+		}
+	}
+}
+
+// check runs isMaster on the monitoring connection, opening a new one if
+// there is none, and returns the description of the server with the round
+// trip time of this check.
+func (s *server) check(connection **Connection) (*ServerDescription, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.mongo.options.heartbeatTimeout())
+	defer cancel()
+
+	start := time.Now()
+	if *connection == nil {
+		c, err := s.connect(monitordial.Mark(ctx))
+		if err != nil {
+			return nil, err
+		}
+		*connection = c
+		description := *c.description
+		description.RTT = time.Since(start)
+		return &description, nil
+	}
+
+	description, err := s.mongo.isMaster(ctx, *connection, s.mongo.heartbeatCommand(), (*connection).supportsOpMsg())
+	if err != nil {
+		(*connection).Close()
+		*connection = nil
+		return nil, err
+	}
+	description.RTT = time.Since(start)
+	return description, nil
+}
+
+// wait sleeps until the next check is due, or until one is asked for, but
+// at least for the minimum heartbeat interval so that a busy client doesn't
+// flood the server with checks. It returns false once the server is closed.
+func (s *server) wait() bool {
+	timer := time.NewTimer(minHeartbeatInterval)
+	select {
+	case <-timer.C:
+	case <-s.ctx.Done():
+		timer.Stop()
+		return false
+	}
+
+	timer.Reset(s.mongo.options.heartbeatInterval() - minHeartbeatInterval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.checkNow:
+	case <-s.ctx.Done():
+		return false
+	}
+	return true
+}
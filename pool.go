@@ -0,0 +1,369 @@
+package gomongo
+
+import (
+	"context"
+	"errors"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// how often the pool closes expired idle connections and opens new ones to
+// keep up its minimum size
+const poolMaintenanceInterval = 10 * time.Second
+
+// PoolStats is a snapshot of the connections of a server's pool.
+type PoolStats struct {
+	// InUse is the number of connections checked out by operations.
+	InUse int
+	// Idle is the number of connections waiting in the pool.
+	Idle int
+	// Waiting is the number of operations waiting for a connection.
+	Waiting int
+	// Connecting is the number of connections being established.
+	Connecting int
+	// Generation is incremented every time the pool is cleared.
+	Generation uint64
+	// Compression counts the bytes sent to and received from the server,
+	// before and after compression.
+	Compression CompressionStats
+}
+
+// pool keeps connections to a single server so that operations can check
+// out a connection of their own. At most maxSize connections are open at
+// once, and operations wait their turn when all of them are checked out.
+//
+// Every connection remembers the generation of the pool it was created in.
+// Clearing the pool bumps the generation, which invalidates every existing
+// connection at once: idle ones are closed right away, and checked out ones
+// are closed when they are put back.
+//
+// Behind a load balancer the connections of the pool end up on different
+// mongos routers, which fail independently. Each of these services has a
+// generation of its own, and only the connections to the service that had
+// an error are cleared.
+type pool struct {
+	// compression is first to keep its counters aligned for atomic access
+	compression CompressionStats
+
+	dial func(ctx context.Context) (*Connection, error)
+
+	minSize          int
+	maxSize          int
+	maxConnecting    int
+	waitQueueTimeout time.Duration
+	maxIdleTime      time.Duration
+
+	mu         sync.Mutex
+	idle       []*Connection
+	total      int
+	inUse      int
+	connecting int
+	waiting    int
+	generation uint64
+	// serviceGenerations are the generations of the services behind a
+	// load balancer
+	serviceGenerations map[bson.ObjectId]uint64
+	closed             bool
+	// changed is closed and replaced whenever a connection may have become
+	// available, to wake up waiting operations
+	changed chan struct{}
+	done    chan struct{}
+}
+
+func newPool(dial func(ctx context.Context) (*Connection, error), options *ClientOptions) *pool {
+	p := &pool{
+		dial:             dial,
+		minSize:          options.MinPoolSize,
+		maxSize:          options.maxPoolSize(),
+		maxConnecting:    options.maxConnecting(),
+		waitQueueTimeout: options.WaitQueueTimeout,
+		maxIdleTime:      options.MaxIdleTime,
+		changed:          make(chan struct{}),
+		done:             make(chan struct{}),
+	}
+	if options.loadBalanced() {
+		p.serviceGenerations = make(map[bson.ObjectId]uint64)
+	}
+	if p.minSize > 0 || p.maxIdleTime > 0 {
+		go p.maintain()
+	}
+	return p
+}
+
+// notify wakes up all operations waiting for a connection. The caller must
+// hold the lock.
+func (p *pool) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// stale returns whether a connection must not be reused. The caller must
+// hold the lock.
+func (p *pool) stale(c *Connection, now time.Time) bool {
+	if c.generation != p.generationOf(c) || c.Error() != nil {
+		return true
+	}
+	return p.maxIdleTime > 0 && now.Sub(c.idleSince) > p.maxIdleTime
+}
+
+// get checks out an idle connection, or dials a new one if there are none.
+// If the pool is at its maximum size, get waits until a connection is put
+// back, up to the wait queue timeout or until the context is done.
+func (p *pool) get(ctx context.Context) (*Connection, error) {
+	var timeout <-chan time.Time
+	if p.waitQueueTimeout > 0 {
+		timer := time.NewTimer(p.waitQueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		if p.closed {
+			return nil, MongoError{
+				message: "Connection pool closed",
+			}
+		}
+
+		now := time.Now()
+		for len(p.idle) > 0 {
+			c := p.idle[len(p.idle)-1]
+			p.idle = p.idle[:len(p.idle)-1]
+			if p.stale(c, now) {
+				p.discard(c)
+				continue
+			}
+			p.inUse++
+			return c, nil
+		}
+
+		if p.total < p.maxSize && p.connecting < p.maxConnecting {
+			c, err := p.open(ctx)
+			if err != nil {
+				return nil, err
+			}
+			p.inUse++
+			return c, nil
+		}
+
+		changed := p.changed
+		p.waiting++
+		p.mu.Unlock()
+		select {
+		case <-changed:
+			p.mu.Lock()
+			p.waiting--
+		case <-timeout:
+			p.mu.Lock()
+			p.waiting--
+			return nil, WaitQueueTimeoutError{
+				Timeout: p.waitQueueTimeout,
+			}
+		case <-ctx.Done():
+			p.mu.Lock()
+			p.waiting--
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// open dials a new connection for the pool. The caller must hold the lock,
+// which is released while dialing.
+func (p *pool) open(ctx context.Context) (*Connection, error) {
+	generation := p.generation
+	p.total++
+	p.connecting++
+	p.mu.Unlock()
+
+	c, err := p.dial(ctx)
+
+	p.mu.Lock()
+	p.connecting--
+	p.notify()
+	if err != nil {
+		p.total--
+		// behind a load balancer there's no telling which service the
+		// connection was to, so none are cleared
+		if isNetworkError(err) && generation == p.generation && p.serviceGenerations == nil {
+			p.clear("")
+		}
+		return nil, err
+	}
+	c.generation = generation
+	if p.serviceGenerations != nil {
+		// the service is only known once the handshake is done
+		c.generation = p.serviceGenerations[c.serviceID()]
+	}
+	return c, nil
+}
+
+// generationOf returns the generation that a connection must be from to be
+// reused. The caller must hold the lock.
+func (p *pool) generationOf(c *Connection) uint64 {
+	if p.serviceGenerations != nil {
+		return p.serviceGenerations[c.serviceID()]
+	}
+	return p.generation
+}
+
+// discard closes a connection that belongs to the pool. The caller must hold
+// the lock.
+func (p *pool) discard(c *Connection) {
+	c.Close()
+	p.total--
+	p.notify()
+}
+
+// put checks a connection back in. Broken and stale connections are closed
+// instead of reused, and a network error clears the whole pool, since the
+// other connections to the server are likely broken too.
+func (p *pool) put(c *Connection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.inUse--
+	err := c.Error()
+	if err != nil && isNetworkError(err) && c.generation == p.generationOf(c) {
+		p.clear(c.serviceID())
+	}
+	if p.closed || p.stale(c, time.Now()) {
+		p.discard(c)
+		return
+	}
+	c.idleSince = time.Now()
+	p.idle = append(p.idle, c)
+	p.notify()
+}
+
+// clear invalidates every connection in the pool, or only those to a
+// service behind a load balancer if one is given. The caller must hold the
+// lock.
+func (p *pool) clear(serviceID bson.ObjectId) {
+	if serviceID != "" && p.serviceGenerations != nil {
+		p.serviceGenerations[serviceID]++
+	} else {
+		p.generation++
+	}
+	idle := p.idle[:0]
+	for _, c := range p.idle {
+		if serviceID != "" && c.serviceID() != serviceID {
+			idle = append(idle, c)
+			continue
+		}
+		c.Close()
+		p.total--
+	}
+	p.idle = idle
+	p.notify()
+}
+
+// reset clears the pool of a server that couldn't be reached.
+func (p *pool) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear("")
+}
+
+// maintain runs in the background, closing expired idle connections and
+// opening new ones until the pool has at least minSize connections.
+func (p *pool) maintain() {
+	ticker := time.NewTicker(poolMaintenanceInterval)
+	defer ticker.Stop()
+	for {
+		p.prune()
+		p.populate()
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *pool) prune() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	idle := p.idle[:0]
+	for _, c := range p.idle {
+		if p.stale(c, now) {
+			p.discard(c)
+			continue
+		}
+		idle = append(idle, c)
+	}
+	p.idle = idle
+}
+
+func (p *pool) populate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for !p.closed && p.total < p.minSize && p.connecting < p.maxConnecting {
+		c, err := p.open(context.Background())
+		if err != nil {
+			return
+		}
+		if p.closed {
+			p.discard(c)
+			return
+		}
+		c.idleSince = time.Now()
+		p.idle = append(p.idle, c)
+	}
+}
+
+func (p *pool) stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PoolStats{
+		InUse:       p.inUse,
+		Idle:        len(p.idle),
+		Waiting:     p.waiting,
+		Connecting:  p.connecting,
+		Generation:  p.generation,
+		Compression: p.compression.load(),
+	}
+}
+
+// close closes all idle connections. Connections that are checked out are
+// closed when they are put back.
+func (p *pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	for _, c := range p.idle {
+		c.Close()
+		p.total--
+	}
+	p.idle = nil
+	p.closed = true
+	close(p.done)
+	p.notify()
+}
+
+// isNetworkError returns whether an error came from the network rather than
+// from the server. Timeouts don't count, since they say more about the
+// operation than about the health of the server.
+func isNetworkError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if isContextError(err) {
+		return false
+	}
+	netErr, ok := err.(net.Error)
+	return ok && !netErr.Timeout()
+}
+
+// isContextError returns whether an operation failed because its context was
+// done, including a dial whose error wraps the context's.
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,150 @@
+package gomongo
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// testPool returns a pool whose connections are one end of a pipe, and
+// counts the dials.
+func testPool(t *testing.T, options *ClientOptions) (*pool, *int) {
+	dials := 0
+	p := newPool(func(ctx context.Context) (*Connection, error) {
+		dials++
+		client, server := net.Pipe()
+		go func() {
+			io.Copy(io.Discard, server)
+			server.Close()
+		}()
+		return &Connection{conn: client}, nil
+	}, options)
+	t.Cleanup(p.close)
+	return p, &dials
+}
+
+// waitForStats waits until check accepts the pool's stats.
+func waitForStats(t *testing.T, p *pool, check func(PoolStats) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !check(p.stats()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool stats are %+v", p.stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPoolSize(t *testing.T) {
+	p, dials := testPool(t, &ClientOptions{
+		MaxPoolSize:      2,
+		WaitQueueTimeout: 50 * time.Millisecond,
+	})
+
+	a, err := p.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := p.stats(); stats.InUse != 2 || stats.Idle != 0 {
+		t.Errorf("stats with both connections checked out: %+v", stats)
+	}
+
+	_, err = p.get(context.Background())
+	if _, ok := err.(WaitQueueTimeoutError); !ok {
+		t.Errorf("checked out a third connection: %v", err)
+	}
+
+	// a waiting operation gets the connection that's put back
+	got := make(chan *Connection)
+	go func() {
+		c, err := p.get(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		got <- c
+	}()
+	waitForStats(t, p, func(stats PoolStats) bool { return stats.Waiting == 1 })
+	p.put(a)
+	if c := <-got; c != a {
+		t.Error("the waiting operation didn't get the connection put back")
+	}
+	p.put(a)
+	p.put(b)
+	if stats := p.stats(); stats.InUse != 0 || stats.Idle != 2 || stats.Waiting != 0 {
+		t.Errorf("stats with both connections put back: %+v", stats)
+	}
+	if *dials != 2 {
+		t.Errorf("dialed %v connections", *dials)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.get(context.Background())
+	p.get(context.Background())
+	_, err = p.get(ctx)
+	if err != context.Canceled {
+		t.Errorf("checked out a connection with a cancelled context: %v", err)
+	}
+}
+
+func TestPoolClear(t *testing.T) {
+	p, dials := testPool(t, &ClientOptions{})
+
+	a, _ := p.get(context.Background())
+	b, _ := p.get(context.Background())
+	p.put(a)
+
+	// a network error on one connection invalidates the other ones
+	b.fatal(io.EOF)
+	p.put(b)
+	if stats := p.stats(); stats.Generation != 1 || stats.Idle != 0 {
+		t.Errorf("stats after a network error: %+v", stats)
+	}
+	if a.conn.SetDeadline(time.Time{}) == nil {
+		t.Error("the idle connection wasn't closed")
+	}
+
+	c, _ := p.get(context.Background())
+	if *dials != 3 || c == a || c == b {
+		t.Error("reused a connection from before the pool was cleared")
+	}
+
+	// a connection from an older generation doesn't clear the pool again
+	d, _ := p.get(context.Background())
+	p.reset()
+	d.fatal(io.EOF)
+	p.put(d)
+	p.put(c)
+	if stats := p.stats(); stats.Generation != 2 || stats.Idle != 0 || stats.InUse != 0 {
+		t.Errorf("stats after putting back connections from before a reset: %+v", stats)
+	}
+}
+
+// TestPoolCancelledDial checks that a dial that gave up because its caller
+// did leaves the pool alone.
+func TestPoolCancelledDial(t *testing.T) {
+	errs := []error{
+		&net.OpError{Op: "dial", Net: "tcp", Err: context.Canceled},
+		&net.OpError{Op: "dial", Net: "tcp", Err: io.EOF},
+	}
+	p := newPool(func(ctx context.Context) (*Connection, error) {
+		err := errs[0]
+		errs = errs[1:]
+		return nil, err
+	}, &ClientOptions{})
+	defer p.close()
+
+	p.get(context.Background())
+	if stats := p.stats(); stats.Generation != 0 {
+		t.Errorf("a cancelled dial cleared the pool: %+v", stats)
+	}
+	p.get(context.Background())
+	if stats := p.stats(); stats.Generation != 1 {
+		t.Errorf("a failed dial didn't clear the pool: %+v", stats)
+	}
+}
@@ -9,19 +9,52 @@ type MsgHeader struct {
 }
 
 type OpQuery struct {
-	Flags              int32  // bit vector of query options.  See below for details.
-	FullCollectionName string // "dbname.collectionname"
-	NumberToSkip       int32  // number of documents to skip
-	NumberToReturn     int32  // number of documents to return
+	Header             MsgHeader // standard message header
+	Flags              int32     // bit vector of query options.  See below for details.
+	FullCollectionName string    // "dbname.collectionname"
+	NumberToSkip       int32     // number of documents to skip
+	NumberToReturn     int32     // number of documents to return
 	Query              interface{}
 	Projection         interface{}
 }
 
 type OpGetMore struct {
-	Reserved           int32  // 0 - reserved for future use
-	FullCollectionName string // "dbname.collectionname"
-	NumberToReturn     int32  // number of documents to return
-	CursorID           int64  // cursorID from the OP_REPLY
+	Header             MsgHeader // standard message header
+	Reserved           int32     // 0 - reserved for future use
+	FullCollectionName string    // "dbname.collectionname"
+	NumberToReturn     int32     // number of documents to return
+	CursorID           int64     // cursorID from the OP_REPLY
+}
+
+type OpKillCursors struct {
+	Header            MsgHeader // standard message header
+	Reserved          int32     // 0 - reserved for future use
+	NumberOfCursorIDs int32     // number of cursorIDs in message
+	CursorIDs         []int64   // sequence of cursorIDs to close
+}
+
+type OpInsert struct {
+	Header             MsgHeader // standard message header
+	Flags              int32     // bit vector - see below
+	FullCollectionName string    // "dbname.collectionname"
+	Documents          [][]byte  // one or more documents to insert into the collection
+}
+
+type OpUpdate struct {
+	Header             MsgHeader // standard message header
+	Reserved           int32     // 0 - reserved for future use
+	FullCollectionName string    // "dbname.collectionname"
+	Flags              int32     // bit vector. see below
+	Selector           interface{}
+	Update             interface{}
+}
+
+type OpDelete struct {
+	Header             MsgHeader // standard message header
+	Reserved           int32     // 0 - reserved for future use
+	FullCollectionName string    // "dbname.collectionname"
+	Flags              int32     // bit vector - see below for details.
+	Selector           interface{}
 }
 
 type OpResponse struct {
@@ -32,3 +65,77 @@ type OpResponse struct {
 	NumberReturned int32     // number of documents in the reply
 	Document       [][]byte  // documents
 }
+
+type OpCompressed struct {
+	Header            MsgHeader // standard message header
+	OriginalOpcode    int32     // value of wrapped opcode
+	UncompressedSize  int32     // size of the message, excluding the header
+	CompressorID      uint8     // ID of the compressor that compressed the message
+	CompressedMessage []byte    // opcode itself, excluding the header
+}
+
+type OpMsg struct {
+	Header   MsgHeader    // standard message header
+	FlagBits uint32       // message flags
+	Sections []MsgSection // data sections
+	Checksum uint32       // optional CRC-32C checksum
+}
+
+type MsgSection struct {
+	Kind       byte     // 0 for a single body document, 1 for a document sequence
+	Identifier string   // document sequence identifier (kind 1 only)
+	Documents  [][]byte // documents
+}
+
+// Reply is a message sent by the server in response to a request, either an
+// OP_REPLY or an OP_MSG.
+type Reply interface {
+	MessageHeader() MsgHeader
+	Documents() [][]byte
+}
+
+func (q *OpQuery) MessageHeader() MsgHeader {
+	return q.Header
+}
+
+func (g *OpGetMore) MessageHeader() MsgHeader {
+	return g.Header
+}
+
+func (k *OpKillCursors) MessageHeader() MsgHeader {
+	return k.Header
+}
+
+func (i *OpInsert) MessageHeader() MsgHeader {
+	return i.Header
+}
+
+func (u *OpUpdate) MessageHeader() MsgHeader {
+	return u.Header
+}
+
+func (d *OpDelete) MessageHeader() MsgHeader {
+	return d.Header
+}
+
+func (r *OpResponse) MessageHeader() MsgHeader {
+	return r.Header
+}
+
+func (r *OpResponse) Documents() [][]byte {
+	return r.Document
+}
+
+func (m *OpMsg) MessageHeader() MsgHeader {
+	return m.Header
+}
+
+// Documents returns the documents of every section in the message, starting
+// with the body.
+func (m *OpMsg) Documents() [][]byte {
+	docs := [][]byte{}
+	for _, section := range m.Sections {
+		docs = append(docs, section.Documents...)
+	}
+	return docs
+}
@@ -0,0 +1,148 @@
+package gomongo
+
+import (
+	"fmt"
+	"github.com/dmliao/gomongo/convert"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// how often a primary writes to the oplog when there are no writes, which
+// bounds how precisely the staleness of a secondary can be known
+const idleWritePeriod = 10 * time.Second
+
+// ReadPreference says which servers reads may go to. Reads on a replica set
+// go to the primary unless the mode says otherwise, and writes always do.
+type ReadPreference struct {
+	// Mode is "primary", "primaryPreferred", "secondary",
+	// "secondaryPreferred" or "nearest". Empty means primary.
+	Mode string
+	// TagSets limit reads to members whose tags include every tag of a set.
+	// The first set that any member matches is used, and an empty set
+	// matches every member. They can't be used with the primary mode.
+	TagSets []map[string]string
+	// MaxStaleness is how far behind the primary a secondary may be for
+	// reads to go to it. It can't be less than 90 seconds. Zero means no
+	// limit.
+	MaxStaleness time.Duration
+	// Hedge enables or disables hedged reads on sharded clusters, where
+	// mongos sends a read to two members of a shard and uses the first
+	// answer. Nil leaves it to the server.
+	Hedge *bool
+}
+
+// primaryPreference is where writes go, and reads without a read preference.
+var primaryPreference = &ReadPreference{
+	Mode: "primary",
+}
+
+// readPreference returns the read preference from the client options.
+func (o *ClientOptions) readPreference() *ReadPreference {
+	return &ReadPreference{
+		Mode:         o.ReadPreference,
+		TagSets:      o.ReadPreferenceTags,
+		MaxStaleness: o.MaxStaleness,
+		Hedge:        o.ReadPreferenceHedge,
+	}
+}
+
+func (r *ReadPreference) mode() string {
+	if r.Mode == "" {
+		return "primary"
+	}
+	return r.Mode
+}
+
+// validate checks the read preference against the heartbeat interval of the
+// client, since the staleness of secondaries is only known to within one
+// heartbeat and the primary's idle writes.
+func (r *ReadPreference) validate(heartbeatInterval time.Duration) error {
+	if !readPreferences[r.mode()] {
+		return fmt.Errorf("unknown read preference %v", r.Mode)
+	}
+	if r.mode() == "primary" {
+		if len(r.TagSets) > 0 {
+			return fmt.Errorf("read preference tags can't be used with the primary read preference")
+		}
+		if r.MaxStaleness != 0 {
+			return fmt.Errorf("maxStalenessSeconds can't be used with the primary read preference")
+		}
+		if r.Hedge != nil {
+			return fmt.Errorf("hedged reads can't be used with the primary read preference")
+		}
+	}
+	if r.MaxStaleness < 0 || (r.MaxStaleness > 0 && r.MaxStaleness < minMaxStaleness) {
+		return fmt.Errorf("maxStalenessSeconds can't be less than %v", int(minMaxStaleness/time.Second))
+	}
+	if r.MaxStaleness > 0 && r.MaxStaleness < heartbeatInterval+idleWritePeriod {
+		return fmt.Errorf("maxStalenessSeconds can't be less than the heartbeat interval plus %v",
+			idleWritePeriod)
+	}
+	return nil
+}
+
+// document returns the read preference as the $readPreference of a command.
+func (r *ReadPreference) document() bson.D {
+	doc := bson.D{{"mode", r.mode()}}
+	if len(r.TagSets) > 0 {
+		doc = append(doc, bson.DocElem{"tags", r.TagSets})
+	}
+	if r.MaxStaleness > 0 {
+		doc = append(doc, bson.DocElem{"maxStalenessSeconds", int64(r.MaxStaleness / time.Second)})
+	}
+	if r.Hedge != nil {
+		doc = append(doc, bson.DocElem{"hedge", bson.D{{"enabled", *r.Hedge}}})
+	}
+	return doc
+}
+
+// sendReadPreference works out what tells the server chosen for a read that
+// it may run it: the $readPreference to send with commands, and whether to
+// set the secondaryOk bit of OP_QUERY. Members of replica
+// sets only need to know that the read may run on a secondary, while mongos
+// routers need the whole read preference to pick a member of the shard.
+func sendReadPreference(r *ReadPreference, topologyKind TopologyKind,
+	serverKind ServerKind) (bson.D, bool) {
+	switch {
+	case serverKind == ServerStandalone:
+		// a standalone has nothing to choose from
+		return nil, false
+	case serverKind == ServerMongos || serverKind == ServerLoadBalancer:
+		if r.mode() == "primary" {
+			return nil, false
+		}
+		return r.document(), true
+	case topologyKind == TopologySingle:
+		// a server connected to directly takes any read, whatever its role
+		if r.mode() == "primary" {
+			return bson.D{{"mode", "primaryPreferred"}}, true
+		}
+		return r.document(), true
+	case r.mode() == "primary":
+		return nil, false
+	}
+	return r.document(), true
+}
+
+// queryFlags sets the secondaryOk bit in the flags of an OP_QUERY for a read
+// that may run on a secondary.
+func queryFlags(connection *Connection, flags int32) int32 {
+	return convert.WriteBit32LE(flags, 2, connection.secondaryOk)
+}
+
+// withQueryReadPreference adds the read preference to the query of an
+// OP_QUERY for a mongos router, which finds it next to the query in a $query
+// wrapper. Members of replica sets go by the secondaryOk bit instead.
+func withQueryReadPreference(connection *Connection, queryBytes []byte) ([]byte, error) {
+	if connection.readPreference == nil || connection.description.Kind != ServerMongos {
+		return queryBytes, nil
+	}
+	if !hasElement(queryBytes, "$query") {
+		var err error
+		queryBytes, err = bson.Marshal(bson.D{{"$query", bson.Raw{Kind: 0x03, Data: queryBytes}}})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return appendElements(queryBytes, bson.D{{"$readPreference", connection.readPreference}})
+}
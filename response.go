@@ -5,33 +5,126 @@ import (
 	"encoding/binary"
 	"fmt"
 	"github.com/dmliao/gomongo/buffer"
+	"github.com/dmliao/gomongo/convert"
+	"gopkg.in/mgo.v2/bson"
 	"io"
 )
 
-func (c *Connection) receive() (*OpResponse, error) {
-	connection := c.conn
+// Message is a whole message read off a connection by ReadMessage.
+type Message struct {
+	Header MsgHeader
+	// HeaderBytes is the header as it was encoded, which the checksum of an
+	// OP_MSG covers
+	HeaderBytes []byte
+	Contents    []byte
+	// WireLength is the length of the message as it was sent, which is less
+	// than the length in the header if it came compressed
+	WireLength int32
+}
 
-	// Read the first 16 bytes for the message header
-	response := OpResponse{}
-	messageHeader := make([]byte, 16)
-	n, err := connection.Read(messageHeader)
+// ReadMessage reads the next message off a connection, unwrapping it first if
+// it is an OP_COMPRESSED. The length in the header is checked against maxSize
+// before anything is allocated for the message, and the whole message is
+// read before any of it is parsed, so a malformed message can't leave the
+// rest of it in the stream. Malformed messages are reported as a
+// FramingError, and an io.EOF means the stream ended between messages.
+func ReadMessage(reader io.Reader, maxSize int32) (Message, error) {
+	headerBytes := make([]byte, 16)
+	_, err := io.ReadFull(reader, headerBytes)
 	if err != nil {
-		if err != io.EOF {
-			fmt.Printf("error reading from connection: %v\n", err)
+		return Message{}, err
+	}
+	header := MsgHeader{
+		MessageLength: int32(binary.LittleEndian.Uint32(headerBytes[0:])),
+		RequestID:     int32(binary.LittleEndian.Uint32(headerBytes[4:])),
+		ResponseTo:    int32(binary.LittleEndian.Uint32(headerBytes[8:])),
+		OpCode:        int32(binary.LittleEndian.Uint32(headerBytes[12:])),
+	}
+	if header.MessageLength < 16 || header.MessageLength > maxSize {
+		return Message{}, FramingError{
+			Reason: fmt.Sprintf("message length %v is not between 16 and %v", header.MessageLength, maxSize),
+		}
+	}
+	contents := make([]byte, header.MessageLength-16)
+	_, err = io.ReadFull(reader, contents)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return Message{}, err
+	}
+
+	wireLength := header.MessageLength
+	if header.OpCode == OP_COMPRESSED {
+		header, contents, err = DecompressMessage(header, contents, maxSize)
+		if err != nil {
+			return Message{}, framingError(err)
 		}
-		fmt.Printf("client %v closed connection\n", connection.RemoteAddr())
+		// the checksum of an OP_MSG covers the original header
+		binary.LittleEndian.PutUint32(headerBytes[0:], uint32(header.MessageLength))
+		binary.LittleEndian.PutUint32(headerBytes[12:], uint32(header.OpCode))
+	}
+	return Message{
+		Header:      header,
+		HeaderBytes: headerBytes,
+		Contents:    contents,
+		WireLength:  wireLength,
+	}, nil
+}
+
+// receive reads the next message off the connection and decodes it as a
+// reply.
+func (c *Connection) receive() (Reply, error) {
+	message, err := ReadMessage(c.reader, c.maxMessageSize())
+	if err != nil {
 		return nil, err
 	}
-	if n == 0 {
-		fmt.Println("connection closed")
-		return nil, io.EOF
+	c.countReceived(message.WireLength, message.Header.MessageLength)
+
+	var reply Reply
+	switch message.Header.OpCode {
+	case OP_REPLY:
+		reply, err = DecodeReply(message.Header, message.Contents)
+	case OP_MSG:
+		reply, err = DecodeMsg(message.Header, message.HeaderBytes, message.Contents)
+	default:
+		err = fmt.Errorf("unsupported opcode %v in reply", message.Header.OpCode)
 	}
-	msgHeader := MsgHeader{}
-	err = binary.Read(bytes.NewReader(messageHeader), binary.LittleEndian, &msgHeader)
 	if err != nil {
-		fmt.Printf("error decoding from reader: %v\n", err)
+		return nil, framingError(err)
+	}
+	return reply, nil
+}
+
+// maxMessageSize returns the largest message the server may send, which is
+// the default until the handshake says otherwise.
+func (c *Connection) maxMessageSize() int32 {
+	if c.description == nil {
+		return defaultMaxMessageSizeBytes
+	}
+	return c.description.MaxMessageSizeBytes
+}
+
+// DecodeReply parses the contents of an OP_REPLY following its header, which
+// must hold exactly the documents it says it returns.
+func DecodeReply(msgHeader MsgHeader, contents []byte) (*OpResponse, error) {
+	reader := bytes.NewReader(contents)
+	reply, err := receiveReply(msgHeader, reader)
+	if err != nil {
 		return nil, err
 	}
+	if reader.Len() != 0 {
+		return nil, fmt.Errorf("OP_REPLY has %v bytes past its documents", reader.Len())
+	}
+	return reply, nil
+}
+
+// receiveReply reads the contents of an OP_REPLY following the message
+// header.
+func receiveReply(msgHeader MsgHeader, connection io.Reader) (*OpResponse, error) {
+	var err error
+
+	response := OpResponse{}
 	response.Header = msgHeader
 	response.ResponseFlags, err = buffer.ReadInt32LE(connection)
 	if err != nil {
@@ -50,6 +143,9 @@ func (c *Connection) receive() (*OpResponse, error) {
 	if err != nil {
 		return nil, err
 	}
+	if response.NumberReturned < 0 {
+		return nil, fmt.Errorf("OP_REPLY returns %v documents", response.NumberReturned)
+	}
 	for i := int32(0); i < response.NumberReturned; i++ {
 		_, doc, err := buffer.ReadDocumentRaw(connection)
 		if err != nil {
@@ -60,7 +156,23 @@ func (c *Connection) receive() (*OpResponse, error) {
 
 	return &response, nil
 }
+
 func receiveFindResponse(res *OpResponse, cursor *cursorObj) error {
+	if convert.ReadBit32LE(res.ResponseFlags, 0) {
+		return MongoError{
+			message: "Cursor not found",
+		}
+	}
+	if convert.ReadBit32LE(res.ResponseFlags, 1) {
+		var queryErr bson.M
+		if len(res.Document) > 0 {
+			bson.Unmarshal(res.Document[0], &queryErr)
+		}
+		return MongoError{
+			message: convert.ToString(queryErr["$err"], "Query failure"),
+			code:    convert.ToInt32(queryErr["code"]),
+		}
+	}
 
 	cursor.docs = res.Document
 	cursor.cursorID = res.CursorID
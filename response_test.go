@@ -0,0 +1,80 @@
+package gomongo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// The seed corpus of these targets is in testdata/fuzz. Each input is a whole
+// message as a server would send it, header included.
+
+// FuzzReceive reads arbitrary bytes off a connection as if a server had sent
+// them. Whatever they are, receive must return an error or a well formed
+// reply, without panicking.
+func FuzzReceive(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := &Connection{
+			reader: bufio.NewReader(bytes.NewReader(data)),
+		}
+		reply, err := c.receive()
+		if err != nil {
+			return
+		}
+		checkDocuments(t, reply.Documents())
+	})
+}
+
+// FuzzDecodeMsg decodes arbitrary bytes as an OP_MSG.
+func FuzzDecodeMsg(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) < 16 {
+			return
+		}
+		msg, err := DecodeMsg(fuzzHeader(data), data[:16], data[16:])
+		if err != nil {
+			return
+		}
+		if len(msg.Sections) == 0 || msg.Sections[0].Kind != 0 || len(msg.Sections[0].Documents) != 1 {
+			t.Errorf("OP_MSG decoded without a body section: %+v", msg.Sections)
+		}
+		checkDocuments(t, msg.Documents())
+	})
+}
+
+// FuzzDecodeReply decodes arbitrary bytes as an OP_REPLY.
+func FuzzDecodeReply(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) < 16 {
+			return
+		}
+		reply, err := DecodeReply(fuzzHeader(data), data[16:])
+		if err != nil {
+			return
+		}
+		if int(reply.NumberReturned) != len(reply.Document) {
+			t.Errorf("OP_REPLY returns %v documents, decoded %v", reply.NumberReturned, len(reply.Document))
+		}
+		checkDocuments(t, reply.Documents())
+	})
+}
+
+func fuzzHeader(data []byte) MsgHeader {
+	return MsgHeader{
+		MessageLength: int32(binary.LittleEndian.Uint32(data[0:])),
+		RequestID:     int32(binary.LittleEndian.Uint32(data[4:])),
+		ResponseTo:    int32(binary.LittleEndian.Uint32(data[8:])),
+		OpCode:        int32(binary.LittleEndian.Uint32(data[12:])),
+	}
+}
+
+// checkDocuments fails the test if a decoded document doesn't match its size
+// prefix or isn't null terminated.
+func checkDocuments(t *testing.T, docs [][]byte) {
+	for i, doc := range docs {
+		if len(doc) < 5 || int(binary.LittleEndian.Uint32(doc)) != len(doc) || doc[len(doc)-1] != 0 {
+			t.Errorf("document %v is malformed: %x", i, doc)
+		}
+	}
+}
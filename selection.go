@@ -0,0 +1,162 @@
+package gomongo
+
+import (
+	"math/rand"
+	"time"
+)
+
+// suitable returns the servers that an operation with the read preference
+// may go to. Writes go where reads with the primary read preference do.
+// Outside of replica sets the read preference doesn't narrow down the
+// servers, since mongos routers apply it themselves.
+func (t *topology) suitable(r *ReadPreference, heartbeatInterval time.Duration) []*ServerDescription {
+	var servers []*ServerDescription
+	switch t.kind {
+	case TopologySingle, TopologyLoadBalanced:
+		for _, server := range t.servers {
+			if server.Kind != ServerUnknown {
+				servers = append(servers, server)
+			}
+		}
+		return servers
+	case TopologySharded:
+		for _, server := range t.servers {
+			if server.Kind == ServerMongos {
+				servers = append(servers, server)
+			}
+		}
+		return servers
+	case TopologyReplicaSetNoPrimary, TopologyReplicaSetWithPrimary:
+	default:
+		return nil
+	}
+
+	var primary *ServerDescription
+	var secondaries []*ServerDescription
+	for _, server := range t.servers {
+		switch server.Kind {
+		case ServerRSPrimary:
+			primary = server
+		case ServerRSSecondary:
+			secondaries = append(secondaries, server)
+		}
+	}
+	eligible := func(servers []*ServerDescription) []*ServerDescription {
+		if r.MaxStaleness > 0 {
+			servers = fresh(servers, primary, secondaries, r.MaxStaleness, heartbeatInterval)
+		}
+		return matchTags(servers, r.TagSets)
+	}
+
+	switch r.mode() {
+	case "primary":
+		if primary != nil {
+			servers = append(servers, primary)
+		}
+	case "primaryPreferred":
+		if primary != nil {
+			servers = append(servers, primary)
+		} else {
+			servers = eligible(secondaries)
+		}
+	case "secondary":
+		servers = eligible(secondaries)
+	case "secondaryPreferred":
+		servers = eligible(secondaries)
+		if len(servers) == 0 && primary != nil {
+			servers = append(servers, primary)
+		}
+	case "nearest":
+		servers = append(servers, secondaries...)
+		if primary != nil {
+			servers = append(servers, primary)
+		}
+		servers = eligible(servers)
+	}
+	return servers
+}
+
+// fresh returns the servers that are at most maxStaleness behind the
+// primary, or if there is none, behind the secondary that is furthest
+// ahead. Staleness is estimated from the last write each server reported
+// and when it reported it, so it is only known to within a heartbeat.
+func fresh(servers []*ServerDescription, primary *ServerDescription, secondaries []*ServerDescription,
+	maxStaleness time.Duration, heartbeatInterval time.Duration) []*ServerDescription {
+	var latest *ServerDescription
+	for _, secondary := range secondaries {
+		if latest == nil || secondary.LastWrite.Date.After(latest.LastWrite.Date) {
+			latest = secondary
+		}
+	}
+
+	var fresh []*ServerDescription
+	for _, server := range servers {
+		if server.Kind == ServerRSPrimary {
+			fresh = append(fresh, server)
+			continue
+		}
+		var staleness time.Duration
+		if primary != nil {
+			staleness = server.UpdatedAt.Sub(server.LastWrite.Date) -
+				primary.UpdatedAt.Sub(primary.LastWrite.Date) + heartbeatInterval
+		} else {
+			staleness = latest.LastWrite.Date.Sub(server.LastWrite.Date) + heartbeatInterval
+		}
+		if staleness <= maxStaleness {
+			fresh = append(fresh, server)
+		}
+	}
+	return fresh
+}
+
+// matchTags returns the servers that match the first tag set that any of
+// them match. Without tag sets every server matches.
+func matchTags(servers []*ServerDescription, tagSets []map[string]string) []*ServerDescription {
+	if len(tagSets) == 0 {
+		return servers
+	}
+	for _, tagSet := range tagSets {
+		var matched []*ServerDescription
+		for _, server := range servers {
+			if hasTags(server, tagSet) {
+				matched = append(matched, server)
+			}
+		}
+		if len(matched) > 0 {
+			return matched
+		}
+	}
+	return nil
+}
+
+func hasTags(server *ServerDescription, tags map[string]string) bool {
+	for name, value := range tags {
+		if server.Tags[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// nearby picks one of the servers at random among those whose round trip
+// time is within the latency window of the fastest one's, which spreads the
+// load over servers that are about as close as each other. It returns nil
+// if there are no servers.
+func nearby(servers []*ServerDescription, localThreshold time.Duration) *ServerDescription {
+	if len(servers) == 0 {
+		return nil
+	}
+	fastest := servers[0].RTT
+	for _, server := range servers {
+		if server.RTT < fastest {
+			fastest = server.RTT
+		}
+	}
+	var window []*ServerDescription
+	for _, server := range servers {
+		if server.RTT <= fastest+localThreshold {
+			window = append(window, server)
+		}
+	}
+	return window[rand.Intn(len(window))]
+}
@@ -0,0 +1,95 @@
+package gomongo
+
+import (
+	"bufio"
+	"context"
+)
+
+// server is a member of the deployment, along with the pool of connections
+// to it and the monitor that checks on it.
+type server struct {
+	address string
+	mongo   *MongoDB
+	pool    *pool
+
+	// ctx is cancelled when the server is closed, which stops the monitor
+	ctx    context.Context
+	cancel context.CancelFunc
+	// checkNow asks the monitor for a check without waiting for the next
+	// heartbeat
+	checkNow chan struct{}
+}
+
+func newServer(address string, m *MongoDB) *server {
+	s := &server{
+		address:  address,
+		mongo:    m,
+		checkNow: make(chan struct{}, 1),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.pool = newPool(s.dial, m.options)
+	return s
+}
+
+// dial opens a new connection for the pool.
+func (s *server) dial(ctx context.Context) (*Connection, error) {
+	c, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.pool = s.pool
+	return c, nil
+}
+
+// connect opens a new connection to the server and runs the handshake on
+// it.
+func (s *server) connect(ctx context.Context) (*Connection, error) {
+	if s.mongo.options.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.mongo.options.ConnectTimeout)
+		defer cancel()
+	}
+
+	conn, err := s.mongo.options.dialer().DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return nil, err
+	}
+	if s.mongo.tlsConfig != nil {
+		tlsConn, err := dialTLS(ctx, conn, s.address, s.mongo.tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	c := &Connection{
+		conn:          conn,
+		reader:        bufio.NewReader(conn),
+		address:       s.address,
+		socketTimeout: s.mongo.options.SocketTimeout,
+		stats:         &s.pool.compression,
+	}
+	err = s.mongo.handshake(ctx, c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// requestCheck asks the monitor to check the server as soon as it may.
+func (s *server) requestCheck() {
+	select {
+	case s.checkNow <- struct{}{}:
+	default:
+	}
+}
+
+func (s *server) stats() PoolStats {
+	return s.pool.stats()
+}
+
+func (s *server) close() {
+	s.cancel()
+	s.pool.close()
+}
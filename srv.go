@@ -0,0 +1,253 @@
+package gomongo
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	srvScheme             = "mongodb+srv://"
+	defaultSRVServiceName = "mongodb"
+
+	// how often the SRV records of a sharded cluster are checked for new or
+	// removed routers, unless the heartbeat interval is set
+	defaultSRVPollInterval = 60 * time.Second
+	srvLookupTimeout       = 10 * time.Second
+)
+
+// Resolver looks up the DNS records behind mongodb+srv connection strings.
+// *net.Resolver implements it.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+func (o *ClientOptions) resolver() Resolver {
+	if o.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return o.Resolver
+}
+
+func (o *ClientOptions) srvServiceName() string {
+	if o.SRVServiceName == "" {
+		return defaultSRVServiceName
+	}
+	return o.SRVServiceName
+}
+
+func (o *ClientOptions) srvPollInterval() time.Duration {
+	if o.HeartbeatInterval == 0 {
+		return defaultSRVPollInterval
+	}
+	return o.HeartbeatInterval
+}
+
+// parseSRVHost checks the single host of a mongodb+srv connection string,
+// which can't have a port.
+func parseSRVHost(host string) (string, error) {
+	if host == "" || strings.Contains(host, ",") {
+		return "", fmt.Errorf("%v connection strings must have exactly one host", srvScheme)
+	}
+	if strings.Contains(host, ":") {
+		return "", fmt.Errorf("%v hosts can't have a port", srvScheme)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.Contains(host, "..") || strings.HasPrefix(host, ".") {
+		return "", fmt.Errorf("invalid host %v", host)
+	}
+	return host, nil
+}
+
+// srvDomain returns the domain that the hosts found for an SRV host have to
+// be in. For hosts with at least three labels it is the host's parent
+// domain, and otherwise the host itself.
+func srvDomain(srvHost string) string {
+	if strings.Count(srvHost, ".") >= 2 {
+		return srvHost[strings.Index(srvHost, ".")+1:]
+	}
+	return srvHost
+}
+
+// lookupSRVHosts looks up the seed list of an SRV host. Every host has to be
+// in the SRV host's domain, so that a DNS record can't point the client at
+// somebody else's servers. If some records aren't, the hosts of the others
+// are returned along with the error.
+func lookupSRVHosts(ctx context.Context, options *ClientOptions) ([]string, error) {
+	_, records, err := options.resolver().LookupSRV(ctx, options.srvServiceName(), "tcp", options.SRVHost)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no SRV records found for %v", options.SRVHost)
+	}
+
+	domain := "." + srvDomain(options.SRVHost)
+	hosts := make([]string, 0, len(records))
+	for _, record := range records {
+		target := strings.ToLower(strings.TrimSuffix(record.Target, "."))
+		if !strings.HasSuffix(target, domain) || target == options.SRVHost {
+			if err == nil {
+				err = fmt.Errorf("SRV record %v is not in the domain of %v", target, options.SRVHost)
+			}
+			continue
+		}
+		hosts = append(hosts, net.JoinHostPort(target, strconv.Itoa(int(record.Port))))
+	}
+	return hosts, err
+}
+
+// lookupSRVOptions looks up the TXT record of an SRV host, which may only
+// set authSource, replicaSet and loadBalanced.
+func lookupSRVOptions(ctx context.Context, options *ClientOptions) (map[string]string, error) {
+	records, err := options.resolver().LookupTXT(ctx, options.SRVHost)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	if len(records) > 1 {
+		return nil, fmt.Errorf("more than one TXT record found for %v", options.SRVHost)
+	}
+
+	txtOptions := make(map[string]string)
+	for _, pair := range strings.Split(records[0], "&") {
+		equals := strings.Index(pair, "=")
+		if equals < 0 {
+			return nil, fmt.Errorf("TXT record option %v has no value", pair)
+		}
+		key := strings.ToLower(pair[:equals])
+		switch key {
+		case "authsource", "replicaset", "loadbalanced":
+			txtOptions[key] = pair[equals+1:]
+		default:
+			return nil, fmt.Errorf("TXT record option %v is not allowed", pair[:equals])
+		}
+	}
+	return txtOptions, nil
+}
+
+// resolveSRV returns a copy of the options with the seed list and the
+// default options looked up from DNS. Options from the connection string
+// take precedence over the TXT record.
+func resolveSRV(ctx context.Context, options *ClientOptions) (*ClientOptions, error) {
+	hosts, err := lookupSRVHosts(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	txtOptions, err := lookupSRVOptions(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := *options
+	resolved.Hosts = limitHosts(hosts, options.SRVMaxHosts)
+	if resolved.ReplicaSet == "" {
+		resolved.ReplicaSet = txtOptions["replicaset"]
+	}
+	if value, ok := txtOptions["loadbalanced"]; ok && resolved.LoadBalanced == nil {
+		loadBalanced, err := parseBoolOption("loadBalanced", value)
+		if err != nil {
+			return nil, err
+		}
+		resolved.LoadBalanced = &loadBalanced
+	}
+	if source, ok := txtOptions["authsource"]; ok && resolved.Auth != nil && resolved.Auth.Source == "" {
+		auth := *resolved.Auth
+		auth.Source = source
+		resolved.Auth = &auth
+	}
+
+	err = resolved.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &resolved, nil
+}
+
+// limitHosts picks max of the hosts at random, or returns all of them if max
+// is zero.
+func limitHosts(hosts []string, max int) []string {
+	if max == 0 || len(hosts) <= max {
+		return hosts
+	}
+	shuffled := make([]string, len(hosts))
+	copy(shuffled, hosts)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled[:max]
+}
+
+// pollSRV runs in the background for deployments found through SRV, adding
+// and removing servers as the SRV records change, for as long as the
+// topology is unknown or sharded. If a lookup fails, the servers are left as
+// they are until the next one; records outside the domain are skipped.
+func (m *MongoDB) pollSRV() {
+	ticker := time.NewTicker(m.options.srvPollInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.done:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), srvLookupTimeout)
+		hosts, _ := lookupSRVHosts(ctx, m.options)
+		cancel()
+		if len(hosts) > 0 && !m.updateSRVHosts(hosts) {
+			return
+		}
+	}
+}
+
+// updateSRVHosts stops monitoring the servers that are no longer in the SRV
+// records and starts monitoring new ones, up to the maximum number of hosts.
+// It returns false once the SRV records no longer apply, because the client
+// is closed or the topology is neither unknown nor sharded.
+func (m *MongoDB) updateSRVHosts(hosts []string) bool {
+	found := make(map[string]bool)
+	for _, host := range hosts {
+		found[host] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed || (m.topology.kind != TopologyUnknown && m.topology.kind != TopologySharded) {
+		return false
+	}
+	for address := range m.topology.servers {
+		if !found[address] {
+			delete(m.topology.servers, address)
+		}
+	}
+	var added []string
+	for _, host := range hosts {
+		if m.topology.servers[host] == nil {
+			added = append(added, host)
+		}
+	}
+	if m.options.SRVMaxHosts > 0 {
+		room := m.options.SRVMaxHosts - len(m.topology.servers)
+		if room <= 0 {
+			added = nil
+		} else {
+			added = limitHosts(added, room)
+		}
+	}
+	for _, host := range added {
+		m.topology.servers[host] = unknownDescription(host, nil)
+	}
+	m.syncServers()
+	return true
+}
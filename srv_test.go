@@ -0,0 +1,229 @@
+package gomongo_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/dmliao/gomongo"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver serves SRV and TXT records for cluster.test.example, which
+// the test can change as it goes.
+type fakeResolver struct {
+	mu      sync.Mutex
+	targets []string
+	txt     []string
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if service != "mongodb" || proto != "tcp" || name != "cluster.test.example" {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	records := make([]*net.SRV, len(r.targets))
+	for i, target := range r.targets {
+		records[i] = &net.SRV{Target: target + ".", Port: 27017}
+	}
+	return "_mongodb._tcp." + name, records, nil
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.txt) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return r.txt, nil
+}
+
+func (r *fakeResolver) setTargets(targets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.targets = targets
+}
+
+// fakeHosts is a Dialer that connects to fake servers by the names in the
+// SRV records.
+type fakeHosts map[string]*fakeServer
+
+func (h fakeHosts) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	f := h[host]
+	if f == nil {
+		return nil, fmt.Errorf("no fake server for %v", address)
+	}
+	return (&net.Dialer{}).DialContext(ctx, network, f.address())
+}
+
+// connectSRV connects through the mongodb+srv connection string for
+// cluster.test.example.
+func connectSRV(options string, resolver *fakeResolver, hosts fakeHosts) (gomongo.Mongo, error) {
+	clientOptions, err := gomongo.ParseURI("mongodb+srv://cluster.test.example/?tls=false" + options)
+	if err != nil {
+		return nil, err
+	}
+	clientOptions.Resolver = resolver
+	clientOptions.Dialer = hosts
+	clientOptions.ServerSelectionTimeout = 5 * time.Second
+	return gomongo.ConnectWithOptions(clientOptions)
+}
+
+func TestSRVDomain(t *testing.T) {
+	for _, target := range []string{"a.other.example", "a.eviltest.example", "test.example", "cluster.test.example"} {
+		resolver := &fakeResolver{
+			targets: []string{"a.test.example", target},
+		}
+		_, err := connectSRV("", resolver, nil)
+		if err == nil || !strings.Contains(err.Error(), "not in the domain") {
+			t.Errorf("connecting with an SRV record for %v: %v", target, err)
+		}
+	}
+}
+
+func TestSRVTXTOptions(t *testing.T) {
+	f := newFakeServer(t)
+	f.hello["setName"] = "rs0"
+	f.hello["hosts"] = []string{"a.test.example:27017"}
+	hosts := fakeHosts{"a.test.example": f}
+
+	resolver := &fakeResolver{
+		targets: []string{"a.test.example"},
+		txt:     []string{"replicaSet=rs0&authSource=admin"},
+	}
+	m, err := connectSRV("", resolver, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if m.Topology() != gomongo.TopologyReplicaSetWithPrimary {
+		t.Errorf("connected to a %v through the TXT record's replicaSet", m.Topology())
+	}
+
+	refused := map[string]string{
+		"w=majority":         "not allowed",
+		"replicaSet":         "no value",
+		"loadBalanced=maybe": "loadBalanced",
+	}
+	for txt, message := range refused {
+		resolver.txt = []string{txt}
+		_, err = connectSRV("", resolver, hosts)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("connecting with the TXT record %q: %v", txt, err)
+		}
+	}
+
+	resolver.txt = []string{"replicaSet=rs0", "authSource=admin"}
+	_, err = connectSRV("", resolver, hosts)
+	if err == nil || !strings.Contains(err.Error(), "more than one TXT record") {
+		t.Errorf("connecting with two TXT records: %v", err)
+	}
+}
+
+// TestSRVPolling checks that the routers of a sharded cluster follow the
+// SRV records as they change.
+func TestSRVPolling(t *testing.T) {
+	hosts := fakeHosts{}
+	for _, name := range []string{"a", "b", "c"} {
+		f := newFakeServer(t)
+		f.hello["msg"] = "isdbgrid"
+		hosts[name+".test.example"] = f
+	}
+	resolver := &fakeResolver{
+		targets: []string{"a.test.example", "b.test.example"},
+	}
+	m, err := connectSRV("&heartbeatFrequencyMS=500", resolver, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if m.Topology() != gomongo.TopologySharded {
+		t.Fatalf("connected to a %v", m.Topology())
+	}
+	waitForServers(t, m, "a.test.example:27017", "b.test.example:27017")
+
+	resolver.setTargets("b.test.example", "c.test.example")
+	waitForServers(t, m, "b.test.example:27017", "c.test.example:27017")
+
+	// a failed lookup leaves the routers alone
+	resolver.setTargets()
+	time.Sleep(time.Second)
+	waitForServers(t, m, "b.test.example:27017", "c.test.example:27017")
+}
+
+// TestSRVPollingUnknown checks that the SRV records are polled while the
+// topology is still unknown.
+func TestSRVPollingUnknown(t *testing.T) {
+	ghost := newFakeServer(t)
+	ghost.hello["isreplicaset"] = true
+	router := newFakeServer(t)
+	router.hello["msg"] = "isdbgrid"
+	hosts := fakeHosts{"a.test.example": ghost, "b.test.example": router}
+	resolver := &fakeResolver{
+		targets: []string{"a.test.example"},
+	}
+	m, err := connectSRV("&heartbeatFrequencyMS=500", resolver, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if m.Topology() != gomongo.TopologyUnknown {
+		t.Fatalf("connected to a %v", m.Topology())
+	}
+
+	resolver.setTargets("b.test.example")
+	waitForServers(t, m, "b.test.example:27017")
+	if m.Topology() != gomongo.TopologySharded {
+		t.Errorf("topology is %v after finding a router", m.Topology())
+	}
+}
+
+// TestSRVPollingInvalidRecord checks that a poll skips the records outside
+// the domain and keeps the others.
+func TestSRVPollingInvalidRecord(t *testing.T) {
+	hosts := fakeHosts{}
+	for _, name := range []string{"a", "b", "c"} {
+		f := newFakeServer(t)
+		f.hello["msg"] = "isdbgrid"
+		hosts[name+".test.example"] = f
+	}
+	resolver := &fakeResolver{
+		targets: []string{"a.test.example"},
+	}
+	m, err := connectSRV("&heartbeatFrequencyMS=500", resolver, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	waitForServers(t, m, "a.test.example:27017")
+
+	resolver.setTargets("b.test.example", "c.other.example", "c.test.example")
+	waitForServers(t, m, "b.test.example:27017", "c.test.example:27017")
+}
+
+// waitForServers waits until the client knows exactly the servers given.
+func waitForServers(t *testing.T, m gomongo.Mongo, want ...string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var got []string
+		for address := range m.Servers() {
+			got = append(got, address)
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") == strings.Join(want, ",") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("servers are %v instead of %v", got, want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,117 @@
+package gomongo
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// tlsConfig builds the TLS configuration for connections from the options,
+// loading any CA and certificate files. It returns nil if TLS is off.
+//
+// Server certificates are verified against the CAs alone: revocation isn't
+// checked, neither through OCSP nor through CRLs.
+func (o *ClientOptions) tlsConfig() (*tls.Config, error) {
+	if !o.TLS {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+	if o.TLSConfig != nil {
+		config = o.TLSConfig.Clone()
+	}
+
+	if o.TLSCAs != nil {
+		config.RootCAs = o.TLSCAs
+	}
+	if o.TLSCAFile != "" {
+		caBytes, err := ioutil.ReadFile(o.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %v", err)
+		}
+		// the pool may be the caller's, which the file mustn't add to
+		if config.RootCAs == nil {
+			config.RootCAs = x509.NewCertPool()
+		} else {
+			config.RootCAs = config.RootCAs.Clone()
+		}
+		if !config.RootCAs.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("no certificates found in CA file %v", o.TLSCAFile)
+		}
+	}
+
+	if o.TLSCertificateKeyFile != "" {
+		// the certificate and its key are in the same PEM file
+		certificate, err := tls.LoadX509KeyPair(o.TLSCertificateKeyFile, o.TLSCertificateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		config.Certificates = append(config.Certificates, certificate)
+	}
+	config.Certificates = append(config.Certificates, o.TLSCertificates...)
+
+	if o.TLSServerName != "" {
+		config.ServerName = o.TLSServerName
+	}
+
+	if o.TLSInsecure || o.TLSAllowInvalidCertificates {
+		config.InsecureSkipVerify = true
+	} else if o.TLSAllowInvalidHostnames {
+		// verify the certificate chain ourselves, leaving out the hostname
+		roots := config.RootCAs
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, roots)
+		}
+	}
+	return config, nil
+}
+
+// verifyChain verifies a server's certificate chain without checking that
+// it is valid for the server's hostname.
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("server sent no certificates")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// dialTLS runs the TLS handshake on a new connection to address. The server
+// name defaults to the host part of the address.
+func dialTLS(ctx context.Context, conn net.Conn, address string, config *tls.Config) (net.Conn, error) {
+	config = config.Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	err := tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,241 @@
+package gomongo_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/dmliao/gomongo"
+	"gopkg.in/mgo.v2/bson"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gomongo test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pool: pool,
+	}
+}
+
+// issue signs a certificate for the template's names and usage.
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+// serverCertificate issues a certificate for a server reached at the IP
+// addresses and names.
+func (ca *testCA) serverCertificate(t *testing.T, ips []net.IP, names ...string) tls.Certificate {
+	return ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		IPAddresses: ips,
+		DNSNames:    names,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+}
+
+// newTLSFakeServer starts a fake server that only speaks TLS.
+func newTLSFakeServer(t *testing.T, config *tls.Config) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveFake(t, tls.NewListener(listener, config))
+}
+
+// connectTLS connects to the fake server with TLS, and returns the error
+// connecting ran into.
+func connectTLS(f *fakeServer, options *gomongo.ClientOptions) error {
+	options.Hosts = []string{f.address()}
+	options.TLS = true
+	options.ServerSelectionTimeout = 5 * time.Second
+	m, err := gomongo.ConnectWithOptions(options)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	return m.GetDB("test").ExecuteCommand(bson.M{"ping": 1}, &bson.M{})
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t)
+	f := newTLSFakeServer(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCertificate(t, []net.IP{net.IPv4(127, 0, 0, 1)})},
+	})
+
+	err := connectTLS(f, &gomongo.ClientOptions{
+		TLSCAs: ca.pool,
+	})
+	if err != nil {
+		t.Errorf("connecting with the server's CA: %v", err)
+	}
+
+	// a server whose certificate comes from another CA
+	err = connectTLS(f, &gomongo.ClientOptions{
+		TLSCAs: newTestCA(t).pool,
+	})
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("connecting with another CA: %v", err)
+	}
+	err = connectTLS(f, &gomongo.ClientOptions{
+		TLSCAs:                      newTestCA(t).pool,
+		TLSAllowInvalidCertificates: true,
+	})
+	if err != nil {
+		t.Errorf("connecting with another CA, allowing invalid certificates: %v", err)
+	}
+}
+
+func TestTLSInvalidHostname(t *testing.T) {
+	ca := newTestCA(t)
+	f := newTLSFakeServer(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCertificate(t, nil, "other.example")},
+	})
+
+	err := connectTLS(f, &gomongo.ClientOptions{
+		TLSCAs: ca.pool,
+	})
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("connecting to a server with a certificate for another host: %v", err)
+	}
+	err = connectTLS(f, &gomongo.ClientOptions{
+		TLSCAs:                   ca.pool,
+		TLSAllowInvalidHostnames: true,
+	})
+	if err != nil {
+		t.Errorf("connecting, allowing invalid hostnames: %v", err)
+	}
+	err = connectTLS(f, &gomongo.ClientOptions{
+		TLSCAs:        ca.pool,
+		TLSServerName: "other.example",
+	})
+	if err != nil {
+		t.Errorf("connecting with the certificate's server name: %v", err)
+	}
+
+	// the chain is still verified when only the hostname is let go
+	err = connectTLS(f, &gomongo.ClientOptions{
+		TLSCAs:                   newTestCA(t).pool,
+		TLSAllowInvalidHostnames: true,
+	})
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("connecting with another CA, allowing invalid hostnames: %v", err)
+	}
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	f := newTLSFakeServer(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCertificate(t, []net.IP{net.IPv4(127, 0, 0, 1)})},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	})
+
+	err := connectTLS(f, &gomongo.ClientOptions{
+		TLSCAs: ca.pool,
+	})
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("connecting without a client certificate: %v", err)
+	}
+
+	client := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	err = connectTLS(f, &gomongo.ClientOptions{
+		TLSCAs:          ca.pool,
+		TLSCertificates: []tls.Certificate{client},
+	})
+	if err != nil {
+		t.Errorf("connecting with a client certificate: %v", err)
+	}
+}
+
+// TestTLSCAFile checks that the CA file is added to a copy of the caller's
+// pool, for each client, rather than to the pool itself.
+func TestTLSCAFile(t *testing.T) {
+	ca := newTestCA(t)
+	f := newTLSFakeServer(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCertificate(t, []net.IP{net.IPv4(127, 0, 0, 1)})},
+	})
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := newTestCA(t).pool
+	before := pool.Clone()
+	for i := 0; i < 2; i++ {
+		err = connectTLS(f, &gomongo.ClientOptions{
+			TLSCAs:    pool,
+			TLSCAFile: caFile,
+		})
+		if err != nil {
+			t.Errorf("connecting with the CA file: %v", err)
+		}
+	}
+	if !pool.Equal(before) {
+		t.Error("the CA file was added to the caller's pool")
+	}
+	err = connectTLS(f, &gomongo.ClientOptions{
+		TLSCAs: pool,
+	})
+	if err == nil {
+		t.Error("connected with the caller's pool alone")
+	}
+}
@@ -0,0 +1,313 @@
+package gomongo
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ServerKind is the role a server plays in the deployment.
+type ServerKind int
+
+const (
+	// ServerUnknown is a server that hasn't been checked yet, or whose last
+	// check failed.
+	ServerUnknown ServerKind = iota
+	ServerStandalone
+	ServerMongos
+	ServerRSPrimary
+	ServerRSSecondary
+	ServerRSArbiter
+	// ServerRSOther is a replica set member that is neither of the above,
+	// such as one that is starting up or recovering.
+	ServerRSOther
+	// ServerRSGhost is a member of a replica set that isn't initiated yet.
+	ServerRSGhost
+	// ServerLoadBalancer is the load balancer in front of mongos routers.
+	ServerLoadBalancer
+)
+
+var serverKindNames = []string{
+	"Unknown",
+	"Standalone",
+	"Mongos",
+	"RSPrimary",
+	"RSSecondary",
+	"RSArbiter",
+	"RSOther",
+	"RSGhost",
+	"LoadBalancer",
+}
+
+func (k ServerKind) String() string {
+	if k < 0 || int(k) >= len(serverKindNames) {
+		return "Unknown"
+	}
+	return serverKindNames[k]
+}
+
+// TopologyKind is the kind of deployment the client is connected to.
+type TopologyKind int
+
+const (
+	// TopologyUnknown is a deployment that hasn't been told apart yet.
+	TopologyUnknown TopologyKind = iota
+	// TopologySingle is a standalone server, or a server the client was told
+	// to connect to directly.
+	TopologySingle
+	TopologyReplicaSetNoPrimary
+	TopologyReplicaSetWithPrimary
+	TopologySharded
+	TopologyLoadBalanced
+)
+
+var topologyKindNames = []string{
+	"Unknown",
+	"Single",
+	"ReplicaSetNoPrimary",
+	"ReplicaSetWithPrimary",
+	"Sharded",
+	"LoadBalanced",
+}
+
+func (k TopologyKind) String() string {
+	if k < 0 || int(k) >= len(topologyKindNames) {
+		return "Unknown"
+	}
+	return topologyKindNames[k]
+}
+
+// topology keeps the description of every server of the deployment, and
+// works out the kind of deployment from them as they come in. The servers to
+// monitor change with it: members are added and removed as primaries report
+// them, and servers that turn out not to belong are dropped.
+type topology struct {
+	kind    TopologyKind
+	setName string
+	// the number of servers in the seed list
+	seeds int
+	// the highest setVersion and electionId of any primary so far, which
+	// tell stale primaries apart from the current one
+	maxSetVersion int64
+	maxElectionID bson.ObjectId
+	servers       map[string]*ServerDescription
+	// why the last server was removed
+	err error
+}
+
+func newTopology(options *ClientOptions, seeds []string) *topology {
+	t := &topology{
+		kind:    TopologyUnknown,
+		setName: options.ReplicaSet,
+		seeds:   len(seeds),
+		servers: make(map[string]*ServerDescription),
+	}
+	switch {
+	case options.loadBalanced():
+		t.kind = TopologyLoadBalanced
+	case options.DirectConnection != nil && *options.DirectConnection:
+		t.kind = TopologySingle
+	case options.ReplicaSet != "":
+		t.kind = TopologyReplicaSetNoPrimary
+	}
+	for _, seed := range seeds {
+		t.servers[seed] = unknownDescription(seed, nil)
+	}
+	return t
+}
+
+// update records the latest description of a server. Descriptions of
+// servers that were removed in the meantime are ignored.
+func (t *topology) update(d *ServerDescription) {
+	if _, ok := t.servers[d.Address]; !ok {
+		return
+	}
+	t.servers[d.Address] = d
+
+	switch t.kind {
+	case TopologySingle:
+		if t.setName != "" && d.Kind != ServerUnknown && d.SetName != t.setName {
+			t.servers[d.Address] = unknownDescription(d.Address, MongoError{
+				message: "Server " + d.Address + " is not a member of replica set " + t.setName,
+			})
+		}
+	case TopologyUnknown:
+		switch d.Kind {
+		case ServerStandalone:
+			// a standalone is all there is to a single seed, and doesn't
+			// belong with the others otherwise
+			if t.seeds == 1 {
+				t.kind = TopologySingle
+			} else {
+				t.remove(d.Address, "is a standalone server")
+			}
+		case ServerMongos:
+			t.kind = TopologySharded
+		case ServerRSPrimary, ServerRSSecondary, ServerRSArbiter, ServerRSOther:
+			t.kind = TopologyReplicaSetNoPrimary
+			t.updateReplicaSet(d)
+		}
+	case TopologySharded:
+		if d.Kind != ServerUnknown && d.Kind != ServerMongos {
+			t.remove(d.Address, "is not a mongos router")
+		}
+	case TopologyReplicaSetNoPrimary, TopologyReplicaSetWithPrimary:
+		t.updateReplicaSet(d)
+	}
+}
+
+// updateReplicaSet handles the description of a server of a replica set.
+func (t *topology) updateReplicaSet(d *ServerDescription) {
+	switch d.Kind {
+	case ServerStandalone, ServerMongos:
+		t.remove(d.Address, "is not a replica set member")
+	case ServerRSPrimary:
+		t.updateFromPrimary(d)
+	case ServerRSSecondary, ServerRSArbiter, ServerRSOther:
+		t.updateFromMember(d)
+	}
+	t.checkPrimary()
+}
+
+// updateFromPrimary takes the members of the replica set from a primary,
+// unless it belongs to another replica set or was elected before the
+// primary we know about.
+func (t *topology) updateFromPrimary(d *ServerDescription) {
+	if t.setName == "" {
+		t.setName = d.SetName
+	} else if d.SetName != t.setName {
+		t.remove(d.Address, "is not a member of replica set "+t.setName)
+		return
+	}
+	if t.stale(d) {
+		t.servers[d.Address] = unknownDescription(d.Address, MongoError{
+			message: "Server " + d.Address + " is a stale primary",
+		})
+		return
+	}
+
+	// there can only be one primary, so any other is out of date
+	for address, server := range t.servers {
+		if address != d.Address && server.Kind == ServerRSPrimary {
+			t.servers[address] = unknownDescription(address, nil)
+		}
+	}
+	members := make(map[string]bool)
+	for _, member := range d.members() {
+		members[member] = true
+		if t.servers[member] == nil {
+			t.servers[member] = unknownDescription(member, nil)
+		}
+	}
+	for address := range t.servers {
+		if !members[address] {
+			t.remove(address, "is no longer a member of replica set "+t.setName)
+		}
+	}
+}
+
+// stale returns whether a primary was elected before the latest primary we
+// know about, and records its election as the latest otherwise. From
+// MongoDB 6.0, elections are ordered by electionId and then by setVersion;
+// before that, by setVersion and then by electionId. Missing values come
+// before any other.
+func (t *topology) stale(d *ServerDescription) bool {
+	if d.MaxWireVersion >= 17 {
+		if t.maxElectionID > d.ElectionID ||
+			t.maxElectionID == d.ElectionID && t.maxSetVersion > d.SetVersion {
+			return true
+		}
+		t.maxElectionID = d.ElectionID
+		t.maxSetVersion = d.SetVersion
+		return false
+	}
+
+	if d.SetVersion != 0 && d.ElectionID != "" {
+		if t.maxSetVersion > d.SetVersion ||
+			t.maxSetVersion == d.SetVersion && t.maxElectionID > d.ElectionID {
+			return true
+		}
+		t.maxElectionID = d.ElectionID
+	}
+	if d.SetVersion > t.maxSetVersion {
+		t.maxSetVersion = d.SetVersion
+	}
+	return false
+}
+
+// updateFromMember handles a replica set member other than the primary. The
+// members it knows about are added while there is no primary to tell us
+// who they are.
+func (t *topology) updateFromMember(d *ServerDescription) {
+	if t.setName == "" {
+		t.setName = d.SetName
+	} else if d.SetName != t.setName {
+		t.remove(d.Address, "is not a member of replica set "+t.setName)
+		return
+	}
+	// the member is known to the replica set by another address
+	if d.Me != "" && d.Me != d.Address {
+		t.remove(d.Address, "is known to the replica set as "+d.Me)
+		return
+	}
+	if t.kind == TopologyReplicaSetNoPrimary {
+		for _, member := range d.members() {
+			if t.servers[member] == nil {
+				t.servers[member] = unknownDescription(member, nil)
+			}
+		}
+	}
+}
+
+// checkPrimary sets the kind of a replica set by whether it has a primary.
+func (t *topology) checkPrimary() {
+	t.kind = TopologyReplicaSetNoPrimary
+	for _, server := range t.servers {
+		if server.Kind == ServerRSPrimary {
+			t.kind = TopologyReplicaSetWithPrimary
+			return
+		}
+	}
+}
+
+// remove stops monitoring a server that doesn't belong to the deployment.
+func (t *topology) remove(address string, reason string) {
+	delete(t.servers, address)
+	t.err = MongoError{
+		message: "Server " + address + " " + reason,
+	}
+}
+
+// discovered returns whether every server has been checked at least once.
+// If none of them could be used, it returns why.
+func (t *topology) discovered() (bool, error) {
+	var err error
+	for _, server := range t.servers {
+		if server.UpdatedAt.IsZero() {
+			return false, nil
+		}
+		if server.Error != nil {
+			err = server.Error
+		}
+	}
+	if t.known() {
+		return true, nil
+	}
+	if err == nil {
+		err = t.err
+	}
+	if err == nil {
+		err = MongoError{
+			message: "No servers available",
+		}
+	}
+	return true, err
+}
+
+// known returns whether any server's kind is known.
+func (t *topology) known() bool {
+	for _, server := range t.servers {
+		if server.Kind != ServerUnknown {
+			return true
+		}
+	}
+	return false
+}
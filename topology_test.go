@@ -0,0 +1,235 @@
+package gomongo
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"testing"
+)
+
+// check is the reply of a server to a check, or nil if the check failed.
+type check struct {
+	address string
+	hello   bson.M
+}
+
+// describe turns a check into the description the monitor would make of it.
+func describe(t *testing.T, c check) *ServerDescription {
+	if c.hello == nil {
+		return unknownDescription(c.address, MongoError{message: "check failed"})
+	}
+	data, err := bson.Marshal(c.hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &ServerDescription{}
+	err = bson.Unmarshal(data, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.init(c.address)
+	return d
+}
+
+// primary and secondary return the replies of replica set members.
+func primary(hosts []string, setVersion int, electionID string, wireVersion int) bson.M {
+	return bson.M{
+		"ismaster":       true,
+		"setName":        "rs",
+		"hosts":          hosts,
+		"setVersion":     setVersion,
+		"electionId":     bson.ObjectIdHex(electionID),
+		"maxWireVersion": wireVersion,
+	}
+}
+
+func secondary(hosts []string) bson.M {
+	return bson.M{
+		"secondary":      true,
+		"setName":        "rs",
+		"hosts":          hosts,
+		"maxWireVersion": 13,
+	}
+}
+
+const (
+	election1 = "000000000000000000000001"
+	election2 = "000000000000000000000002"
+)
+
+func TestTopologyUpdate(t *testing.T) {
+	abc := []string{"a:1", "b:1", "c:1"}
+	tests := []struct {
+		name       string
+		replicaSet string
+		seeds      []string
+		checks     []check
+		kind       TopologyKind
+		servers    map[string]ServerKind
+	}{{
+		name:    "standalone",
+		seeds:   []string{"a:1"},
+		checks:  []check{{"a:1", bson.M{}}},
+		kind:    TopologySingle,
+		servers: map[string]ServerKind{"a:1": ServerStandalone},
+	}, {
+		name:    "standalone among other seeds",
+		seeds:   []string{"a:1", "b:1"},
+		checks:  []check{{"a:1", bson.M{}}},
+		kind:    TopologyUnknown,
+		servers: map[string]ServerKind{"b:1": ServerUnknown},
+	}, {
+		name:  "mongos",
+		seeds: []string{"a:1", "b:1"},
+		checks: []check{
+			{"a:1", bson.M{"msg": "isdbgrid"}},
+			{"b:1", secondary(abc)},
+		},
+		kind:    TopologySharded,
+		servers: map[string]ServerKind{"a:1": ServerMongos},
+	}, {
+		name:    "ghost",
+		seeds:   []string{"a:1", "b:1"},
+		checks:  []check{{"a:1", bson.M{"isreplicaset": true}}},
+		kind:    TopologyUnknown,
+		servers: map[string]ServerKind{"a:1": ServerRSGhost, "b:1": ServerUnknown},
+	}, {
+		name:  "mongos in a replica set",
+		seeds: []string{"a:1"},
+		checks: []check{
+			{"a:1", primary(abc, 1, election1, 13)},
+			{"b:1", bson.M{"msg": "isdbgrid"}},
+		},
+		kind:    TopologyReplicaSetWithPrimary,
+		servers: map[string]ServerKind{"a:1": ServerRSPrimary, "c:1": ServerUnknown},
+	}, {
+		name:   "primary reports the members",
+		seeds:  []string{"a:1"},
+		checks: []check{{"a:1", primary(abc, 1, election1, 13)}},
+		kind:   TopologyReplicaSetWithPrimary,
+		servers: map[string]ServerKind{
+			"a:1": ServerRSPrimary, "b:1": ServerUnknown, "c:1": ServerUnknown,
+		},
+	}, {
+		name:  "primary removes a member",
+		seeds: []string{"a:1"},
+		checks: []check{
+			{"a:1", primary(abc, 1, election1, 13)},
+			{"c:1", secondary(abc)},
+			{"a:1", primary([]string{"a:1", "b:1"}, 2, election1, 13)},
+		},
+		kind:    TopologyReplicaSetWithPrimary,
+		servers: map[string]ServerKind{"a:1": ServerRSPrimary, "b:1": ServerUnknown},
+	}, {
+		name:  "secondaries add members without a primary",
+		seeds: []string{"b:1"},
+		checks: []check{
+			{"b:1", secondary(abc)},
+		},
+		kind: TopologyReplicaSetNoPrimary,
+		servers: map[string]ServerKind{
+			"a:1": ServerUnknown, "b:1": ServerRSSecondary, "c:1": ServerUnknown,
+		},
+	}, {
+		name:       "member of another replica set",
+		replicaSet: "other",
+		seeds:      []string{"a:1", "b:1"},
+		checks:     []check{{"a:1", secondary(abc)}},
+		kind:       TopologyReplicaSetNoPrimary,
+		servers:    map[string]ServerKind{"b:1": ServerUnknown},
+	}, {
+		name:  "member known by another address",
+		seeds: []string{"a:1", "b:1"},
+		checks: []check{
+			{"b:1", bson.M{"secondary": true, "setName": "rs", "hosts": abc, "me": "c:1"}},
+		},
+		kind:    TopologyReplicaSetNoPrimary,
+		servers: map[string]ServerKind{"a:1": ServerUnknown},
+	}, {
+		name:   "hidden member",
+		seeds:  []string{"a:1"},
+		checks: []check{{"a:1", bson.M{"secondary": true, "hidden": true, "setName": "rs"}}},
+		kind:   TopologyReplicaSetNoPrimary,
+		servers: map[string]ServerKind{
+			"a:1": ServerRSOther,
+		},
+	}, {
+		name:  "new primary",
+		seeds: []string{"a:1"},
+		checks: []check{
+			{"a:1", primary(abc, 1, election1, 17)},
+			{"b:1", primary(abc, 1, election2, 17)},
+		},
+		kind: TopologyReplicaSetWithPrimary,
+		servers: map[string]ServerKind{
+			"a:1": ServerUnknown, "b:1": ServerRSPrimary, "c:1": ServerUnknown,
+		},
+	}, {
+		name:  "stale primary by electionId",
+		seeds: []string{"a:1"},
+		checks: []check{
+			{"a:1", primary(abc, 1, election2, 17)},
+			{"b:1", primary(abc, 2, election1, 17)},
+		},
+		kind: TopologyReplicaSetWithPrimary,
+		servers: map[string]ServerKind{
+			"a:1": ServerRSPrimary, "b:1": ServerUnknown, "c:1": ServerUnknown,
+		},
+	}, {
+		name:  "stale primary by setVersion before 6.0",
+		seeds: []string{"a:1"},
+		checks: []check{
+			{"a:1", primary(abc, 2, election1, 13)},
+			{"b:1", primary(abc, 1, election2, 13)},
+		},
+		kind: TopologyReplicaSetWithPrimary,
+		servers: map[string]ServerKind{
+			"a:1": ServerRSPrimary, "b:1": ServerUnknown, "c:1": ServerUnknown,
+		},
+	}, {
+		name:  "primary lost",
+		seeds: []string{"a:1"},
+		checks: []check{
+			{"a:1", primary(abc, 1, election1, 13)},
+			{"a:1", nil},
+		},
+		kind: TopologyReplicaSetNoPrimary,
+		servers: map[string]ServerKind{
+			"a:1": ServerUnknown, "b:1": ServerUnknown, "c:1": ServerUnknown,
+		},
+	}}
+
+	for _, test := range tests {
+		topology := newTopology(&ClientOptions{ReplicaSet: test.replicaSet}, test.seeds)
+		for _, c := range test.checks {
+			topology.update(describe(t, c))
+		}
+		servers := make(map[string]ServerKind)
+		for address, server := range topology.servers {
+			servers[address] = server.Kind
+		}
+		if topology.kind != test.kind || !reflect.DeepEqual(servers, test.servers) {
+			t.Errorf("%v: %v with %v, want %v with %v", test.name, topology.kind, servers, test.kind, test.servers)
+		}
+	}
+}
+
+func TestTopologyDiscovered(t *testing.T) {
+	topology := newTopology(&ClientOptions{}, []string{"a:1", "b:1"})
+	if discovered, _ := topology.discovered(); discovered || topology.known() {
+		t.Error("discovered before any check")
+	}
+	topology.update(describe(t, check{"a:1", bson.M{"msg": "isdbgrid"}}))
+	if discovered, _ := topology.discovered(); discovered || !topology.known() {
+		t.Error("discovered before every seed was checked")
+	}
+	topology.update(describe(t, check{"b:1", nil}))
+	if discovered, err := topology.discovered(); !discovered || err != nil {
+		t.Errorf("discovered %v: %v", discovered, err)
+	}
+
+	topology = newTopology(&ClientOptions{}, []string{"a:1"})
+	topology.update(describe(t, check{"a:1", nil}))
+	if discovered, err := topology.discovered(); !discovered || err == nil {
+		t.Errorf("no usable server discovered %v: %v", discovered, err)
+	}
+}
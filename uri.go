@@ -0,0 +1,449 @@
+package gomongo
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	uriScheme   = "mongodb://"
+	defaultPort = "27017"
+)
+
+// ParseURI parses a mongodb:// connection string into client options:
+//
+//	mongodb://[username:password@]host1[:port1][,...hostN[:portN]][/[database][?options]]
+//
+// The username, password and database are percent-decoded, and options are
+// matched case-insensitively. Options the driver doesn't know are ignored,
+// as the connection string spec asks, but known options with invalid values
+// and options that conflict with each other are errors.
+//
+// A mongodb+srv:// connection string has a single host without a port,
+// which sets SRVHost. The seed list is looked up when connecting, and TLS is
+// on unless the connection string turns it off.
+func ParseURI(uri string) (*ClientOptions, error) {
+	srv := strings.HasPrefix(uri, srvScheme)
+	if !srv && !strings.HasPrefix(uri, uriScheme) {
+		return nil, fmt.Errorf("connection string must start with %v or %v", uriScheme, srvScheme)
+	}
+	rest := uri[len(uriScheme):]
+	if srv {
+		rest = uri[len(srvScheme):]
+	}
+
+	hostPart := rest
+	path := ""
+	slash := strings.Index(rest, "/")
+	if slash >= 0 {
+		hostPart = rest[:slash]
+		path = rest[slash+1:]
+	} else if strings.Contains(rest, "?") {
+		return nil, fmt.Errorf("connection string options must follow a slash")
+	}
+
+	options := &ClientOptions{}
+
+	at := strings.LastIndex(hostPart, "@")
+	if at >= 0 {
+		credential, err := parseUserInfo(hostPart[:at])
+		if err != nil {
+			return nil, err
+		}
+		options.Auth = credential
+		hostPart = hostPart[at+1:]
+	}
+
+	if srv {
+		srvHost, err := parseSRVHost(hostPart)
+		if err != nil {
+			return nil, err
+		}
+		options.SRVHost = srvHost
+		options.TLS = true
+	} else {
+		if hostPart == "" {
+			return nil, fmt.Errorf("connection string has no hosts")
+		}
+		for _, host := range strings.Split(hostPart, ",") {
+			address, err := parseHost(host)
+			if err != nil {
+				return nil, err
+			}
+			options.Hosts = append(options.Hosts, address)
+		}
+	}
+
+	query := ""
+	question := strings.Index(path, "?")
+	if question >= 0 {
+		query = path[question+1:]
+		path = path[:question]
+	}
+	if path != "" {
+		database, err := url.PathUnescape(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid database name %v: %v", path, err)
+		}
+		options.Database = database
+	}
+
+	err := parseURIOptions(query, options)
+	if err != nil {
+		return nil, err
+	}
+
+	err = options.validate()
+	if err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// parseUserInfo decodes the "username[:password]" part of a connection
+// string.
+func parseUserInfo(userInfo string) (*Credential, error) {
+	username := userInfo
+	password := ""
+	passwordSet := false
+	colon := strings.Index(userInfo, ":")
+	if colon >= 0 {
+		username = userInfo[:colon]
+		password = userInfo[colon+1:]
+		passwordSet = true
+	}
+	// reserved characters in credentials have to be percent-encoded
+	if strings.ContainsAny(username, "@/") || strings.ContainsAny(password, ":@/") {
+		return nil, fmt.Errorf("username and password must have :, @ and / percent-encoded")
+	}
+
+	var err error
+	username, err = url.PathUnescape(username)
+	if err != nil {
+		return nil, fmt.Errorf("invalid username: %v", err)
+	}
+	if username == "" {
+		return nil, fmt.Errorf("connection string has an empty username")
+	}
+	password, err = url.PathUnescape(password)
+	if err != nil {
+		return nil, fmt.Errorf("invalid password: %v", err)
+	}
+	return &Credential{
+		Username:    username,
+		Password:    password,
+		PasswordSet: passwordSet,
+	}, nil
+}
+
+// parseHost checks a "host[:port]" address, including bracketed IPv6
+// addresses, and returns it with the default port filled in.
+func parseHost(host string) (string, error) {
+	if host == "" {
+		return "", fmt.Errorf("empty host in connection string")
+	}
+
+	name := host
+	port := defaultPort
+	if strings.HasPrefix(host, "[") {
+		end := strings.Index(host, "]")
+		if end < 0 {
+			return "", fmt.Errorf("invalid host %v: missing ]", host)
+		}
+		name = host[1:end]
+		switch after := host[end+1:]; {
+		case after == "":
+		case strings.HasPrefix(after, ":"):
+			port = after[1:]
+		default:
+			return "", fmt.Errorf("invalid host %v", host)
+		}
+	} else {
+		switch strings.Count(host, ":") {
+		case 0:
+		case 1:
+			colon := strings.Index(host, ":")
+			name = host[:colon]
+			port = host[colon+1:]
+		default:
+			return "", fmt.Errorf("invalid host %v: IPv6 addresses must be in brackets", host)
+		}
+	}
+
+	if name == "" {
+		return "", fmt.Errorf("invalid host %v", host)
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 1 || portNumber > 65535 {
+		return "", fmt.Errorf("invalid port in host %v", host)
+	}
+	return net.JoinHostPort(strings.ToLower(name), port), nil
+}
+
+// parseURIOptions applies the options in the query part of a connection
+// string. Later occurrences of an option override earlier ones, except for
+// readPreferenceTags, which collect a tag set each.
+func parseURIOptions(query string, options *ClientOptions) error {
+	if query == "" {
+		return nil
+	}
+
+	var tls, ssl string
+	authSource, authSourceSet := "", false
+	authMechanism := ""
+	var authProperties map[string]string
+
+	for _, pair := range strings.Split(query, "&") {
+		if pair == "" {
+			continue
+		}
+		equals := strings.Index(pair, "=")
+		if equals < 0 {
+			return fmt.Errorf("connection string option %v has no value", pair)
+		}
+		name := pair[:equals]
+		key := strings.ToLower(name)
+		value, err := url.PathUnescape(pair[equals+1:])
+		if err != nil {
+			return fmt.Errorf("invalid value for %v: %v", name, err)
+		}
+
+		switch key {
+		case "replicaset":
+			options.ReplicaSet = value
+		case "directconnection":
+			direct, err := parseBoolOption(name, value)
+			if err != nil {
+				return err
+			}
+			options.DirectConnection = &direct
+		case "loadbalanced":
+			loadBalanced, err := parseBoolOption(name, value)
+			if err != nil {
+				return err
+			}
+			options.LoadBalanced = &loadBalanced
+		case "appname":
+			options.AppName = value
+		case "proxyhost":
+			options.ProxyHost = value
+		case "proxyport":
+			options.ProxyPort, err = parseIntOption(name, value)
+		case "proxyusername":
+			options.ProxyUsername = value
+		case "proxypassword":
+			options.ProxyPassword = value
+
+		case "tls":
+			tls = value
+		case "ssl":
+			ssl = value
+		case "tlscafile":
+			options.TLSCAFile = value
+		case "tlscertificatekeyfile":
+			options.TLSCertificateKeyFile = value
+		case "tlscertificatekeyfilepassword":
+			return fmt.Errorf("encrypted client certificate keys are not supported")
+		case "tlsinsecure":
+			options.TLSInsecure, err = parseBoolOption(name, value)
+			if err != nil {
+				return err
+			}
+		case "tlsallowinvalidcertificates":
+			options.TLSAllowInvalidCertificates, err = parseBoolOption(name, value)
+			if err != nil {
+				return err
+			}
+		case "tlsallowinvalidhostnames":
+			options.TLSAllowInvalidHostnames, err = parseBoolOption(name, value)
+			if err != nil {
+				return err
+			}
+		case "tlsdisableocspendpointcheck", "tlsdisablecertificaterevocationcheck":
+			// revocation is never checked, so there is nothing to turn off
+			_, err := parseBoolOption(name, value)
+			if err != nil {
+				return err
+			}
+
+		case "authsource":
+			authSource, authSourceSet = value, true
+		case "authmechanism":
+			authMechanism = strings.ToUpper(value)
+		case "authmechanismproperties":
+			authProperties, err = parseKeyValueList(name, value)
+			if err != nil {
+				return err
+			}
+
+		case "readpreference":
+			options.ReadPreference = value
+		case "readpreferencetags":
+			tags := map[string]string{}
+			if value != "" {
+				tags, err = parseKeyValueList(name, value)
+				if err != nil {
+					return err
+				}
+			}
+			options.ReadPreferenceTags = append(options.ReadPreferenceTags, tags)
+		case "maxstalenessseconds":
+			seconds, err := parseIntOption(name, value)
+			if err != nil {
+				return err
+			}
+			if seconds == -1 {
+				options.MaxStaleness = 0
+			} else {
+				options.MaxStaleness = time.Duration(seconds) * time.Second
+			}
+
+		case "w":
+			writeConcern := options.writeConcern()
+			number, err := strconv.Atoi(value)
+			if err == nil {
+				writeConcern.W = number
+			} else {
+				writeConcern.W = value
+			}
+		case "journal":
+			journal, err := parseBoolOption(name, value)
+			if err != nil {
+				return err
+			}
+			options.writeConcern().Journal = &journal
+		case "wtimeoutms":
+			options.writeConcern().WTimeout, err = parseDurationOption(name, value)
+			if err != nil {
+				return err
+			}
+
+		case "maxpoolsize":
+			options.MaxPoolSize, err = parseIntOption(name, value)
+		case "minpoolsize":
+			options.MinPoolSize, err = parseIntOption(name, value)
+		case "maxconnecting":
+			options.MaxConnecting, err = parseIntOption(name, value)
+		case "waitqueuetimeoutms":
+			options.WaitQueueTimeout, err = parseDurationOption(name, value)
+		case "maxidletimems":
+			options.MaxIdleTime, err = parseDurationOption(name, value)
+
+		case "compressors":
+			options.Compressors = strings.Split(value, ",")
+		case "zlibcompressionlevel":
+			options.ZlibCompressionLevel, err = parseIntOption(name, value)
+
+		case "connecttimeoutms":
+			options.ConnectTimeout, err = parseDurationOption(name, value)
+		case "sockettimeoutms":
+			options.SocketTimeout, err = parseDurationOption(name, value)
+		case "serverselectiontimeoutms":
+			options.ServerSelectionTimeout, err = parseDurationOption(name, value)
+		case "heartbeatfrequencyms":
+			options.HeartbeatInterval, err = parseDurationOption(name, value)
+		case "localthresholdms":
+			threshold, err := parseDurationOption(name, value)
+			if err != nil {
+				return err
+			}
+			options.LocalThreshold = &threshold
+
+		case "srvservicename":
+			options.SRVServiceName = value
+		case "srvmaxhosts":
+			options.SRVMaxHosts, err = parseIntOption(name, value)
+
+		case "retrywrites":
+			retry, err := parseBoolOption(name, value)
+			if err != nil {
+				return err
+			}
+			options.RetryWrites = &retry
+		case "retryreads":
+			retry, err := parseBoolOption(name, value)
+			if err != nil {
+				return err
+			}
+			options.RetryReads = &retry
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if tls != "" && ssl != "" && tls != ssl {
+		return fmt.Errorf("tls and ssl options conflict")
+	}
+	if tls == "" {
+		tls = ssl
+	}
+	if tls != "" {
+		var err error
+		options.TLS, err = parseBoolOption("tls", tls)
+		if err != nil {
+			return err
+		}
+	} else if options.TLSCAFile != "" || options.TLSCertificateKeyFile != "" || options.TLSInsecure ||
+		options.TLSAllowInvalidHostnames || options.TLSAllowInvalidCertificates {
+		// the other tls options imply tls=true
+		options.TLS = true
+	}
+
+	// an authSource alone, without credentials, doesn't turn on authentication
+	if authMechanism != "" || authProperties != nil || (authSourceSet && options.Auth != nil) {
+		if options.Auth == nil {
+			options.Auth = &Credential{}
+		}
+		options.Auth.Source = authSource
+		options.Auth.Mechanism = authMechanism
+		options.Auth.MechanismProperties = authProperties
+	}
+	return nil
+}
+
+func parseBoolOption(key string, value string) (bool, error) {
+	switch value {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("%v must be true or false, not %v", key, value)
+}
+
+func parseIntOption(key string, value string) (int, error) {
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%v must be an integer, not %v", key, value)
+	}
+	return number, nil
+}
+
+func parseDurationOption(key string, value string) (time.Duration, error) {
+	ms, err := parseIntOption(key, value)
+	if err != nil {
+		return 0, err
+	}
+	if ms < 0 {
+		return 0, fmt.Errorf("%v can't be negative", key)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// parseKeyValueList parses a "key:value,key:value" option value.
+func parseKeyValueList(key string, value string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		colon := strings.Index(pair, ":")
+		if colon <= 0 {
+			return nil, fmt.Errorf("%v must be a list of key:value pairs, not %v", key, value)
+		}
+		result[pair[:colon]] = pair[colon+1:]
+	}
+	return result, nil
+}
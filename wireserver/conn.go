@@ -0,0 +1,116 @@
+package wireserver
+
+import (
+	"bufio"
+	"github.com/dmliao/gomongo"
+	"github.com/dmliao/gomongo/buffer"
+	"gopkg.in/mgo.v2/bson"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Conn is a client connection being served. Its methods may be called from
+// any goroutine, such as one that streams the batches of an exhaust cursor.
+type Conn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	requestID int32
+
+	writeMu sync.Mutex
+}
+
+// RemoteAddr returns the address of the client.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Conn) nextID() int32 {
+	return atomic.AddInt32(&c.requestID, 1)
+}
+
+// write sends a finished message and releases it.
+func (c *Conn) write(message *buffer.MessageWriter) error {
+	defer message.Release()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(message.Bytes())
+	return err
+}
+
+// startMessage begins a message with the standard header, and returns its
+// request ID. The length is filled in once the message is complete.
+func (c *Conn) startMessage(responseTo int32, opCode int32) (int32, *buffer.MessageWriter) {
+	requestID := c.nextID()
+	message := buffer.NewMessageWriter()
+	message.ReserveInt32()
+	message.WriteInt32(requestID)
+	message.WriteInt32(responseTo)
+	message.WriteInt32(opCode)
+	return requestID, message
+}
+
+// WriteReply sends an OP_REPLY with the flags, cursor ID, starting point and
+// documents of reply, answering the request with ID responseTo. It returns
+// the request ID of the reply, which the next reply of an exhaust stream
+// answers.
+func (c *Conn) WriteReply(responseTo int32, reply *gomongo.OpResponse) (int32, error) {
+	requestID, message := c.startMessage(responseTo, gomongo.OP_REPLY)
+	message.WriteInt32(reply.ResponseFlags)
+	message.WriteInt64(reply.CursorID)
+	message.WriteInt32(reply.StartingFrom)
+	message.WriteInt32(int32(len(reply.Document)))
+	for _, doc := range reply.Document {
+		message.WriteBytes(doc)
+	}
+	message.PatchLength(0)
+	return requestID, c.write(message)
+}
+
+// WriteMsg sends an OP_MSG with the flags and sections of msg, answering the
+// request with ID responseTo. A checksum is added if the flags ask for one.
+// It returns the request ID of the message, which the next message of a
+// moreToCome stream answers.
+func (c *Conn) WriteMsg(responseTo int32, msg *gomongo.OpMsg) (int32, error) {
+	requestID := c.nextID()
+	return requestID, c.write(gomongo.EncodeMsg(requestID, responseTo, msg))
+}
+
+// Respond answers a request with a single document: as the body of an OP_MSG
+// for an OP_MSG, and as an OP_REPLY otherwise. Requests that the client
+// expects no answer to, which are an OP_MSG with the moreToCome flag and the
+// legacy kill cursors, insert, update and delete, are left unanswered.
+func (c *Conn) Respond(request Request, doc interface{}) error {
+	switch r := request.(type) {
+	case *gomongo.OpKillCursors, *gomongo.OpInsert, *gomongo.OpUpdate, *gomongo.OpDelete:
+		return nil
+	case *gomongo.OpMsg:
+		if r.FlagBits&gomongo.MSG_MORE_TO_COME != 0 {
+			return nil
+		}
+	}
+
+	docBytes, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	responseTo := request.MessageHeader().RequestID
+	if _, ok := request.(*gomongo.OpMsg); ok {
+		_, err = c.WriteMsg(responseTo, &gomongo.OpMsg{
+			Sections: []gomongo.MsgSection{{
+				Kind:      0,
+				Documents: [][]byte{docBytes},
+			}},
+		})
+		return err
+	}
+	_, err = c.WriteReply(responseTo, &gomongo.OpResponse{
+		Document: [][]byte{docBytes},
+	})
+	return err
+}
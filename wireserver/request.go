@@ -0,0 +1,410 @@
+package wireserver
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dmliao/gomongo"
+	"github.com/dmliao/gomongo/buffer"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+)
+
+// DefaultMaxMessageSize is the largest message a server accepts unless told
+// otherwise, the same as the default of mongod.
+const DefaultMaxMessageSize = 48000000
+
+// Request is a message decoded from a client: a *gomongo.OpQuery,
+// *gomongo.OpMsg, *gomongo.OpGetMore, *gomongo.OpKillCursors,
+// *gomongo.OpInsert, *gomongo.OpUpdate or *gomongo.OpDelete. Documents in
+// requests are bson.Raw values, or raw bytes where the type is [][]byte.
+type Request interface {
+	MessageHeader() gomongo.MsgHeader
+}
+
+// ProtocolError is returned when a client sends a message that can't be
+// decoded. The connection can't be used after this.
+type ProtocolError struct {
+	Reason string
+}
+
+func (p ProtocolError) Error() string {
+	return "malformed request: " + p.Reason
+}
+
+// ReadRequest reads one message from a client and decodes it, unwrapping it
+// first if it is an OP_COMPRESSED. Messages longer than maxSize are rejected
+// before they are read. An io.EOF means the client hung up between messages.
+func ReadRequest(reader io.Reader, maxSize int32) (Request, error) {
+	message, err := gomongo.ReadMessage(reader, maxSize)
+	if _, ok := err.(gomongo.FramingError); ok {
+		return nil, protocolError(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	request, err := decodeRequest(message.Header, message.HeaderBytes, message.Contents)
+	if err != nil {
+		return nil, protocolError(err)
+	}
+	return request, nil
+}
+
+// ReadReply reads one message from a server and decodes it, the same way as
+// ReadRequest. The reply is a *gomongo.OpResponse or a *gomongo.OpMsg.
+func ReadReply(reader io.Reader, maxSize int32) (gomongo.Reply, error) {
+	message, err := gomongo.ReadMessage(reader, maxSize)
+	if _, ok := err.(gomongo.FramingError); ok {
+		return nil, protocolError(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var reply gomongo.Reply
+	switch message.Header.OpCode {
+	case gomongo.OP_REPLY:
+		reply, err = gomongo.DecodeReply(message.Header, message.Contents)
+	case gomongo.OP_MSG:
+		reply, err = gomongo.DecodeMsg(message.Header, message.HeaderBytes, message.Contents)
+	default:
+		err = ProtocolError{
+			Reason: fmt.Sprintf("unsupported opcode %v in reply", message.Header.OpCode),
+		}
+	}
+	if err != nil {
+		return nil, protocolError(err)
+	}
+	return reply, nil
+}
+
+// WriteRequest encodes a request the way a client sends it, with the request
+// ID of its header, and writes it. It is the counterpart of ReadRequest, for
+// passing requests on to a server. An OP_MSG is given a new checksum if its
+// flags ask for one, since the request may have been changed.
+func WriteRequest(writer io.Writer, request Request) error {
+	header := request.MessageHeader()
+	if msg, ok := request.(*gomongo.OpMsg); ok {
+		message := gomongo.EncodeMsg(header.RequestID, 0, msg)
+		defer message.Release()
+		_, err := writer.Write(message.Bytes())
+		return err
+	}
+
+	message := buffer.NewMessageWriter()
+	defer message.Release()
+	message.ReserveInt32()
+	message.WriteInt32(header.RequestID)
+	message.WriteInt32(0)
+
+	switch r := request.(type) {
+	case *gomongo.OpQuery:
+		message.WriteInt32(gomongo.OP_QUERY)
+		message.WriteInt32(r.Flags)
+		message.WriteCString(r.FullCollectionName)
+		message.WriteInt32(r.NumberToSkip)
+		message.WriteInt32(r.NumberToReturn)
+		err := writeDocument(message, r.Query)
+		if err != nil {
+			return err
+		}
+		if r.Projection != nil {
+			err = writeDocument(message, r.Projection)
+			if err != nil {
+				return err
+			}
+		}
+	case *gomongo.OpGetMore:
+		message.WriteInt32(gomongo.OP_GET_MORE)
+		message.WriteInt32(0)
+		message.WriteCString(r.FullCollectionName)
+		message.WriteInt32(r.NumberToReturn)
+		message.WriteInt64(r.CursorID)
+	case *gomongo.OpKillCursors:
+		message.WriteInt32(gomongo.OP_KILL_CURSORS)
+		message.WriteInt32(0)
+		message.WriteInt32(int32(len(r.CursorIDs)))
+		for _, id := range r.CursorIDs {
+			message.WriteInt64(id)
+		}
+	case *gomongo.OpInsert:
+		message.WriteInt32(gomongo.OP_INSERT)
+		message.WriteInt32(r.Flags)
+		message.WriteCString(r.FullCollectionName)
+		for _, doc := range r.Documents {
+			message.WriteBytes(doc)
+		}
+	case *gomongo.OpUpdate:
+		message.WriteInt32(gomongo.OP_UPDATE)
+		message.WriteInt32(0)
+		message.WriteCString(r.FullCollectionName)
+		message.WriteInt32(r.Flags)
+		err := writeDocument(message, r.Selector)
+		if err != nil {
+			return err
+		}
+		err = writeDocument(message, r.Update)
+		if err != nil {
+			return err
+		}
+	case *gomongo.OpDelete:
+		message.WriteInt32(gomongo.OP_DELETE)
+		message.WriteInt32(0)
+		message.WriteCString(r.FullCollectionName)
+		message.WriteInt32(r.Flags)
+		err := writeDocument(message, r.Selector)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("can't encode a request of type %T", request)
+	}
+
+	message.PatchLength(0)
+	_, err := writer.Write(message.Bytes())
+	return err
+}
+
+// writeDocument adds a document to a message, as is if it is a bson.Raw.
+func writeDocument(message *buffer.MessageWriter, doc interface{}) error {
+	if raw, ok := doc.(bson.Raw); ok {
+		message.WriteBytes(raw.Data)
+		return nil
+	}
+	docBytes, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	message.WriteBytes(docBytes)
+	return nil
+}
+
+// protocolError wraps an error from reading or decoding a message in a
+// ProtocolError, unless it already is one.
+func protocolError(err error) error {
+	switch e := err.(type) {
+	case ProtocolError:
+		return err
+	case gomongo.FramingError:
+		return ProtocolError{
+			Reason: e.Reason,
+		}
+	}
+	return ProtocolError{
+		Reason: err.Error(),
+	}
+}
+
+// decodeRequest parses the contents of a message following its header.
+func decodeRequest(header gomongo.MsgHeader, headerBytes []byte, contents []byte) (Request, error) {
+	if header.OpCode == gomongo.OP_MSG {
+		return gomongo.DecodeMsg(header, headerBytes, contents)
+	}
+
+	reader := bytes.NewReader(contents)
+	var request Request
+	var err error
+	switch header.OpCode {
+	case gomongo.OP_QUERY:
+		request, err = decodeQuery(header, reader)
+	case gomongo.OP_GET_MORE:
+		request, err = decodeGetMore(header, reader)
+	case gomongo.OP_KILL_CURSORS:
+		request, err = decodeKillCursors(header, reader)
+	case gomongo.OP_INSERT:
+		request, err = decodeInsert(header, reader)
+	case gomongo.OP_UPDATE:
+		request, err = decodeUpdate(header, reader)
+	case gomongo.OP_DELETE:
+		request, err = decodeDelete(header, reader)
+	default:
+		return nil, ProtocolError{
+			Reason: fmt.Sprintf("unsupported opcode %v", header.OpCode),
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if reader.Len() != 0 {
+		return nil, ProtocolError{
+			Reason: fmt.Sprintf("%v bytes past the end of opcode %v", reader.Len(), header.OpCode),
+		}
+	}
+	return request, nil
+}
+
+// readCString reads a null terminated string from the rest of a message.
+func readCString(reader *bytes.Reader) (string, error) {
+	_, s, err := buffer.ReadNullTerminatedString(reader, int32(reader.Len()))
+	return s, err
+}
+
+// readDocument reads a BSON document from the rest of a message.
+func readDocument(reader *bytes.Reader) (bson.Raw, error) {
+	_, doc, err := buffer.ReadDocumentRaw(reader)
+	if err != nil {
+		return bson.Raw{}, err
+	}
+	return bson.Raw{Kind: 0x03, Data: doc}, nil
+}
+
+func decodeQuery(header gomongo.MsgHeader, reader *bytes.Reader) (*gomongo.OpQuery, error) {
+	var err error
+	query := &gomongo.OpQuery{
+		Header: header,
+	}
+	query.Flags, err = buffer.ReadInt32LE(reader)
+	if err != nil {
+		return nil, err
+	}
+	query.FullCollectionName, err = readCString(reader)
+	if err != nil {
+		return nil, err
+	}
+	query.NumberToSkip, err = buffer.ReadInt32LE(reader)
+	if err != nil {
+		return nil, err
+	}
+	query.NumberToReturn, err = buffer.ReadInt32LE(reader)
+	if err != nil {
+		return nil, err
+	}
+	query.Query, err = readDocument(reader)
+	if err != nil {
+		return nil, err
+	}
+	if reader.Len() > 0 {
+		query.Projection, err = readDocument(reader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return query, nil
+}
+
+func decodeGetMore(header gomongo.MsgHeader, reader *bytes.Reader) (*gomongo.OpGetMore, error) {
+	var err error
+	getMore := &gomongo.OpGetMore{
+		Header: header,
+	}
+	getMore.Reserved, err = buffer.ReadInt32LE(reader)
+	if err != nil {
+		return nil, err
+	}
+	getMore.FullCollectionName, err = readCString(reader)
+	if err != nil {
+		return nil, err
+	}
+	getMore.NumberToReturn, err = buffer.ReadInt32LE(reader)
+	if err != nil {
+		return nil, err
+	}
+	getMore.CursorID, err = buffer.ReadInt64LE(reader)
+	if err != nil {
+		return nil, err
+	}
+	return getMore, nil
+}
+
+func decodeKillCursors(header gomongo.MsgHeader, reader *bytes.Reader) (*gomongo.OpKillCursors, error) {
+	var err error
+	killCursors := &gomongo.OpKillCursors{
+		Header: header,
+	}
+	killCursors.Reserved, err = buffer.ReadInt32LE(reader)
+	if err != nil {
+		return nil, err
+	}
+	killCursors.NumberOfCursorIDs, err = buffer.ReadInt32LE(reader)
+	if err != nil {
+		return nil, err
+	}
+	// checked before allocating, since the count comes from the client
+	if killCursors.NumberOfCursorIDs < 0 || int(killCursors.NumberOfCursorIDs)*8 != reader.Len() {
+		return nil, ProtocolError{
+			Reason: fmt.Sprintf("OP_KILL_CURSORS has %v bytes for %v cursor IDs", reader.Len(),
+				killCursors.NumberOfCursorIDs),
+		}
+	}
+	killCursors.CursorIDs = make([]int64, killCursors.NumberOfCursorIDs)
+	for i := range killCursors.CursorIDs {
+		killCursors.CursorIDs[i], err = buffer.ReadInt64LE(reader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return killCursors, nil
+}
+
+func decodeInsert(header gomongo.MsgHeader, reader *bytes.Reader) (*gomongo.OpInsert, error) {
+	var err error
+	insert := &gomongo.OpInsert{
+		Header: header,
+	}
+	insert.Flags, err = buffer.ReadInt32LE(reader)
+	if err != nil {
+		return nil, err
+	}
+	insert.FullCollectionName, err = readCString(reader)
+	if err != nil {
+		return nil, err
+	}
+	for reader.Len() > 0 {
+		_, doc, err := buffer.ReadDocumentRaw(reader)
+		if err != nil {
+			return nil, err
+		}
+		insert.Documents = append(insert.Documents, doc)
+	}
+	return insert, nil
+}
+
+func decodeUpdate(header gomongo.MsgHeader, reader *bytes.Reader) (*gomongo.OpUpdate, error) {
+	var err error
+	update := &gomongo.OpUpdate{
+		Header: header,
+	}
+	update.Reserved, err = buffer.ReadInt32LE(reader)
+	if err != nil {
+		return nil, err
+	}
+	update.FullCollectionName, err = readCString(reader)
+	if err != nil {
+		return nil, err
+	}
+	update.Flags, err = buffer.ReadInt32LE(reader)
+	if err != nil {
+		return nil, err
+	}
+	update.Selector, err = readDocument(reader)
+	if err != nil {
+		return nil, err
+	}
+	update.Update, err = readDocument(reader)
+	if err != nil {
+		return nil, err
+	}
+	return update, nil
+}
+
+func decodeDelete(header gomongo.MsgHeader, reader *bytes.Reader) (*gomongo.OpDelete, error) {
+	var err error
+	remove := &gomongo.OpDelete{
+		Header: header,
+	}
+	remove.Reserved, err = buffer.ReadInt32LE(reader)
+	if err != nil {
+		return nil, err
+	}
+	remove.FullCollectionName, err = readCString(reader)
+	if err != nil {
+		return nil, err
+	}
+	remove.Flags, err = buffer.ReadInt32LE(reader)
+	if err != nil {
+		return nil, err
+	}
+	remove.Selector, err = readDocument(reader)
+	if err != nil {
+		return nil, err
+	}
+	return remove, nil
+}
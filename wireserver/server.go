@@ -0,0 +1,168 @@
+// Package wireserver implements the server side of the MongoDB wire
+// protocol, for building mocks, proxies and protocol tests. A Server reads
+// requests off client connections and hands them to a Handler, which answers
+// them through the Conn.
+package wireserver
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("wireserver: server closed")
+
+// Handler answers the requests of a client. Requests from one connection
+// are handled one at a time, in the order they arrive. Returning an error
+// closes the connection.
+type Handler interface {
+	Handle(conn *Conn, request Request) error
+}
+
+// CloseHandler may be implemented by a Handler that keeps state for each
+// connection, to be told when a connection it has handled is closed.
+type CloseHandler interface {
+	HandleClose(conn *Conn)
+}
+
+// HandlerFunc adapts a function to a Handler.
+type HandlerFunc func(conn *Conn, request Request) error
+
+func (f HandlerFunc) Handle(conn *Conn, request Request) error {
+	return f(conn, request)
+}
+
+// Server accepts client connections and dispatches their requests to a
+// Handler.
+type Server struct {
+	Handler Handler
+	// MaxMessageSize limits the size of requests. Zero means
+	// DefaultMaxMessageSize.
+	MaxMessageSize int32
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[*Conn]bool
+	closed    bool
+}
+
+// ListenAndServe listens on a TCP address and serves the connections made
+// to it with the handler.
+func ListenAndServe(address string, handler Handler) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	server := &Server{
+		Handler: handler,
+	}
+	return server.Serve(listener)
+}
+
+func (s *Server) maxMessageSize() int32 {
+	if s.MaxMessageSize == 0 {
+		return DefaultMaxMessageSize
+	}
+	return s.MaxMessageSize
+}
+
+// Serve accepts connections from the listener and serves each of them in a
+// goroutine of its own, until the listener fails or the server is closed.
+// The listener is closed when Serve returns.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]bool)
+	}
+	s.listeners[listener] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, listener)
+		s.mu.Unlock()
+		listener.Close()
+	}()
+
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.ServeConn(netConn)
+	}
+}
+
+// ServeConn serves the requests on a single connection until the client
+// hangs up, which returns nil, or until reading a request or handling it
+// fails. The connection is closed when ServeConn returns. It can be given
+// one end of a net.Pipe to serve a client in memory.
+func (s *Server) ServeConn(netConn net.Conn) error {
+	conn := &Conn{
+		conn:   netConn,
+		reader: bufio.NewReader(netConn),
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		netConn.Close()
+		return ErrServerClosed
+	}
+	if s.conns == nil {
+		s.conns = make(map[*Conn]bool)
+	}
+	s.conns[conn] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		if closeHandler, ok := s.Handler.(CloseHandler); ok {
+			closeHandler.HandleClose(conn)
+		}
+	}()
+
+	for {
+		request, err := ReadRequest(conn.reader, s.maxMessageSize())
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = s.Handler.Handle(conn, request)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Close stops every Serve and closes every connection being served.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
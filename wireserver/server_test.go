@@ -0,0 +1,204 @@
+package wireserver_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dmliao/gomongo"
+	"github.com/dmliao/gomongo/wireserver"
+	"gopkg.in/mgo.v2/bson"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func marshal(t *testing.T, doc interface{}) []byte {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// unmarshal decodes a document of a request, which is bson.Raw.
+func unmarshal(t *testing.T, doc interface{}) bson.M {
+	raw, ok := doc.(bson.Raw)
+	if !ok {
+		t.Fatalf("document is a %T", doc)
+	}
+	var m bson.M
+	err := raw.Unmarshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// TestRequestRoundTrip writes a request of every opcode with WriteRequest,
+// and checks that ReadRequest decodes it back.
+func TestRequestRoundTrip(t *testing.T) {
+	header := gomongo.MsgHeader{RequestID: 7}
+	doc := marshal(t, bson.M{"a": 1})
+	requests := []wireserver.Request{
+		&gomongo.OpQuery{Header: header, Flags: 4, FullCollectionName: "test.$cmd", NumberToSkip: 1,
+			NumberToReturn: -1, Query: bson.M{"ping": 1}, Projection: bson.M{"a": 1}},
+		&gomongo.OpGetMore{Header: header, FullCollectionName: "test.c", NumberToReturn: 10, CursorID: 42},
+		&gomongo.OpKillCursors{Header: header, NumberOfCursorIDs: 2, CursorIDs: []int64{42, 43}},
+		&gomongo.OpInsert{Header: header, Flags: 1, FullCollectionName: "test.c", Documents: [][]byte{doc, doc}},
+		&gomongo.OpUpdate{Header: header, FullCollectionName: "test.c", Flags: 2, Selector: bson.M{"a": 1},
+			Update: bson.M{"a": 2}},
+		&gomongo.OpDelete{Header: header, FullCollectionName: "test.c", Flags: 1, Selector: bson.M{"a": 1}},
+		&gomongo.OpMsg{Header: header, FlagBits: gomongo.MSG_CHECKSUM_PRESENT, Sections: []gomongo.MsgSection{
+			{Kind: 0, Documents: [][]byte{marshal(t, bson.M{"insert": "c", "$db": "test"})}},
+			{Kind: 1, Identifier: "documents", Documents: [][]byte{doc}},
+		}},
+	}
+
+	for _, request := range requests {
+		var buf bytes.Buffer
+		err := wireserver.WriteRequest(&buf, request)
+		if err != nil {
+			t.Fatalf("%T: %v", request, err)
+		}
+		decoded, err := wireserver.ReadRequest(&buf, wireserver.DefaultMaxMessageSize)
+		if err != nil {
+			t.Fatalf("%T: %v", request, err)
+		}
+		if reflect.TypeOf(decoded) != reflect.TypeOf(request) || decoded.MessageHeader().RequestID != 7 {
+			t.Errorf("%T decoded as %T with header %+v", request, decoded, decoded.MessageHeader())
+			continue
+		}
+
+		ok := true
+		switch r := decoded.(type) {
+		case *gomongo.OpQuery:
+			ok = r.Flags == 4 && r.FullCollectionName == "test.$cmd" && r.NumberToSkip == 1 &&
+				r.NumberToReturn == -1 && unmarshal(t, r.Query)["ping"] == 1 && unmarshal(t, r.Projection)["a"] == 1
+		case *gomongo.OpGetMore:
+			ok = r.FullCollectionName == "test.c" && r.NumberToReturn == 10 && r.CursorID == 42
+		case *gomongo.OpKillCursors:
+			ok = reflect.DeepEqual(r.CursorIDs, []int64{42, 43})
+		case *gomongo.OpInsert:
+			ok = r.Flags == 1 && r.FullCollectionName == "test.c" && reflect.DeepEqual(r.Documents, [][]byte{doc, doc})
+		case *gomongo.OpUpdate:
+			ok = r.Flags == 2 && r.FullCollectionName == "test.c" && unmarshal(t, r.Selector)["a"] == 1 &&
+				unmarshal(t, r.Update)["a"] == 2
+		case *gomongo.OpDelete:
+			ok = r.Flags == 1 && r.FullCollectionName == "test.c" && unmarshal(t, r.Selector)["a"] == 1
+		case *gomongo.OpMsg:
+			ok = r.FlagBits == gomongo.MSG_CHECKSUM_PRESENT &&
+				reflect.DeepEqual(r.Sections, request.(*gomongo.OpMsg).Sections)
+		}
+		if !ok {
+			t.Errorf("%T decoded as %+v", request, decoded)
+		}
+	}
+}
+
+func TestReadRequestMalformed(t *testing.T) {
+	// a header claiming an OP_QUERY, followed by nothing
+	data := []byte{16, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0xd4, 0x07, 0, 0}
+	_, err := wireserver.ReadRequest(bytes.NewReader(data), wireserver.DefaultMaxMessageSize)
+	if _, ok := err.(wireserver.ProtocolError); !ok {
+		t.Errorf("read an empty OP_QUERY: %v", err)
+	}
+	data = []byte{0xff, 0xff, 0xff, 0x7f, 1, 0, 0, 0, 0, 0, 0, 0, 0xdd, 0x07, 0, 0}
+	_, err = wireserver.ReadRequest(bytes.NewReader(data), wireserver.DefaultMaxMessageSize)
+	if _, ok := err.(wireserver.ProtocolError); !ok {
+		t.Errorf("read a message longer than the maximum: %v", err)
+	}
+}
+
+// TestServe serves a client in memory, and checks that its requests reach
+// the handler and that Respond answers each in kind.
+func TestServe(t *testing.T) {
+	var handled []string
+	server := &wireserver.Server{
+		Handler: wireserver.HandlerFunc(func(conn *wireserver.Conn, request wireserver.Request) error {
+			name := fmt.Sprintf("%T", request)
+			handled = append(handled, name)
+			return conn.Respond(request, bson.M{"ok": 1, "request": name})
+		}),
+	}
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ServeConn(serverConn)
+	}()
+
+	body := marshal(t, bson.M{"ping": 1, "$db": "test"})
+	requests := []struct {
+		request wireserver.Request
+		// the opcode of the reply, or zero for none
+		reply int32
+	}{
+		{&gomongo.OpQuery{Header: gomongo.MsgHeader{RequestID: 1}, FullCollectionName: "test.$cmd",
+			NumberToReturn: -1, Query: bson.M{"ping": 1}}, gomongo.OP_REPLY},
+		{&gomongo.OpMsg{Header: gomongo.MsgHeader{RequestID: 2}, Sections: []gomongo.MsgSection{
+			{Kind: 0, Documents: [][]byte{body}}}}, gomongo.OP_MSG},
+		{&gomongo.OpInsert{Header: gomongo.MsgHeader{RequestID: 3}, FullCollectionName: "test.c",
+			Documents: [][]byte{body}}, 0},
+		{&gomongo.OpMsg{Header: gomongo.MsgHeader{RequestID: 4}, FlagBits: gomongo.MSG_MORE_TO_COME,
+			Sections: []gomongo.MsgSection{{Kind: 0, Documents: [][]byte{body}}}}, 0},
+		{&gomongo.OpGetMore{Header: gomongo.MsgHeader{RequestID: 5}, FullCollectionName: "test.c",
+			CursorID: 42}, gomongo.OP_REPLY},
+	}
+	for _, r := range requests {
+		err := wireserver.WriteRequest(client, r.request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.reply == 0 {
+			continue
+		}
+		reply, err := wireserver.ReadReply(client, wireserver.DefaultMaxMessageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := reply.MessageHeader()
+		if header.OpCode != r.reply || header.ResponseTo != r.request.MessageHeader().RequestID {
+			t.Errorf("%T answered with %+v", r.request, header)
+		}
+		var doc bson.M
+		err = bson.Unmarshal(reply.Documents()[0], &doc)
+		if err != nil || doc["request"] != fmt.Sprintf("%T", r.request) {
+			t.Errorf("%T answered with %v: %v", r.request, doc, err)
+		}
+	}
+
+	client.Close()
+	if err := <-served; err != nil {
+		t.Errorf("serving a client that hung up: %v", err)
+	}
+	if len(handled) != len(requests) {
+		t.Errorf("handled %v", handled)
+	}
+}
+
+// TestServeHandlerError checks that a handler's error ends the connection.
+func TestServeHandlerError(t *testing.T) {
+	failed := fmt.Errorf("failed")
+	server := &wireserver.Server{
+		Handler: wireserver.HandlerFunc(func(conn *wireserver.Conn, request wireserver.Request) error {
+			return failed
+		}),
+	}
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ServeConn(serverConn)
+	}()
+
+	err := wireserver.WriteRequest(client, &gomongo.OpKillCursors{CursorIDs: []int64{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != failed {
+		t.Errorf("serving returned %v", err)
+	}
+	_, err = wireserver.ReadReply(client, wireserver.DefaultMaxMessageSize)
+	if err == nil {
+		t.Error("the connection is still open")
+	}
+}
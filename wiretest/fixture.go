@@ -0,0 +1,99 @@
+// Package wiretest records the wire protocol conversations between the
+// driver and a server, and replays them later without a server, so that code
+// built on the driver can be tested deterministically.
+//
+// A Recorder and a Replayer are both gomongo.Dialer implementations, set as
+// the Dialer of the client options:
+//
+//	recorder := &wiretest.Recorder{}
+//	mongo, err := gomongo.ConnectWithOptions(&gomongo.ClientOptions{
+//		Hosts:  []string{"localhost:27017"},
+//		Dialer: recorder,
+//	})
+//	...
+//	mongo.Close()
+//	err = recorder.Fixture().Save("testdata/find.json")
+//
+// The recorder sees the bytes on the wire, so TLS has to be off while
+// recording.
+package wiretest
+
+import (
+	"encoding/json"
+	"github.com/dmliao/gomongo/buffer"
+	"io/ioutil"
+)
+
+// who sent a message
+const (
+	FromClient = "client"
+	FromServer = "server"
+)
+
+// Fixture is a recording of every connection a client opened.
+type Fixture struct {
+	Conversations []*Conversation `json:"conversations"`
+}
+
+// Conversation is the messages exchanged on one connection, in the order
+// they were sent.
+type Conversation struct {
+	Address string `json:"address"`
+	// Monitor is set on the connections the driver checks servers on in the
+	// background, which are replayed apart from the others.
+	Monitor  bool       `json:"monitor,omitempty"`
+	Messages []*Message `json:"messages"`
+}
+
+// Message is a whole wire protocol message, header included, exactly as it
+// was sent.
+type Message struct {
+	From string `json:"from"`
+	Data []byte `json:"data"`
+}
+
+// LoadFixture reads a fixture saved with Save.
+func LoadFixture(path string) (*Fixture, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fixture := &Fixture{}
+	err = json.Unmarshal(data, fixture)
+	if err != nil {
+		return nil, err
+	}
+	return fixture, nil
+}
+
+// Save writes the fixture to a file as JSON.
+func (f *Fixture) Save(path string) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// framer splits a stream of bytes into whole messages by their length
+// prefix.
+type framer struct {
+	pending []byte
+}
+
+// write adds bytes from the stream, and returns the messages they complete.
+func (f *framer) write(p []byte) [][]byte {
+	f.pending = append(f.pending, p...)
+	var messages [][]byte
+	for len(f.pending) >= 4 {
+		length := int(buffer.ConvertToInt32LE(f.pending))
+		if length < 4 || len(f.pending) < length {
+			break
+		}
+		message := make([]byte, length)
+		copy(message, f.pending)
+		messages = append(messages, message)
+		f.pending = f.pending[length:]
+	}
+	return messages
+}
@@ -0,0 +1,184 @@
+package wiretest
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dmliao/gomongo"
+	"github.com/dmliao/gomongo/wireserver"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultIgnore are the command fields that a replayed request doesn't have
+// to match: session IDs are random, the client metadata of the handshake
+// names the Go version and operating system that ran the recording, and
+// maxTimeMS is the time left before a context's deadline, which is never
+// quite the same twice.
+var DefaultIgnore = []string{"lsid", "client", "maxTimeMS"}
+
+// describe renders a request one line per part, with the ignored fields
+// left out of its commands, so that requests can be compared and diffed
+// line by line. The request ID is left out as well.
+func describe(data []byte, ignore map[string]bool) ([]string, error) {
+	request, err := wireserver.ReadRequest(bytes.NewReader(data), math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	switch r := request.(type) {
+	case *gomongo.OpMsg:
+		// the checksum depends on the request ID, so whether there is one
+		// doesn't matter either
+		flags := r.FlagBits &^ gomongo.MSG_CHECKSUM_PRESENT
+		lines = append(lines, fmt.Sprintf("OP_MSG flags %v", flags))
+		for _, section := range r.Sections {
+			for i, doc := range section.Documents {
+				if section.Kind == 0 {
+					lines = append(lines, "body: "+formatCommand(doc, ignore))
+				} else {
+					lines = append(lines, fmt.Sprintf("%v[%v]: %v", section.Identifier, i, formatRaw(doc)))
+				}
+			}
+		}
+	case *gomongo.OpQuery:
+		lines = append(lines, fmt.Sprintf("OP_QUERY %v flags %v skip %v return %v", r.FullCollectionName, r.Flags,
+			r.NumberToSkip, r.NumberToReturn))
+		lines = append(lines, "query: "+formatCommand(r.Query.(bson.Raw).Data, ignore))
+		if r.Projection != nil {
+			lines = append(lines, "projection: "+formatRaw(r.Projection.(bson.Raw).Data))
+		}
+	case *gomongo.OpGetMore:
+		lines = append(lines, fmt.Sprintf("OP_GET_MORE %v return %v cursor %v", r.FullCollectionName,
+			r.NumberToReturn, r.CursorID))
+	case *gomongo.OpKillCursors:
+		lines = append(lines, fmt.Sprintf("OP_KILL_CURSORS cursors %v", r.CursorIDs))
+	case *gomongo.OpInsert:
+		lines = append(lines, fmt.Sprintf("OP_INSERT %v flags %v", r.FullCollectionName, r.Flags))
+		for i, doc := range r.Documents {
+			lines = append(lines, fmt.Sprintf("documents[%v]: %v", i, formatRaw(doc)))
+		}
+	case *gomongo.OpUpdate:
+		lines = append(lines, fmt.Sprintf("OP_UPDATE %v flags %v", r.FullCollectionName, r.Flags))
+		lines = append(lines, "selector: "+formatRaw(r.Selector.(bson.Raw).Data))
+		lines = append(lines, "update: "+formatRaw(r.Update.(bson.Raw).Data))
+	case *gomongo.OpDelete:
+		lines = append(lines, fmt.Sprintf("OP_DELETE %v flags %v", r.FullCollectionName, r.Flags))
+		lines = append(lines, "selector: "+formatRaw(r.Selector.(bson.Raw).Data))
+	}
+	return lines, nil
+}
+
+// diff lists two descriptions side by side, marking the lines only in the
+// recording with "-" and the lines only in the request with "+". It returns
+// "" if they are the same.
+func diff(recorded []string, got []string) string {
+	same := len(recorded) == len(got)
+	var out []string
+	for i := 0; i < len(recorded) || i < len(got); i++ {
+		switch {
+		case i >= len(got):
+			out = append(out, "- "+recorded[i])
+			same = false
+		case i >= len(recorded):
+			out = append(out, "+ "+got[i])
+			same = false
+		case recorded[i] == got[i]:
+			out = append(out, "  "+got[i])
+		default:
+			out = append(out, "- "+recorded[i], "+ "+got[i])
+			same = false
+		}
+	}
+	if same {
+		return ""
+	}
+	return strings.Join(out, "\n")
+}
+
+// formatCommand renders a command document without the ignored fields. A
+// legacy command wrapped in $query has them removed inside the wrapper.
+func formatCommand(data []byte, ignore map[string]bool) string {
+	var doc bson.D
+	err := bson.Unmarshal(data, &doc)
+	if err != nil {
+		return fmt.Sprintf("<invalid document: %v>", err)
+	}
+	doc = withoutFields(doc, ignore)
+	for i, elem := range doc {
+		if query, ok := elem.Value.(bson.D); ok && elem.Name == "$query" {
+			doc[i].Value = withoutFields(query, ignore)
+		}
+	}
+	return formatValue(doc)
+}
+
+func withoutFields(doc bson.D, ignore map[string]bool) bson.D {
+	kept := bson.D{}
+	for _, elem := range doc {
+		if !ignore[elem.Name] {
+			kept = append(kept, elem)
+		}
+	}
+	return kept
+}
+
+func formatRaw(data []byte) string {
+	var doc bson.D
+	err := bson.Unmarshal(data, &doc)
+	if err != nil {
+		return fmt.Sprintf("<invalid document: %v>", err)
+	}
+	return formatValue(doc)
+}
+
+// formatValue renders a BSON value in a JSON-like form that keeps the order
+// of fields and shows the type of values that JSON can't tell apart.
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bson.D:
+		fields := make([]string, len(v))
+		for i, elem := range v {
+			fields[i] = strconv.Quote(elem.Name) + ": " + formatValue(elem.Value)
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	case bson.M:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fields := make([]string, len(names))
+		for i, name := range names {
+			fields[i] = strconv.Quote(name) + ": " + formatValue(v[name])
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = formatValue(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case string:
+		return strconv.Quote(v)
+	case int:
+		return fmt.Sprintf("int32(%v)", v)
+	case int64:
+		return fmt.Sprintf("int64(%v)", v)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bson.ObjectId:
+		return fmt.Sprintf("ObjectId(%q)", v.Hex())
+	case time.Time:
+		return fmt.Sprintf("Date(%q)", v.UTC().Format(time.RFC3339Nano))
+	case []byte:
+		return fmt.Sprintf("Binary(%x)", v)
+	}
+	return fmt.Sprintf("%v", value)
+}
@@ -0,0 +1,103 @@
+package wiretest
+
+import (
+	"context"
+	"github.com/dmliao/gomongo"
+	"github.com/dmliao/gomongo/internal/monitordial"
+	"net"
+	"sync"
+)
+
+// Recorder is a gomongo.Dialer that records every message sent and received
+// on the connections it opens.
+type Recorder struct {
+	// Dialer opens the connections to the server. Nil means a net.Dialer.
+	Dialer gomongo.Dialer
+
+	mu            sync.Mutex
+	conversations []*Conversation
+}
+
+func (r *Recorder) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := r.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	conversation := &Conversation{
+		Address: address,
+		Monitor: monitordial.Is(ctx),
+	}
+	r.mu.Lock()
+	r.conversations = append(r.conversations, conversation)
+	r.mu.Unlock()
+	return &recordingConn{
+		Conn:         conn,
+		recorder:     r,
+		conversation: conversation,
+	}, nil
+}
+
+// Fixture returns what has been recorded so far.
+func (r *Recorder) Fixture() *Fixture {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fixture := &Fixture{}
+	for _, conversation := range r.conversations {
+		copied := *conversation
+		copied.Messages = append([]*Message(nil), conversation.Messages...)
+		fixture.Conversations = append(fixture.Conversations, &copied)
+	}
+	return fixture
+}
+
+// add records the messages completed by bytes from one side of a
+// conversation.
+func (r *Recorder) add(conversation *Conversation, from string, messages [][]byte) {
+	if len(messages) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, data := range messages {
+		conversation.Messages = append(conversation.Messages, &Message{
+			From: from,
+			Data: data,
+		})
+	}
+}
+
+// recordingConn passes everything through to the real connection, and
+// records the messages that go by.
+type recordingConn struct {
+	net.Conn
+	recorder     *Recorder
+	conversation *Conversation
+
+	// the driver writes from one goroutine at a time and reads from
+	// another, so each direction has its own framer and lock
+	writeMu sync.Mutex
+	written framer
+	readMu  sync.Mutex
+	read    framer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.writeMu.Lock()
+	c.recorder.add(c.conversation, FromClient, c.written.write(p[:n]))
+	c.writeMu.Unlock()
+	return n, err
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.readMu.Lock()
+	c.recorder.add(c.conversation, FromServer, c.read.write(p[:n]))
+	c.readMu.Unlock()
+	return n, err
+}
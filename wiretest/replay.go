@@ -0,0 +1,286 @@
+package wiretest
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/dmliao/gomongo/internal/monitordial"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Replayer is a gomongo.Dialer that plays a fixture back in place of a
+// server. Each connection it opens gets the next unused conversation of the
+// fixture with the address dialed. The connections of monitors only get
+// conversations recorded on monitor connections and the others only the
+// rest, since monitors dial in the background and would otherwise race the
+// pool for them. The requests the client sends are checked against the
+// recorded ones, and the recorded replies are sent back with their
+// responseTo changed to the client's request IDs.
+//
+// Requests match if they have the same opcode, flags and documents, apart
+// from the fields named in Ignore. The request IDs don't have to match.
+type Replayer struct {
+	Fixture *Fixture
+	// Ignore names the top level command fields left out of the comparison.
+	// Nil means DefaultIgnore.
+	Ignore []string
+
+	mu sync.Mutex
+	// which conversations have been handed to a connection
+	used map[int]bool
+	err  error
+}
+
+// MismatchError is returned when a client sends a request that isn't the
+// next one in the recording. Diff shows the recorded request on lines marked
+// with "-" and the request that was sent on lines marked with "+".
+type MismatchError struct {
+	Connection int // which connection of the fixture, counting from 0
+	Message    int // which message of the connection, counting from 0
+	Diff       string
+}
+
+func (m *MismatchError) Error() string {
+	return fmt.Sprintf("request doesn't match message %v of connection %v in the recording:\n%v", m.Message,
+		m.Connection, m.Diff)
+}
+
+func (r *Replayer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	monitor := monitordial.Is(ctx)
+	number := -1
+	for i, conversation := range r.Fixture.Conversations {
+		if !r.used[i] && conversation.Address == address && conversation.Monitor == monitor {
+			number = i
+			break
+		}
+	}
+	if number < 0 {
+		kind := "connection"
+		if monitor {
+			kind = "monitor connection"
+		}
+		return nil, fmt.Errorf("wiretest: the recording has no more %vs to %v", kind, address)
+	}
+	if r.used == nil {
+		r.used = make(map[int]bool)
+	}
+	r.used[number] = true
+
+	ignore := r.Ignore
+	if ignore == nil {
+		ignore = DefaultIgnore
+	}
+	conn := &replayConn{
+		replayer:     r,
+		number:       number,
+		conversation: r.Fixture.Conversations[number],
+		ignore:       map[string]bool{},
+		changed:      make(chan struct{}),
+	}
+	for _, name := range ignore {
+		conn.ignore[name] = true
+	}
+	return conn, nil
+}
+
+// Err returns the first error a replayed connection ran into, if any. The
+// driver may retry or hide an error from the caller, so tests should check
+// this once they are done.
+func (r *Replayer) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Replayer) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// replayConn is a net.Conn that answers requests from a recorded
+// conversation.
+type replayConn struct {
+	replayer     *Replayer
+	number       int
+	conversation *Conversation
+	ignore       map[string]bool
+
+	mu       sync.Mutex
+	next     int // the next message of the conversation
+	requests framer
+	readable []byte
+	err      error
+	closed   bool
+	deadline time.Time
+	// closed and replaced whenever there may be something new to read
+	changed chan struct{}
+}
+
+type replayAddr string
+
+func (a replayAddr) Network() string {
+	return "tcp"
+}
+
+func (a replayAddr) String() string {
+	return string(a)
+}
+
+func (c *replayConn) LocalAddr() net.Addr {
+	return replayAddr("replay")
+}
+
+func (c *replayConn) RemoteAddr() net.Addr {
+	return replayAddr(c.conversation.Address)
+}
+
+// notify wakes up a blocked Read. c.mu must be held.
+func (c *replayConn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *replayConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	for _, request := range c.requests.write(p) {
+		err := c.replay(request)
+		if err != nil {
+			c.err = err
+			c.replayer.fail(err)
+			c.notify()
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// replay checks a request against the next message of the recording, and
+// queues the replies that followed it. c.mu must be held.
+func (c *replayConn) replay(request []byte) error {
+	got, err := describe(request, c.ignore)
+	if err != nil {
+		return err
+	}
+	if c.next >= len(c.conversation.Messages) {
+		return &MismatchError{
+			Connection: c.number,
+			Message:    c.next,
+			Diff:       diff(nil, got),
+		}
+	}
+	recorded := c.conversation.Messages[c.next]
+	if recorded.From != FromClient {
+		return fmt.Errorf("wiretest: message %v of connection %v is from the %v", c.next, c.number, recorded.From)
+	}
+	want, err := describe(recorded.Data, c.ignore)
+	if err != nil {
+		return err
+	}
+	difference := diff(want, got)
+	if difference != "" {
+		return &MismatchError{
+			Connection: c.number,
+			Message:    c.next,
+			Diff:       difference,
+		}
+	}
+	c.next++
+
+	recordedID := binary.LittleEndian.Uint32(recorded.Data[4:])
+	requestID := binary.LittleEndian.Uint32(request[4:])
+	for c.next < len(c.conversation.Messages) && c.conversation.Messages[c.next].From == FromServer {
+		reply := append([]byte(nil), c.conversation.Messages[c.next].Data...)
+		// replies further along an exhaust stream answer the previous reply
+		// rather than the request, and are left alone
+		if binary.LittleEndian.Uint32(reply[8:]) == recordedID {
+			binary.LittleEndian.PutUint32(reply[8:], requestID)
+		}
+		c.readable = append(c.readable, reply...)
+		c.next++
+	}
+	c.notify()
+	return nil
+}
+
+// Read returns the queued replies, and waits for more if there are none.
+func (c *replayConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.closed {
+			return 0, net.ErrClosed
+		}
+		if len(c.readable) > 0 {
+			n := copy(p, c.readable)
+			c.readable = c.readable[n:]
+			return n, nil
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !c.deadline.IsZero() {
+			wait := time.Until(c.deadline)
+			if wait <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		c.mu.Lock()
+	}
+}
+
+func (c *replayConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.notify()
+	return nil
+}
+
+func (c *replayConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *replayConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	c.notify()
+	return nil
+}
+
+// SetWriteDeadline does nothing, since writes never block.
+func (c *replayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
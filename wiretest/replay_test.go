@@ -0,0 +1,136 @@
+package wiretest_test
+
+import (
+	"context"
+	"github.com/dmliao/gomongo"
+	"github.com/dmliao/gomongo/wireserver"
+	"github.com/dmliao/gomongo/wiretest"
+	"gopkg.in/mgo.v2/bson"
+	"net"
+	"testing"
+	"time"
+)
+
+// serve answers the handshake, and find with the documents inserted so far.
+func serve(t *testing.T) string {
+	var docs []bson.Raw
+	handler := wireserver.HandlerFunc(func(conn *wireserver.Conn, request wireserver.Request) error {
+		msg, ok := request.(*gomongo.OpMsg)
+		if !ok {
+			return conn.Respond(request, bson.M{"ismaster": true, "maxWireVersion": 13, "ok": 1})
+		}
+		var command bson.D
+		err := bson.Unmarshal(msg.Sections[0].Documents[0], &command)
+		if err != nil {
+			return err
+		}
+		switch command[0].Name {
+		case "insert":
+			for _, doc := range msg.Sections[1].Documents {
+				docs = append(docs, bson.Raw{Kind: 0x03, Data: doc})
+			}
+			return conn.Respond(request, bson.M{"ok": 1, "n": len(msg.Sections[1].Documents)})
+		case "find":
+			return conn.Respond(request, bson.M{"ok": 1, "cursor": bson.M{
+				"id":         int64(0),
+				"ns":         "test.c",
+				"firstBatch": docs,
+			}})
+		}
+		return conn.Respond(request, bson.M{"ismaster": true, "maxWireVersion": 13, "ok": 1})
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &wireserver.Server{
+		Handler: handler,
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() {
+		server.Close()
+	})
+	return listener.Addr().String()
+}
+
+// insertAndFind inserts a document through the dialer and reads it back.
+func insertAndFind(ctx context.Context, t *testing.T, dialer gomongo.Dialer, address string) {
+	m, err := gomongo.ConnectWithOptions(&gomongo.ClientOptions{
+		Hosts:  []string{address},
+		Dialer: dialer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	c := m.GetDB("test").GetCollection("c")
+	_, err = c.InsertContext(ctx, bson.M{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := c.FindContext(ctx, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		A int `bson:"a"`
+	}
+	err = cursor.Next(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.A != 1 {
+		t.Errorf("found %+v", doc)
+	}
+}
+
+// TestReplayMonitor replays a recording whose monitor connection comes after
+// the pool's, as it does when the monitor reconnects while the pool is busy.
+func TestReplayMonitor(t *testing.T) {
+	address := serve(t)
+	recorder := &wiretest.Recorder{}
+	insertAndFind(context.Background(), t, recorder, address)
+
+	fixture := recorder.Fixture()
+	monitors := 0
+	for _, conversation := range fixture.Conversations {
+		if conversation.Monitor {
+			monitors++
+		}
+	}
+	if monitors != 1 || len(fixture.Conversations) != 2 {
+		t.Fatalf("recorded %v connections, %v of them monitors", len(fixture.Conversations), monitors)
+	}
+	conversations := fixture.Conversations
+	conversations[0], conversations[1] = conversations[1], conversations[0]
+
+	replayer := &wiretest.Replayer{
+		Fixture: fixture,
+	}
+	insertAndFind(context.Background(), t, replayer, address)
+	err := replayer.Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReplayMaxTimeMS replays a recording with another deadline than it was
+// recorded with, which changes the maxTimeMS sent with each command.
+func TestReplayMaxTimeMS(t *testing.T) {
+	address := serve(t)
+	recorder := &wiretest.Recorder{}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	insertAndFind(ctx, t, recorder, address)
+
+	replayer := &wiretest.Replayer{
+		Fixture: recorder.Fixture(),
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	insertAndFind(ctx, t, replayer, address)
+	err := replayer.Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
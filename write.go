@@ -0,0 +1,191 @@
+package gomongo
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// room left in each batch for the command itself and the fields the
+	// driver adds to it, such as $db and maxTimeMS. The server allows command
+	// documents this much larger than maxBsonObjectSize for the same reason.
+	writeCommandOverhead = 16 * 1024
+	// the most a document adds to an array element in a legacy command: a
+	// type byte, up to seven digits of index and a terminating null
+	arrayElementOverhead = 9
+)
+
+// WriteResult is the outcome of an insert, update or remove. When a write
+// fails part way, it counts the documents written before the failure.
+type WriteResult struct {
+	// N is the number of documents inserted, matched by an update or
+	// removed.
+	N int
+	// Modified is the number of documents an update changed.
+	Modified int
+
+	acknowledged bool
+}
+
+// unacknowledgedResult returns the result of a write with a w:0 write
+// concern, which is sent without waiting to hear back from the server. Its
+// counts are -1, since nothing is known about what was written.
+func unacknowledgedResult() *WriteResult {
+	return &WriteResult{
+		N:        -1,
+		Modified: -1,
+	}
+}
+
+// Acknowledged returns whether the server reported on the write, which is
+// when the counts of the result can be relied on.
+func (r *WriteResult) Acknowledged() bool {
+	return r.acknowledged
+}
+
+// writeReply is the reply to an insert, update or delete command.
+type writeReply struct {
+	Ok                float64            `bson:"ok"`
+	ErrMsg            string             `bson:"errmsg"`
+	Code              int32              `bson:"code"`
+	N                 int                `bson:"n"`
+	NModified         int                `bson:"nModified"`
+	WriteErrors       []WriteError       `bson:"writeErrors"`
+	WriteConcernError *WriteConcernError `bson:"writeConcernError"`
+}
+
+// executeWrite runs a write command with the documents as its identifier
+// sequence, split into as many commands as it takes to stay within the
+// server's batch and message size limits. Writes are ordered, so no batch is
+// sent after one with write errors. The results of the batches are added
+// up, and write errors are reported at the index of the document in docs.
+//
+// With a w:0 write concern the batches are sent without waiting for replies,
+// and the result is unacknowledged, with counts of -1.
+func (c *C) executeWrite(ctx context.Context, command bson.D, identifier string,
+	docs [][]byte) (*WriteResult, error) {
+	connection, err := c.database.mongo.checkout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.database.mongo.checkin(connection)
+
+	commandBytes, err := bson.Marshal(command)
+	if err != nil {
+		return nil, err
+	}
+	description := connection.description
+	if identifier == "documents" {
+		for i, doc := range docs {
+			if len(doc) > int(description.MaxBSONObjectSize) {
+				return nil, MongoError{
+					message: fmt.Sprintf("document at index %v is %v bytes, more than the maximum of %v",
+						i, len(doc), description.MaxBSONObjectSize),
+				}
+			}
+		}
+	}
+
+	maxSize := int(description.MaxMessageSizeBytes)
+	elementOverhead := 0
+	if !connection.supportsOpMsg() {
+		// the documents are folded into the command as an array
+		maxSize = int(description.MaxBSONObjectSize)
+		elementOverhead = arrayElementOverhead
+	}
+	maxSize -= len(commandBytes) + writeCommandOverhead
+	batches := splitBatches(docs, int(description.MaxWriteBatchSize), maxSize, elementOverhead)
+
+	unacknowledged := c.database.mongo.options.WriteConcern.unacknowledged()
+	if unacknowledged && connection.supportsOpMsg() {
+		for _, batch := range batches {
+			err = c.database.sendMsg(ctx, connection, commandBytes, MsgSection{
+				Kind:       1,
+				Identifier: identifier,
+				Documents:  batch,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return unacknowledgedResult(), nil
+	}
+
+	result := &WriteResult{
+		acknowledged: true,
+	}
+	var writeErrors []WriteError
+	var writeConcernError *WriteConcernError
+	offset := 0
+	for _, batch := range batches {
+		var reply writeReply
+		err = c.database.run(ctx, connection, command, &reply, MsgSection{
+			Kind:       1,
+			Identifier: identifier,
+			Documents:  batch,
+		})
+		if err != nil {
+			return result, err
+		}
+		if reply.Ok != 1 {
+			err = MongoError{
+				message: reply.ErrMsg,
+				code:    reply.Code,
+			}
+			c.database.mongo.serverError(connection, err)
+			return result, err
+		}
+
+		result.N += reply.N
+		result.Modified += reply.NModified
+		for _, writeError := range reply.WriteErrors {
+			writeError.Index += int32(offset)
+			writeErrors = append(writeErrors, writeError)
+		}
+		if reply.WriteConcernError != nil {
+			writeConcernError = reply.WriteConcernError
+		}
+		if len(reply.WriteErrors) > 0 {
+			break
+		}
+		offset += len(batch)
+	}
+
+	// servers without OP_MSG always reply, but w:0 writes are reported the
+	// same way everywhere
+	if unacknowledged {
+		result = unacknowledgedResult()
+	}
+	if len(writeErrors) > 0 {
+		return result, WriteErrors{
+			Errors: writeErrors,
+		}
+	}
+	if writeConcernError != nil {
+		return result, *writeConcernError
+	}
+	return result, nil
+}
+
+// splitBatches splits documents into batches of at most maxCount documents
+// and at most maxSize bytes, counting elementOverhead bytes on top of each
+// document. A document that is too big on its own gets a batch to itself.
+func splitBatches(docs [][]byte, maxCount int, maxSize int, elementOverhead int) [][][]byte {
+	var batches [][][]byte
+	start := 0
+	size := 0
+	for i, doc := range docs {
+		docSize := len(doc) + elementOverhead
+		if i > start && (i-start >= maxCount || size+docSize > maxSize) {
+			batches = append(batches, docs[start:i])
+			start = i
+			size = 0
+		}
+		size += docSize
+	}
+	if start < len(docs) {
+		batches = append(batches, docs[start:])
+	}
+	return batches
+}
@@ -0,0 +1,162 @@
+package gomongo_test
+
+import (
+	"github.com/dmliao/gomongo"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestUnacknowledgedResult checks that each w:0 write gets a result of its
+// own, so that a caller changing one doesn't change the next.
+func TestUnacknowledgedResult(t *testing.T) {
+	f := newFakeServer(t)
+	m := f.connect(&gomongo.ClientOptions{
+		WriteConcern: &gomongo.WriteConcern{
+			W: 0,
+		},
+	})
+	c := m.GetDB("test").GetCollection("c")
+
+	first, err := c.Insert(bson.M{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Acknowledged() || first.N != -1 {
+		t.Errorf("w:0 insert returned %+v, acknowledged %v", first, first.Acknowledged())
+	}
+	first.N = 1
+	second, err := c.Insert(bson.M{"a": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first || second.N != -1 {
+		t.Errorf("second w:0 insert returned %+v, the result of the first", second)
+	}
+
+	acknowledged, err := f.connect(nil).GetDB("test").GetCollection("c").Insert(bson.M{"a": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acknowledged.Acknowledged() || acknowledged.N != 1 {
+		t.Errorf("insert returned %+v, acknowledged %v", acknowledged, acknowledged.Acknowledged())
+	}
+}
+
+// insertDocs inserts count documents, each padded to about size bytes.
+// Failing marks the document at that index to fail, if it isn't negative.
+func insertDocs(c gomongo.Collection, count int, size int, failing int) (*gomongo.WriteResult, error) {
+	docs := make([]interface{}, count)
+	for i := range docs {
+		doc := bson.M{"i": i, "padding": strings.Repeat("x", size)}
+		if i == failing {
+			doc["fail"] = true
+		}
+		docs[i] = doc
+	}
+	return c.Insert(docs...)
+}
+
+func TestInsertBatches(t *testing.T) {
+	tests := []struct {
+		name  string
+		hello bson.M
+		size  int
+		want  []int
+	}{{
+		name:  "by count",
+		hello: bson.M{"maxWriteBatchSize": 3},
+		size:  10,
+		want:  []int{3, 3, 1},
+	}, {
+		// the driver keeps 16KB for the command, and each document is a
+		// little over 250 bytes
+		name:  "by size",
+		hello: bson.M{"maxMessageSizeBytes": 16*1024 + 1000},
+		size:  250,
+		want:  []int{3, 3, 1},
+	}, {
+		name:  "by size, with documents as big as a batch",
+		hello: bson.M{"maxMessageSizeBytes": 16*1024 + 1000},
+		size:  2000,
+		want:  []int{1, 1, 1, 1, 1, 1, 1},
+	}}
+	for _, test := range tests {
+		f := newFakeServer(t)
+		for key, value := range test.hello {
+			f.hello[key] = value
+		}
+		c := f.connect(nil).GetDB("test").GetCollection("c")
+		result, err := insertDocs(c, 7, test.size, -1)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if result.N != 7 {
+			t.Errorf("%v: inserted %v documents", test.name, result.N)
+		}
+		if got := f.insertSizes(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: sent batches of %v documents instead of %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestInsertTooLarge(t *testing.T) {
+	f := newFakeServer(t)
+	f.hello["maxBsonObjectSize"] = 1000
+	c := f.connect(nil).GetDB("test").GetCollection("c")
+	_, err := c.Insert(bson.M{"a": 1}, bson.M{"padding": strings.Repeat("x", 1000)})
+	if err == nil || !strings.Contains(err.Error(), "index 1") {
+		t.Errorf("inserted a document over the maximum size: %v", err)
+	}
+	if sizes := f.insertSizes(); len(sizes) != 0 {
+		t.Errorf("sent batches of %v documents", sizes)
+	}
+}
+
+// TestInsertWriteErrors checks that write errors are reported at the index
+// of the document among all those inserted, not within its batch, and that
+// no batch is sent after one that failed.
+func TestInsertWriteErrors(t *testing.T) {
+	f := newFakeServer(t)
+	f.hello["maxWriteBatchSize"] = 3
+	c := f.connect(nil).GetDB("test").GetCollection("c")
+	result, err := insertDocs(c, 9, 10, 4)
+	writeErrors, ok := err.(gomongo.WriteErrors)
+	if !ok || len(writeErrors.Errors) != 1 || writeErrors.Errors[0].Index != 4 {
+		t.Fatalf("inserting with a failing document: %#v", err)
+	}
+	if result.N != 4 {
+		t.Errorf("inserted %v documents before the failing one", result.N)
+	}
+	if sizes := f.insertSizes(); !reflect.DeepEqual(sizes, []int{3, 3}) {
+		t.Errorf("sent batches of %v documents", sizes)
+	}
+}
+
+// TestUnacknowledgedBatches checks that w:0 inserts are split like the
+// others, and that their result is unacknowledged.
+func TestUnacknowledgedBatches(t *testing.T) {
+	f := newFakeServer(t)
+	f.hello["maxWriteBatchSize"] = 3
+	m := f.connect(&gomongo.ClientOptions{
+		WriteConcern: &gomongo.WriteConcern{
+			W: 0,
+		},
+	})
+	result, err := insertDocs(m.GetDB("test").GetCollection("c"), 7, 10, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Acknowledged() || result.N != -1 {
+		t.Errorf("w:0 insert returned %+v, acknowledged %v", result, result.Acknowledged())
+	}
+	// a reply to a command on the same connection means the inserts got there
+	err = m.GetDB("test").ExecuteCommand(bson.M{"ping": 1}, &bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizes := f.insertSizes(); !reflect.DeepEqual(sizes, []int{3, 3, 1}) {
+		t.Errorf("sent batches of %v documents", sizes)
+	}
+}